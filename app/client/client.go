@@ -0,0 +1,228 @@
+// Package client talks to the server over RESP, sharing its encoder and
+// decoder with the protocol package.
+//
+// Commands run on pooled connections. Commands which change the state of
+// a connection are handled by the client itself: authentication and the
+// protocol version are set through Options, transactions go through
+// TxPipeline and subscriptions get a dedicated connection through PubSub.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// returned for null replies, such as GET of a missing key
+var ErrNil = errors.New("client: nil reply")
+
+var ErrClosed = errors.New("client: closed")
+
+// an error reply sent by the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+type Options struct {
+	// tcp by default, unix to connect through a unix socket
+	Network string
+	Addr    string
+
+	// AUTH is sent on every new connection when a password is given,
+	// the default user is used without a username
+	Username string
+	Password string
+	// set through HELLO SETNAME on every new connection
+	ClientName string
+	// RESP version negotiated through HELLO, 2 by default
+	Protocol int
+
+	// maximum number of connections open at once, 10 by default
+	PoolSize int
+	// 5 seconds by default
+	DialTimeout time.Duration
+	// connects over TLS when set
+	TLSConfig *tls.Config
+}
+
+type Client struct {
+	opts Options
+	// connections waiting to be reused
+	idle chan *conn
+	// one token per connection the pool may still open
+	slots  chan unit
+	closed atomic.Bool
+}
+
+type unit struct{}
+
+func New(opts Options) *Client {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.Protocol == 0 {
+		opts.Protocol = 2
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	c := &Client{
+		opts:  opts,
+		idle:  make(chan *conn, opts.PoolSize),
+		slots: make(chan unit, opts.PoolSize),
+	}
+	for i := 0; i < opts.PoolSize; i++ {
+		c.slots <- unit{}
+	}
+	return c
+}
+
+// closes the idle connections, connections in use are closed
+// once they are given back
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.close()
+		default:
+			return nil
+		}
+	}
+}
+
+// sends a command and returns its reply, error replies are returned
+// as an Error
+func (c *Client) Do(ctx context.Context, args ...string) (protocol.Value, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	var v protocol.Value
+	err = cn.withContext(ctx, cn.nc.SetDeadline, func() error {
+		if err := cn.writeCommands([]string{protocol.SerializeCommand(args...)}); err != nil {
+			return err
+		}
+		v, err = cn.read()
+		return err
+	})
+	c.put(cn, err)
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	if v.IsError() {
+		return v, Error(v.Str)
+	}
+	return v, nil
+}
+
+// takes an idle connection from the pool, dialing one if the pool
+// has room for it
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case <-c.slots:
+		cn, err := c.dial(ctx)
+		if err != nil {
+			c.slots <- unit{}
+			return nil, err
+		}
+		return cn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// gives the connection back to the pool, connections which failed at
+// the network level may hold half read replies and are closed instead
+func (c *Client) put(cn *conn, err error) {
+	if err != nil || c.closed.Load() {
+		cn.close()
+		c.slots <- unit{}
+		return
+	}
+	c.idle <- cn
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+
+	var nc net.Conn
+	var err error
+	if c.opts.TLSConfig != nil {
+		d := tls.Dialer{Config: c.opts.TLSConfig}
+		nc, err = d.DialContext(ctx, c.opts.Network, c.opts.Addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, c.opts.Network, c.opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := newConn(nc)
+	if err := c.init(ctx, cn); err != nil {
+		cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// authenticates the new connection and negotiates its protocol
+func (c *Client) init(ctx context.Context, cn *conn) error {
+	var args []string
+	if c.opts.Protocol != 2 || c.opts.ClientName != "" {
+		args = []string{"HELLO", strconv.Itoa(c.opts.Protocol)}
+		if c.opts.Password != "" {
+			username := c.opts.Username
+			if username == "" {
+				username = "default"
+			}
+			args = append(args, "AUTH", username, c.opts.Password)
+		}
+		if c.opts.ClientName != "" {
+			args = append(args, "SETNAME", c.opts.ClientName)
+		}
+	} else if c.opts.Password != "" {
+		args = []string{"AUTH", c.opts.Password}
+		if c.opts.Username != "" {
+			args = []string{"AUTH", c.opts.Username, c.opts.Password}
+		}
+	} else {
+		return nil
+	}
+
+	return cn.withContext(ctx, cn.nc.SetDeadline, func() error {
+		if err := cn.writeCommands([]string{protocol.SerializeCommand(args...)}); err != nil {
+			return err
+		}
+		v, err := cn.read()
+		if err != nil {
+			return err
+		}
+		if v.IsError() {
+			return Error(v.Str)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,948 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// starts a server on a free port, shut down along with the test
+func startServer(t *testing.T, opts ...protocol.ServerOptFunc) *protocol.Server {
+	t.Helper()
+	opts = append([]protocol.ServerOptFunc{protocol.WithAddressAndPort("127.0.0.1", 0)}, opts...)
+	s, err := protocol.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %s", err)
+		}
+	})
+	return s
+}
+
+func newTestClient(t *testing.T, s *protocol.Server, opts Options) *Client {
+	t.Helper()
+	opts.Addr = s.Addr().String()
+	c := New(opts)
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestStrings(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "key", "multi\r\nline"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "key"); err != nil || got != "multi\r\nline" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, want ErrNil", err)
+	}
+
+	if err := c.SetPX(ctx, "short", "v", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Get(ctx, "short"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, the key should have expired", err)
+	}
+
+	var replyErr Error
+	if _, err := c.Do(ctx, "NOSUCHCOMMAND"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "ERR unknown command") {
+		t.Fatalf("got %v, want an unknown command error", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	p := c.Pipeline()
+	p.Queue("SET", "a", "1")
+	p.Queue("GET", "a")
+	p.Queue("NOSUCHCOMMAND")
+	p.Queue("ECHO", "done")
+	replies, err := p.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 4 || replies[1].Str != "1" || !replies[2].IsError() || replies[3].Str != "done" {
+		t.Fatalf("got %+v", replies)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	tx := c.TxPipeline()
+	tx.Queue("SET", "a", "1")
+	tx.Queue("GET", "a")
+	tx.Queue("SET", "b", "2")
+	replies, err := tx.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 || replies[0].Str != "OK" || replies[1].Str != "1" || replies[2].Str != "OK" {
+		t.Fatalf("got %+v", replies)
+	}
+
+	// a command which can't be queued discards the whole transaction
+	tx.Queue("SET", "a", "changed")
+	tx.Queue("NOSUCHCOMMAND")
+	if _, err := tx.Exec(ctx); err == nil || !strings.HasPrefix(err.Error(), "EXECABORT") {
+		t.Fatalf("got %v, want EXECABORT", err)
+	}
+	if got, err := c.Get(ctx, "a"); err != nil || got != "1" {
+		t.Fatalf("got %q %v, the discarded transaction should not have run", got, err)
+	}
+}
+
+func TestTransactionIsolation(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{PoolSize: 4})
+
+	// every transaction reads the counter it writes, interleaved
+	// transactions would read a value another one already wrote
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := c.TxPipeline()
+			tx.Queue("EVAL", "return redis.call('SET', 'counter', tonumber(redis.call('GET', 'counter') or '0') + 1)", "0")
+			tx.Queue("GET", "counter")
+			if _, err := tx.Exec(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "counter"); err != nil || got != "20" {
+		t.Fatalf("got %q %v, want 20", got, err)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	ps, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Kind != "subscribe" || msg.Channel != "news" || msg.Count != 1 {
+		t.Fatalf("got %+v", msg)
+	}
+	if err := ps.PSubscribe(ctx, "sport.*"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = ps.Receive(ctx); err != nil || msg.Kind != "psubscribe" || msg.Count != 2 {
+		t.Fatalf("got %+v %v", msg, err)
+	}
+
+	if n, err := c.Publish(ctx, "news", "hello"); err != nil || n != 1 {
+		t.Fatalf("got %d %v, want 1 receiver", n, err)
+	}
+	if n, err := c.Publish(ctx, "sport.tennis", "match"); err != nil || n != 1 {
+		t.Fatalf("got %d %v, want 1 receiver", n, err)
+	}
+	if n, err := c.Publish(ctx, "weather", "rain"); err != nil || n != 0 {
+		t.Fatalf("got %d %v, want no receiver", n, err)
+	}
+
+	messages := ps.Channel()
+	want := []Message{
+		{Kind: "message", Channel: "news", Payload: "hello"},
+		{Kind: "pmessage", Pattern: "sport.*", Channel: "sport.tennis", Payload: "match"},
+	}
+	for _, w := range want {
+		select {
+		case msg := <-messages:
+			if *msg != w {
+				t.Fatalf("got %+v, want %+v", *msg, w)
+			}
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+	}
+
+	if counts, err := c.PubSubNumSub(ctx, "news", "weather"); err != nil || counts["news"] != 1 || counts["weather"] != 0 {
+		t.Fatalf("got %v %v", counts, err)
+	}
+	if err := ps.Unsubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.Kind != "unsubscribe" || msg.Channel != "news" || msg.Count != 1 {
+			t.Fatalf("got %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("unsubscribe not confirmed")
+	}
+}
+
+func TestPool(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{PoolSize: 2, ClientName: "pooled"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Ping(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	admin := newTestClient(t, s, Options{})
+	list, err := admin.ClientList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(list, "name=pooled"); n < 1 || n > 2 {
+		t.Fatalf("got %d pooled connections, want at most the pool size of 2:\n%s", n, list)
+	}
+
+	// callers wait for a connection once the pool is exhausted, instead
+	// of dialing another one
+	single := newTestClient(t, s, Options{PoolSize: 1, ClientName: "single"})
+	if err := single.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ClientPause(ctx, 500*time.Millisecond, "ALL"); err != nil {
+		t.Fatal(err)
+	}
+	paused := make(chan error)
+	go func() {
+		paused <- single.Ping(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := single.Ping(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to expire while waiting for a connection", err)
+	}
+	if err := <-paused; err != nil {
+		t.Fatal(err)
+	}
+	if err := single.Ping(ctx); err != nil {
+		t.Fatalf("the connection should be back in the pool: %s", err)
+	}
+	if list, err = admin.ClientList(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(list, "name=single"); n != 1 {
+		t.Fatalf("got %d connections, want the single one of the pool:\n%s", n, list)
+	}
+
+	single.Close()
+	if err := single.Ping(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	admin := newTestClient(t, s, Options{})
+	if err := admin.ACLSetUser(ctx, "reader", "on", ">secret", "~*", "+get", "+ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newTestClient(t, s, Options{Username: "reader", Password: "secret"})
+	if user, err := reader.ACLWhoAmI(ctx); err == nil {
+		t.Fatalf("reader ran ACL WHOAMI as %s without the permission", user)
+	}
+	if _, err := reader.Get(ctx, "key"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, want ErrNil", err)
+	}
+	var replyErr Error
+	if err := reader.Set(ctx, "key", "v"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "NOPERM") {
+		t.Fatalf("got %v, want NOPERM", err)
+	}
+
+	wrong := newTestClient(t, s, Options{Username: "reader", Password: "wrong", Protocol: 3})
+	if err := wrong.Ping(ctx); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "WRONGPASS") {
+		t.Fatalf("got %v, want WRONGPASS", err)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	ctx := testContext(t)
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	library := "#!lua name=mylib\nredis.register_function('answer', function() return 42 end)"
+
+	s := startServer(t, protocol.WithSnapshotFile(path))
+	c := newTestClient(t, s, Options{})
+	if _, err := c.FunctionLoad(ctx, library, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "key", "saved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-s.Done()
+
+	// the libraries and the keys are loaded back on start
+	restarted := startServer(t, protocol.WithSnapshotFile(path))
+	c = newTestClient(t, restarted, Options{})
+	if v, err := c.FCall(ctx, "answer", nil); err != nil || v.Int != 42 {
+		t.Fatalf("got %+v %v, want the function to be restored", v, err)
+	}
+	if got, err := c.Get(ctx, "key"); err != nil || got != "saved" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	// the library code runs once, its functions keep their state between calls
+	library := "#!lua name=lib\n" +
+		"local calls = 0\n" +
+		"redis.register_function('count', function() calls = calls + 1 return calls end)\n" +
+		"redis.register_function('store', function(keys, args) return redis.call('SET', keys[1], args[1]) end)"
+	if name, err := c.FunctionLoad(ctx, library, false); err != nil || name != "lib" {
+		t.Fatalf("got %q %v", name, err)
+	}
+	for want := int64(1); want <= 2; want++ {
+		if v, err := c.FCall(ctx, "count", nil); err != nil || v.Int != want {
+			t.Fatalf("got %+v %v, want %d", v, err, want)
+		}
+	}
+	if _, err := c.FCall(ctx, "store", []string{"key"}, "from function"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "key"); err != nil || got != "from function" {
+		t.Fatalf("got %q %v", got, err)
+	}
+
+	var replyErr Error
+	if _, err := c.FunctionLoad(ctx, "#!lua name=calls\nredis.call('SET', 'k', 'v')", false); !errors.As(err, &replyErr) {
+		t.Fatalf("got %v, redis.call should not be allowed while loading", err)
+	}
+	if _, err := c.FunctionLoad(ctx, "#!lua name=loop\nwhile true do end", false); !errors.As(err, &replyErr) || !strings.Contains(string(replyErr), "timeout") {
+		t.Fatalf("got %v, want the load to time out", err)
+	}
+	// reloading starts over with a fresh state
+	if _, err := c.FunctionLoad(ctx, library, true); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.FCall(ctx, "count", nil); err != nil || v.Int != 1 {
+		t.Fatalf("got %+v %v, want 1", v, err)
+	}
+}
+
+func TestShutdownBusyScript(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{})
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.Eval(ctx, "while true do end", nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the script holds the server, shutting down gives up at the deadline
+	// and aborts it
+	shutdownCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to expire", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %s, past its deadline", elapsed)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("the script kept running after shutdown")
+	}
+}
+
+func TestBusyScript(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t, protocol.WithBusyScriptTimeout(50*time.Millisecond))
+	admin := newTestClient(t, s, Options{})
+	if err := admin.ACLSetUser(ctx, "reader", "on", ">secret", "~*", "+get", "+shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	// clients connect before the script holds the server
+	reader := newTestClient(t, s, Options{Username: "reader", Password: "secret"})
+	if _, err := reader.Get(ctx, "key"); !errors.Is(err, ErrNil) {
+		t.Fatal(err)
+	}
+	if err := admin.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	script := newTestClient(t, s, Options{})
+	done := make(chan error)
+	go func() {
+		_, err := script.Eval(ctx, "while true do end", nil)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	var replyErr Error
+	if _, err := reader.Get(ctx, "key"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "BUSY") {
+		t.Fatalf("got %v, want BUSY", err)
+	}
+	if err := reader.ScriptKill(ctx); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "NOPERM") {
+		t.Fatalf("got %v, want NOPERM", err)
+	}
+	if err := admin.ScriptKill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.As(err, &replyErr) || !strings.Contains(string(replyErr), "Script killed") {
+		t.Fatalf("got %v, want the script to be killed", err)
+	}
+}
+
+func TestBusyScriptACLLog(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t, protocol.WithBusyScriptTimeout(50*time.Millisecond))
+	admin := newTestClient(t, s, Options{})
+	if err := admin.ACLSetUser(ctx, "scripter", "on", ">secret", "~*", "+eval"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ACLSetUser(ctx, "reader", "on", ">secret", "~*", "+get"); err != nil {
+		t.Fatal(err)
+	}
+	reader := newTestClient(t, s, Options{Username: "reader", Password: "secret"})
+	scripter := newTestClient(t, s, Options{Username: "scripter", Password: "secret"})
+	// clients connect before the script holds the server
+	if _, err := reader.Get(ctx, "key"); !errors.Is(err, ErrNil) {
+		t.Fatal(err)
+	}
+	if _, err := scripter.Eval(ctx, "return 1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the script keeps logging denials while the reader gets denied too
+	done := make(chan error)
+	go func() {
+		_, err := scripter.Eval(ctx, "while true do redis.pcall('SET', 'key', 'v') end", nil)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	var replyErr Error
+	for i := 0; i < 10; i++ {
+		if err := reader.ScriptKill(ctx); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "NOPERM") {
+			t.Fatalf("got %v, want NOPERM", err)
+		}
+	}
+	if err := admin.ScriptKill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	log, err := admin.ACLLog(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, entry := range log.Elems {
+		fields := map[string]protocol.Value{}
+		for i := 0; i+1 < len(entry.Elems); i += 2 {
+			fields[entry.Elems[i].Str] = entry.Elems[i+1]
+		}
+		found[fields["username"].Str+" "+fields["context"].Str+" "+fields["object"].Str] = true
+	}
+	for _, want := range []string{"scripter lua set", "reader toplevel script"} {
+		if !found[want] {
+			t.Errorf("no ACL log entry for %s: %v", want, found)
+		}
+	}
+}
+
+func TestBusyScriptOnReplica(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	replica := startServer(t,
+		protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port),
+		protocol.WithBusyScriptTimeout(50*time.Millisecond),
+	)
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "before", "1")
+
+	script := newTestClient(t, replica, Options{})
+	if err := script.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := script.Eval(ctx, "while true do end", nil)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// the write waits for the script instead of being refused as busy
+	if err := m.Set(ctx, "during", "1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := r.ScriptKill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	waitReplicated(t, ctx, m, r, "after", "1")
+	if got, err := r.Get(ctx, "during"); err != nil || got != "1" {
+		t.Fatalf("got %q %v, the write sent during the script was lost", got, err)
+	}
+}
+
+// sets the key on the master and waits for the replica to have it
+func waitReplicated(t *testing.T, ctx context.Context, m, r *Client, key, value string) {
+	t.Helper()
+	if err := m.Set(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		got, err := r.Get(ctx, key)
+		if err == nil && got == value {
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("%s didn't reach the replica: %q %v", key, got, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// opens a connection outside of the client, for tests reading pushes
+// or replies the client doesn't expose
+func dialServer(t *testing.T, s *protocol.Server) *conn {
+	t.Helper()
+	nc, err := net.DialTimeout("tcp", s.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	cn := newConn(nc)
+	t.Cleanup(func() {
+		cn.close()
+	})
+	return cn
+}
+
+// sends the command and reads the next value, which might be a push
+func rawCommand(t *testing.T, cn *conn, args ...string) protocol.Value {
+	t.Helper()
+	if err := cn.writeCommands([]string{protocol.SerializeCommand(args...)}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := cn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// sends a command which causes a push to the same connection, the push
+// and the reply might be received in any order
+func rawCommandWithPush(t *testing.T, cn *conn, args ...string) (reply, push protocol.Value) {
+	t.Helper()
+	first := rawCommand(t, cn, args...)
+	second, err := cn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Type == protocol.PushType {
+		return second, first
+	}
+	return first, second
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	ctx := testContext(t)
+	if _, err := protocol.ParseKeyspaceEventFlags("Ee"); err == nil {
+		t.Fatal("evicted events are never emitted, the flag should be rejected")
+	}
+	classes, err := protocol.ParseKeyspaceEventFlags("E$gx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, startServer(t, protocol.WithKeyspaceEvents(classes)), Options{})
+
+	ps, err := c.PSubscribe(ctx, "__keyevent@0__:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if msg, err := ps.Receive(ctx); err != nil || msg.Kind != "psubscribe" {
+		t.Fatalf("got %+v %v", msg, err)
+	}
+	if err := c.SetPX(ctx, "key", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	messages := ps.Channel()
+	// the expiration is published by the timer, without any request
+	for _, event := range []string{"set", "expire", "expired"} {
+		select {
+		case msg := <-messages:
+			if msg.Channel != "__keyevent@0__:"+event || msg.Payload != "key" {
+				t.Fatalf("got %+v, want the %s event", *msg, event)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%s event not received", event)
+		}
+	}
+}
+
+// the replica keeps an expired key, missing it for reads, until the
+// master deletes it
+func TestExpirePropagation(t *testing.T) {
+	ctx := testContext(t)
+	classes, err := protocol.ParseKeyspaceEventFlags("Egx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := startServer(t, protocol.WithBusyScriptTimeout(50*time.Millisecond))
+	replica := startServer(t,
+		protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port),
+		protocol.WithKeyspaceEvents(classes),
+	)
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "before", "1")
+
+	ps, err := r.PSubscribe(ctx, "__keyevent@0__:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if msg, err := ps.Receive(ctx); err != nil || msg.Kind != "psubscribe" {
+		t.Fatalf("got %+v %v", msg, err)
+	}
+	messages := ps.Channel()
+	killer := newTestClient(t, master, Options{})
+	if err := killer.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPX(ctx, "key", "value", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.Channel != "__keyevent@0__:expire" {
+			t.Fatalf("got %+v, want the expire event", *msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("expire event not received")
+	}
+
+	// the busy script holds the master's expiration timer
+	done := make(chan error)
+	go func() {
+		_, err := m.Eval(ctx, "while true do end", nil)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := r.Get(ctx, "key"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, the replica served an expired key", err)
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("got %+v, the replica expired the key on its own", *msg)
+	default:
+	}
+
+	if err := killer.ScriptKill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	select {
+	case msg := <-messages:
+		if msg.Channel != "__keyevent@0__:del" || msg.Payload != "key" {
+			t.Fatalf("got %+v, want the key deleted by the master", *msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("the master didn't delete the key")
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	s := startServer(t)
+	cn := dialServer(t, s)
+	id := rawCommand(t, cn, "CLIENT", "ID").Int
+	if v := rawCommand(t, cn, "CLIENT", "SETNAME", "bad name"); !v.IsError() {
+		t.Fatalf("got %+v, want names with spaces refused", v)
+	}
+	rawCommand(t, cn, "CLIENT", "SETNAME", "worker")
+	if v := rawCommand(t, cn, "CLIENT", "GETNAME"); v.Str != "worker" {
+		t.Fatalf("got %+v", v)
+	}
+	rawCommand(t, cn, "CLIENT", "NO-EVICT", "ON")
+	info := rawCommand(t, cn, "CLIENT", "INFO").Str
+	for _, field := range []string{fmt.Sprintf("id=%d ", id), " name=worker ", " flags=e ", " cmd=client|info "} {
+		if !strings.Contains(info, field) {
+			t.Fatalf("got %q, want %q in it", info, field)
+		}
+	}
+
+	sub := dialServer(t, s)
+	subID := rawCommand(t, sub, "CLIENT", "ID").Int
+	rawCommand(t, sub, "SUBSCRIBE", "news")
+	list := rawCommand(t, cn, "CLIENT", "LIST", "TYPE", "pubsub").Str
+	if !strings.HasPrefix(list, fmt.Sprintf("id=%d ", subID)) || strings.Count(list, "\n") != 1 {
+		t.Fatalf("got %q, want the subscriber alone", list)
+	}
+	list = rawCommand(t, cn, "CLIENT", "LIST", "ID", strconv.FormatInt(id, 10)).Str
+	if !strings.Contains(list, " name=worker ") || strings.Count(list, "\n") != 1 {
+		t.Fatalf("got %q", list)
+	}
+
+	if v := rawCommand(t, cn, "CLIENT", "KILL", "127.0.0.1:1"); !v.IsError() {
+		t.Fatalf("got %+v, want no such client", v)
+	}
+	if v := rawCommand(t, cn, "CLIENT", "KILL", "ID", strconv.FormatInt(subID, 10)); v.Int != 1 {
+		t.Fatalf("got %+v, want the subscriber killed", v)
+	}
+	if _, err := sub.read(); err == nil {
+		t.Fatal("the killed client is still connected")
+	}
+	// SKIPME defaults to yes
+	if v := rawCommand(t, cn, "CLIENT", "KILL", "TYPE", "normal"); v.Int != 0 {
+		t.Fatalf("got %+v, want the caller spared", v)
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	cn := dialServer(t, startServer(t))
+	if err := cn.writeCommands([]string{
+		protocol.SerializeCommand("CLIENT", "REPLY", "OFF"),
+		protocol.SerializeCommand("SET", "key", "1"),
+		protocol.SerializeCommand("CLIENT", "REPLY", "ON"),
+		protocol.SerializeCommand("CLIENT", "REPLY", "SKIP"),
+		protocol.SerializeCommand("SET", "key", "2"),
+		protocol.SerializeCommand("GET", "key"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"OK", "2"} {
+		if v, err := cn.read(); err != nil || v.Str != want {
+			t.Fatalf("got %+v %v, want %q", v, err, want)
+		}
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{})
+	admin := newTestClient(t, s, Options{})
+	if err := c.Set(ctx, "key", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ClientPause(ctx, 5*time.Second, "WRITE"); err != nil {
+		t.Fatal(err)
+	}
+	// reads go on during a write pause
+	if got, err := c.Get(ctx, "key"); err != nil || got != "1" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	written := make(chan error)
+	go func() {
+		written <- c.Set(ctx, "key", "2")
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("got %v, the write ran during the pause", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := admin.ClientUnpause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "key"); err != nil || got != "2" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+// ACL LOAD replaces the users and disconnects the clients of the
+// users it removed, ACL SAVE writes the current users
+func TestACLFile(t *testing.T) {
+	ctx := testContext(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(path, []byte("user alice on >secret ~* +get +ping\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(t, protocol.WithACLFile(path))
+	admin := newTestClient(t, s, Options{})
+	alice := newTestClient(t, s, Options{Username: "alice", Password: "secret"})
+	if err := alice.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := admin.ACLSetUser(ctx, "bob", "on", ">pw", "+get"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ACLSave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "user bob on") || !strings.Contains(string(saved), "user alice on") {
+		t.Fatalf("got %q, want alice and bob saved", saved)
+	}
+
+	if err := os.WriteFile(path, []byte("user bob on >pw +get\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ACLLoad(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := admin.ACLUsers(ctx); err != nil || !reflect.DeepEqual(users, []string{"bob", "default"}) {
+		t.Fatalf("got %v %v", users, err)
+	}
+	// alice's pooled connection was closed, the new one can't authenticate
+	if err := alice.Ping(ctx); err == nil {
+		t.Fatal("alice is still served once removed")
+	}
+
+	// an invalid file leaves the users untouched
+	if err := os.WriteFile(path, []byte("user carol +nosuchcommand\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ACLLoad(ctx); err == nil {
+		t.Fatal("the invalid file was loaded")
+	}
+	if users, err := admin.ACLUsers(ctx); err != nil || len(users) != 2 {
+		t.Fatalf("got %v %v", users, err)
+	}
+
+	other := newTestClient(t, startServer(t), Options{})
+	if err := other.ACLSave(ctx); err == nil || !strings.Contains(err.Error(), "not configured to use an ACL file") {
+		t.Fatalf("got %v, want an error without an acl file", err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	ctx := testContext(t)
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	s := startServer(t, protocol.WithUnixSocket(path, 0))
+	c := New(Options{Network: "unix", Addr: path})
+	defer c.Close()
+	if err := c.Set(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// both listeners serve the same dataset
+	if got, err := newTestClient(t, s, Options{}).Get(ctx, "key"); err != nil || got != "value" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if info, err := c.ClientInfo(ctx); err != nil || !strings.Contains(info, " flags=U ") || !strings.Contains(info, " addr=/") {
+		t.Fatalf("got %q %v, want a unix socket client", info, err)
+	}
+}
+
+// commands run one at a time, and blocked clients don't hold the others
+func TestExecutorConcurrency(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{PoolSize: 8})
+	incr := `local v = tonumber(redis.call('GET', KEYS[1]) or '0')
+redis.call('SET', KEYS[1], tostring(v + 1))`
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := c.Eval(ctx, incr, []string{"counter"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "counter"); err != nil || got != "400" {
+		t.Fatalf("got %q %v, want every increment applied", got, err)
+	}
+
+	// WAIT parks its client until the timeout, without replicas to wait for
+	waiter := newTestClient(t, s, Options{})
+	waited := make(chan error)
+	go func() {
+		_, err := waiter.Wait(ctx, 1, 500*time.Millisecond)
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := c.Get(ctx, "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("GET took %s, the blocked client held the executor", elapsed)
+	}
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+func stringReply(v protocol.Value, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if v.Null {
+		return "", ErrNil
+	}
+	return v.Str, nil
+}
+
+func intReply(v protocol.Value, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != protocol.IntegerType {
+		return 0, fmt.Errorf("client: expected an integer reply, got %c", v.Type)
+	}
+	return v.Int, nil
+}
+
+func okReply(v protocol.Value, err error) error {
+	if err != nil {
+		return err
+	}
+	if v.Type != protocol.SimpleStringType {
+		return fmt.Errorf("client: expected a status reply, got %c", v.Type)
+	}
+	return nil
+}
+
+func stringsReply(v protocol.Value, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(v.Elems))
+	for i, el := range v.Elems {
+		strs[i] = el.Str
+	}
+	return strs, nil
+}
+
+// pairs of names and counts, as replied by PUBSUB NUMSUB
+func countsReply(v protocol.Value, err error) (map[string]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(v.Elems)/2)
+	for i := 0; i+1 < len(v.Elems); i += 2 {
+		counts[v.Elems[i].Str] = v.Elems[i+1].Int
+	}
+	return counts, nil
+}
+
+// builds the arguments of commands taking a number of keys
+// followed by the keys and the other arguments
+func withKeys(args []string, keys []string, rest []string) []string {
+	args = append(args, strconv.Itoa(len(keys)))
+	args = append(args, keys...)
+	return append(args, rest...)
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	return okReply(c.Do(ctx, "PING"))
+}
+
+func (c *Client) Echo(ctx context.Context, message string) (string, error) {
+	return stringReply(c.Do(ctx, "ECHO", message))
+}
+
+// returns ErrNil when the key does not exist
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return stringReply(c.Do(ctx, "GET", key))
+}
+
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	return okReply(c.Do(ctx, "SET", key, value))
+}
+
+// sets the key to expire after ttl, with millisecond precision
+func (c *Client) SetPX(ctx context.Context, key, value string, ttl time.Duration) error {
+	return okReply(c.Do(ctx, "SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10)))
+}
+
+// returns the number of keys which existed
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"DEL"}, keys...)...))
+}
+
+// returns false when the key does not exist
+func (c *Client) PExpireAt(ctx context.Context, key string, at time.Time) (bool, error) {
+	n, err := intReply(c.Do(ctx, "PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10)))
+	return n == 1, err
+}
+
+func (c *Client) Info(ctx context.Context, section string) (string, error) {
+	return stringReply(c.Do(ctx, "INFO", section))
+}
+
+// waits for replicas to acknowledge the writes made so far, the
+// context should outlive the timeout
+func (c *Client) Wait(ctx context.Context, replicas int, timeout time.Duration) (int64, error) {
+	return intReply(c.Do(ctx, "WAIT", strconv.Itoa(replicas), strconv.FormatInt(timeout.Milliseconds(), 10)))
+}
+
+// shuts the server down, modifiers such as NOSAVE or NOW are sent as is
+//
+// the server closes the connection instead of replying once it shuts down
+func (c *Client) Shutdown(ctx context.Context, modifiers ...string) error {
+	err := okReply(c.Do(ctx, append([]string{"SHUTDOWN"}, modifiers...)...))
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// makes the server a replica of the given master
+func (c *Client) ReplicaOf(ctx context.Context, host string, port int) error {
+	return okReply(c.Do(ctx, "REPLICAOF", host, strconv.Itoa(port)))
+}
+
+// promotes a replica into a master which keeps its dataset
+func (c *Client) ReplicaOfNoOne(ctx context.Context) error {
+	return okReply(c.Do(ctx, "REPLICAOF", "NO", "ONE"))
+}
+
+func (c *Client) Eval(ctx context.Context, script string, keys []string, args ...string) (protocol.Value, error) {
+	return c.Do(ctx, withKeys([]string{"EVAL", script}, keys, args)...)
+}
+
+func (c *Client) EvalSha(ctx context.Context, sha string, keys []string, args ...string) (protocol.Value, error) {
+	return c.Do(ctx, withKeys([]string{"EVALSHA", sha}, keys, args)...)
+}
+
+// returns the SHA1 digest the script is cached under
+func (c *Client) ScriptLoad(ctx context.Context, script string) (string, error) {
+	return stringReply(c.Do(ctx, "SCRIPT", "LOAD", script))
+}
+
+func (c *Client) ScriptExists(ctx context.Context, shas ...string) ([]bool, error) {
+	v, err := c.Do(ctx, append([]string{"SCRIPT", "EXISTS"}, shas...)...)
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(v.Elems))
+	for i, el := range v.Elems {
+		exists[i] = el.Int == 1
+	}
+	return exists, nil
+}
+
+func (c *Client) ScriptFlush(ctx context.Context) error {
+	return okReply(c.Do(ctx, "SCRIPT", "FLUSH"))
+}
+
+func (c *Client) ScriptKill(ctx context.Context) error {
+	return okReply(c.Do(ctx, "SCRIPT", "KILL"))
+}
+
+// returns the name of the loaded library
+func (c *Client) FunctionLoad(ctx context.Context, code string, replace bool) (string, error) {
+	args := []string{"FUNCTION", "LOAD"}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	return stringReply(c.Do(ctx, append(args, code)...))
+}
+
+func (c *Client) FunctionDelete(ctx context.Context, library string) error {
+	return okReply(c.Do(ctx, "FUNCTION", "DELETE", library))
+}
+
+func (c *Client) FunctionFlush(ctx context.Context) error {
+	return okReply(c.Do(ctx, "FUNCTION", "FLUSH"))
+}
+
+// lists the libraries whose name matches the pattern, all of them
+// for an empty pattern
+func (c *Client) FunctionList(ctx context.Context, pattern string, withCode bool) (protocol.Value, error) {
+	args := []string{"FUNCTION", "LIST"}
+	if pattern != "" {
+		args = append(args, "LIBRARYNAME", pattern)
+	}
+	if withCode {
+		args = append(args, "WITHCODE")
+	}
+	return c.Do(ctx, args...)
+}
+
+func (c *Client) FunctionDump(ctx context.Context) (string, error) {
+	return stringReply(c.Do(ctx, "FUNCTION", "DUMP"))
+}
+
+// policy is one of APPEND, REPLACE or FLUSH, APPEND when empty
+func (c *Client) FunctionRestore(ctx context.Context, payload, policy string) error {
+	args := []string{"FUNCTION", "RESTORE", payload}
+	if policy != "" {
+		args = append(args, policy)
+	}
+	return okReply(c.Do(ctx, args...))
+}
+
+func (c *Client) FunctionKill(ctx context.Context) error {
+	return okReply(c.Do(ctx, "FUNCTION", "KILL"))
+}
+
+func (c *Client) FunctionStats(ctx context.Context) (protocol.Value, error) {
+	return c.Do(ctx, "FUNCTION", "STATS")
+}
+
+func (c *Client) FCall(ctx context.Context, function string, keys []string, args ...string) (protocol.Value, error) {
+	return c.Do(ctx, withKeys([]string{"FCALL", function}, keys, args)...)
+}
+
+func (c *Client) FCallRO(ctx context.Context, function string, keys []string, args ...string) (protocol.Value, error) {
+	return c.Do(ctx, withKeys([]string{"FCALL_RO", function}, keys, args)...)
+}
+
+// returns the number of subscribers which received the message
+func (c *Client) Publish(ctx context.Context, channel, message string) (int64, error) {
+	return intReply(c.Do(ctx, "PUBLISH", channel, message))
+}
+
+func (c *Client) SPublish(ctx context.Context, channel, message string) (int64, error) {
+	return intReply(c.Do(ctx, "SPUBLISH", channel, message))
+}
+
+// lists the active channels matching the pattern, all of them
+// for an empty pattern
+func (c *Client) PubSubChannels(ctx context.Context, pattern string) ([]string, error) {
+	args := []string{"PUBSUB", "CHANNELS"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	return stringsReply(c.Do(ctx, args...))
+}
+
+func (c *Client) PubSubShardChannels(ctx context.Context, pattern string) ([]string, error) {
+	args := []string{"PUBSUB", "SHARDCHANNELS"}
+	if pattern != "" {
+		args = append(args, pattern)
+	}
+	return stringsReply(c.Do(ctx, args...))
+}
+
+func (c *Client) PubSubNumSub(ctx context.Context, channels ...string) (map[string]int64, error) {
+	return countsReply(c.Do(ctx, append([]string{"PUBSUB", "NUMSUB"}, channels...)...))
+}
+
+func (c *Client) PubSubShardNumSub(ctx context.Context, channels ...string) (map[string]int64, error) {
+	return countsReply(c.Do(ctx, append([]string{"PUBSUB", "SHARDNUMSUB"}, channels...)...))
+}
+
+func (c *Client) PubSubNumPat(ctx context.Context) (int64, error) {
+	return intReply(c.Do(ctx, "PUBSUB", "NUMPAT"))
+}
+
+// the following commands run on whichever pooled connection is idle,
+// CLIENT ID and CLIENT INFO describe that connection
+
+func (c *Client) ClientID(ctx context.Context) (int64, error) {
+	return intReply(c.Do(ctx, "CLIENT", "ID"))
+}
+
+func (c *Client) ClientInfo(ctx context.Context) (string, error) {
+	return stringReply(c.Do(ctx, "CLIENT", "INFO"))
+}
+
+func (c *Client) ClientList(ctx context.Context) (string, error) {
+	return stringReply(c.Do(ctx, "CLIENT", "LIST"))
+}
+
+// kills the clients matching the filters given as pairs,
+// such as "ID", "5", returning how many were killed
+func (c *Client) ClientKill(ctx context.Context, filters ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"CLIENT", "KILL"}, filters...)...))
+}
+
+// mode is WRITE or ALL, ALL when empty
+func (c *Client) ClientPause(ctx context.Context, timeout time.Duration, mode string) error {
+	args := []string{"CLIENT", "PAUSE", strconv.FormatInt(timeout.Milliseconds(), 10)}
+	if mode != "" {
+		args = append(args, mode)
+	}
+	return okReply(c.Do(ctx, args...))
+}
+
+func (c *Client) ClientUnpause(ctx context.Context) error {
+	return okReply(c.Do(ctx, "CLIENT", "UNPAUSE"))
+}
+
+func (c *Client) ACLWhoAmI(ctx context.Context) (string, error) {
+	return stringReply(c.Do(ctx, "ACL", "WHOAMI"))
+}
+
+func (c *Client) ACLUsers(ctx context.Context) ([]string, error) {
+	return stringsReply(c.Do(ctx, "ACL", "USERS"))
+}
+
+func (c *Client) ACLList(ctx context.Context) ([]string, error) {
+	return stringsReply(c.Do(ctx, "ACL", "LIST"))
+}
+
+func (c *Client) ACLSetUser(ctx context.Context, username string, rules ...string) error {
+	return okReply(c.Do(ctx, append([]string{"ACL", "SETUSER", username}, rules...)...))
+}
+
+// returns ErrNil when the user does not exist
+func (c *Client) ACLGetUser(ctx context.Context, username string) (protocol.Value, error) {
+	v, err := c.Do(ctx, "ACL", "GETUSER", username)
+	if err == nil && v.Null {
+		return v, ErrNil
+	}
+	return v, err
+}
+
+// returns the number of deleted users
+func (c *Client) ACLDelUser(ctx context.Context, usernames ...string) (int64, error) {
+	return intReply(c.Do(ctx, append([]string{"ACL", "DELUSER"}, usernames...)...))
+}
+
+// lists the categories, or the commands of the category when given
+func (c *Client) ACLCat(ctx context.Context, category string) ([]string, error) {
+	args := []string{"ACL", "CAT"}
+	if category != "" {
+		args = append(args, category)
+	}
+	return stringsReply(c.Do(ctx, args...))
+}
+
+// returns OK when the user may run the command, the reason
+// of the denial otherwise
+func (c *Client) ACLDryRun(ctx context.Context, username string, args ...string) (string, error) {
+	return stringReply(c.Do(ctx, append([]string{"ACL", "DRYRUN", username}, args...)...))
+}
+
+// returns the most recent denials, all of them when count is 0
+func (c *Client) ACLLog(ctx context.Context, count int) (protocol.Value, error) {
+	args := []string{"ACL", "LOG"}
+	if count > 0 {
+		args = append(args, strconv.Itoa(count))
+	}
+	return c.Do(ctx, args...)
+}
+
+func (c *Client) ACLLogReset(ctx context.Context) error {
+	return okReply(c.Do(ctx, "ACL", "LOG", "RESET"))
+}
+
+func (c *Client) ACLLoad(ctx context.Context) error {
+	return okReply(c.Do(ctx, "ACL", "LOAD"))
+}
+
+func (c *Client) ACLSave(ctx context.Context) error {
+	return okReply(c.Do(ctx, "ACL", "SAVE"))
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}
+}
+
+func (cn *conn) close() error {
+	return cn.nc.Close()
+}
+
+// writes serialized commands with a single flush
+func (cn *conn) writeCommands(cmds []string) error {
+	for _, cmd := range cmds {
+		if _, err := cn.w.WriteString(cmd); err != nil {
+			return err
+		}
+	}
+	return cn.w.Flush()
+}
+
+func (cn *conn) read() (protocol.Value, error) {
+	return protocol.ReadValue(cn.r)
+}
+
+// runs fn with the deadline of the context, cancelling the context
+// interrupts the network calls of fn by moving the deadline to the past
+func (cn *conn) withContext(ctx context.Context, setDeadline func(time.Time) error, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := setDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(time.Unix(1, 0))
+	})
+	err := fn()
+	if !stop() && err != nil {
+		return ctx.Err()
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// queues commands to send them with a single write, their replies
+// are read back in order
+type Pipeline struct {
+	c    *Client
+	cmds []string
+	// wraps the commands in MULTI and EXEC
+	tx bool
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// returns a pipeline whose commands run as a transaction, no other
+// client's command runs in between them
+func (c *Client) TxPipeline() *Pipeline {
+	return &Pipeline{c: c, tx: true}
+}
+
+func (p *Pipeline) Queue(args ...string) {
+	p.cmds = append(p.cmds, protocol.SerializeCommand(args...))
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// sends the queued commands and returns one reply per command, error
+// replies are part of the replies and do not fail the pipeline
+//
+// transactions fail as a whole with the error of EXEC when a command
+// could not be queued
+func (p *Pipeline) Exec(ctx context.Context) ([]protocol.Value, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if p.tx {
+		cmds = append([]string{protocol.SerializeCommand("MULTI")}, cmds...)
+		cmds = append(cmds, protocol.SerializeCommand("EXEC"))
+	}
+
+	cn, err := p.c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]protocol.Value, len(cmds))
+	err = cn.withContext(ctx, cn.nc.SetDeadline, func() error {
+		if err := cn.writeCommands(cmds); err != nil {
+			return err
+		}
+		for i := range replies {
+			if replies[i], err = cn.read(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	p.c.put(cn, err)
+	if err != nil {
+		return nil, err
+	}
+	if !p.tx {
+		return replies, nil
+	}
+
+	exec := replies[len(replies)-1]
+	if exec.IsError() {
+		return nil, Error(exec.Str)
+	}
+	if exec.Null {
+		return nil, ErrNil
+	}
+	return exec.Elems, nil
+}
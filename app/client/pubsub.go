@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// a message or a subscription change received by a subscriber
+type Message struct {
+	// message, pmessage, smessage, or the name of the command
+	// for subscription changes, such as subscribe
+	Kind    string
+	Pattern string
+	Channel string
+	Payload string
+	// number of subscriptions left after a subscription change
+	Count int64
+}
+
+// a dedicated connection in subscriber mode, outside of the pool
+type PubSub struct {
+	cn *conn
+	// serializes writes of subscription changes
+	lock sync.Mutex
+
+	chOnce sync.Once
+	ch     chan *Message
+}
+
+// opens a subscriber connection, subscribed to no channel yet
+func (c *Client) PubSub(ctx context.Context) (*PubSub, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSub{cn: cn}, nil
+}
+
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "SUBSCRIBE", channels)
+}
+
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (c *Client) SSubscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "SSUBSCRIBE", channels)
+}
+
+func (c *Client) subscribe(ctx context.Context, cmd string, channels []string) (*PubSub, error) {
+	ps, err := c.PubSub(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.send(ctx, cmd, channels); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// the confirmations of subscription changes are received as messages
+
+func (ps *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "SUBSCRIBE", channels)
+}
+
+func (ps *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (ps *PubSub) SSubscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "SSUBSCRIBE", channels)
+}
+
+// unsubscribes from the given channels, all of them when none is given
+func (ps *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "UNSUBSCRIBE", channels)
+}
+
+func (ps *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "PUNSUBSCRIBE", patterns)
+}
+
+func (ps *PubSub) SUnsubscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "SUNSUBSCRIBE", channels)
+}
+
+func (ps *PubSub) send(ctx context.Context, cmd string, channels []string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.cn.withContext(ctx, ps.cn.nc.SetWriteDeadline, func() error {
+		return ps.cn.writeCommands([]string{protocol.SerializeCommand(append([]string{cmd}, channels...)...)})
+	})
+}
+
+// waits for the next message, should not be used along with Channel
+func (ps *PubSub) Receive(ctx context.Context) (*Message, error) {
+	var v protocol.Value
+	err := ps.cn.withContext(ctx, ps.cn.nc.SetReadDeadline, func() error {
+		var err error
+		v, err = ps.cn.read()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseMessage(v)
+}
+
+func parseMessage(v protocol.Value) (*Message, error) {
+	if v.IsError() {
+		return nil, Error(v.Str)
+	}
+	if len(v.Elems) < 3 {
+		return nil, fmt.Errorf("client: unexpected reply in subscriber mode %c", v.Type)
+	}
+	msg := &Message{Kind: strings.ToLower(v.Elems[0].Str)}
+	switch msg.Kind {
+	case "message", "smessage":
+		msg.Channel, msg.Payload = v.Elems[1].Str, v.Elems[2].Str
+	case "pmessage":
+		if len(v.Elems) < 4 {
+			return nil, fmt.Errorf("client: pmessage has %d elements", len(v.Elems))
+		}
+		msg.Pattern, msg.Channel, msg.Payload = v.Elems[1].Str, v.Elems[2].Str, v.Elems[3].Str
+	case "pong":
+		msg.Payload = v.Elems[1].Str
+	default:
+		msg.Channel, msg.Count = v.Elems[1].Str, v.Elems[2].Int
+	}
+	return msg, nil
+}
+
+// returns a channel of the received messages, closed along with the
+// connection
+func (ps *PubSub) Channel() <-chan *Message {
+	ps.chOnce.Do(func() {
+		ps.ch = make(chan *Message, 100)
+		go func() {
+			defer close(ps.ch)
+			for {
+				msg, err := ps.Receive(context.Background())
+				if err != nil {
+					if _, ok := err.(Error); ok {
+						continue
+					}
+					return
+				}
+				ps.ch <- msg
+			}
+		}()
+	})
+	return ps.ch
+}
+
+func (ps *PubSub) Close() error {
+	return ps.cn.close()
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// RESP2 subscribers can only change their subscriptions, RESP3 ones
+// keep running commands and receive messages as pushes
+func TestSubscriberMode(t *testing.T) {
+	s := startServer(t)
+	resp2 := dialServer(t, s)
+	if v := rawCommand(t, resp2, "SUBSCRIBE", "news"); len(v.Elems) != 3 || v.Elems[0].Str != "subscribe" || v.Elems[2].Int != 1 {
+		t.Fatalf("got %+v", v)
+	}
+	if v := rawCommand(t, resp2, "GET", "key"); !v.IsError() || !strings.Contains(v.Str, "only (P|S)SUBSCRIBE") {
+		t.Fatalf("got %+v, want GET refused in subscriber mode", v)
+	}
+	if v := rawCommand(t, resp2, "PING"); len(v.Elems) != 2 || v.Elems[0].Str != "pong" {
+		t.Fatalf("got %+v, want a pong message", v)
+	}
+	if v := rawCommand(t, resp2, "UNSUBSCRIBE"); len(v.Elems) != 3 || v.Elems[0].Str != "unsubscribe" || v.Elems[2].Int != 0 {
+		t.Fatalf("got %+v", v)
+	}
+	if v := rawCommand(t, resp2, "GET", "key"); !v.Null {
+		t.Fatalf("got %+v, want GET served once unsubscribed", v)
+	}
+
+	resp3 := dialServer(t, s)
+	rawCommand(t, resp3, "HELLO", "3")
+	if v := rawCommand(t, resp3, "SUBSCRIBE", "news"); v.Type != protocol.PushType || v.Elems[0].Str != "subscribe" {
+		t.Fatalf("got %+v, want a subscribe push", v)
+	}
+	if v := rawCommand(t, resp3, "GET", "key"); !v.Null {
+		t.Fatalf("got %+v, want GET served to a RESP3 subscriber", v)
+	}
+	v, push := rawCommandWithPush(t, resp3, "PUBLISH", "news", "hello")
+	if v.Int != 1 {
+		t.Fatalf("got %+v, want 1 receiver", v)
+	}
+	if push.Type != protocol.PushType || len(push.Elems) != 3 || push.Elems[0].Str != "message" || push.Elems[2].Str != "hello" {
+		t.Fatalf("got %+v, want a message push", push)
+	}
+}
+
+func TestPubSubPatterns(t *testing.T) {
+	ctx := testContext(t)
+	c := newTestClient(t, startServer(t), Options{})
+
+	ps, err := c.PSubscribe(ctx, "news.*", "sport.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if err := ps.Subscribe(ctx, "news.tech"); err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range []int64{1, 2, 3} {
+		if msg, err := ps.Receive(ctx); err != nil || msg.Count != count {
+			t.Fatalf("got %+v %v, want %d subscriptions", msg, err, count)
+		}
+	}
+	if n, err := c.PubSubNumPat(ctx); err != nil || n != 2 {
+		t.Fatalf("got %d %v, want 2 patterns", n, err)
+	}
+	// patterns don't make channels active
+	if channels, err := c.PubSubChannels(ctx, "*"); err != nil || !reflect.DeepEqual(channels, []string{"news.tech"}) {
+		t.Fatalf("got %v %v", channels, err)
+	}
+	// the channel and the pattern both match
+	if n, err := c.Publish(ctx, "news.tech", "launch"); err != nil || n != 2 {
+		t.Fatalf("got %d %v, want 2 receivers", n, err)
+	}
+	for _, kind := range []string{"message", "pmessage"} {
+		if msg, err := ps.Receive(ctx); err != nil || msg.Kind != kind || msg.Payload != "launch" {
+			t.Fatalf("got %+v %v, want a %s", msg, err, kind)
+		}
+	}
+
+	if err := ps.PUnsubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	patterns := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg, err := ps.Receive(ctx)
+		if err != nil || msg.Kind != "punsubscribe" {
+			t.Fatalf("got %+v %v", msg, err)
+		}
+		patterns[msg.Channel] = true
+	}
+	if !patterns["news.*"] || !patterns["sport.*"] {
+		t.Fatalf("got %v, want every pattern unsubscribed", patterns)
+	}
+	if n, err := c.PubSubNumPat(ctx); err != nil || n != 0 {
+		t.Fatalf("got %d %v, want no pattern left", n, err)
+	}
+}
+
+// shard channels are apart from channels, and SPUBLISH reaches the
+// shard subscribers of the replicas too
+func TestShardedPubSub(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	replica := startServer(t, protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port))
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "before", "1")
+
+	ps, err := m.SSubscribe(ctx, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if err := ps.Subscribe(ctx, "orders"); err != nil {
+		t.Fatal(err)
+	}
+	// shard subscriptions are counted on their own
+	for _, want := range []Message{{Kind: "ssubscribe", Channel: "orders", Count: 1}, {Kind: "subscribe", Channel: "orders", Count: 1}} {
+		if msg, err := ps.Receive(ctx); err != nil || *msg != want {
+			t.Fatalf("got %+v %v, want %+v", msg, err, want)
+		}
+	}
+	rps, err := r.SSubscribe(ctx, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rps.Close()
+	if msg, err := rps.Receive(ctx); err != nil || msg.Kind != "ssubscribe" {
+		t.Fatalf("got %+v %v", msg, err)
+	}
+
+	if channels, err := m.PubSubShardChannels(ctx, "*"); err != nil || !reflect.DeepEqual(channels, []string{"orders"}) {
+		t.Fatalf("got %v %v", channels, err)
+	}
+	if counts, err := m.PubSubShardNumSub(ctx, "orders", "other"); err != nil || counts["orders"] != 1 || counts["other"] != 0 {
+		t.Fatalf("got %v %v", counts, err)
+	}
+	// the channel subscriber doesn't receive shard messages
+	if n, err := m.SPublish(ctx, "orders", "shipped"); err != nil || n != 1 {
+		t.Fatalf("got %d %v, want 1 receiver", n, err)
+	}
+	want := Message{Kind: "smessage", Channel: "orders", Payload: "shipped"}
+	if msg, err := ps.Receive(ctx); err != nil || *msg != want {
+		t.Fatalf("got %+v %v, want %+v", msg, err, want)
+	}
+	if msg, err := rps.Receive(ctx); err != nil || *msg != want {
+		t.Fatalf("got %+v %v, want %+v on the replica", msg, err, want)
+	}
+
+	if err := ps.SUnsubscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ps.Receive(ctx); err != nil || msg.Kind != "sunsubscribe" || msg.Count != 0 {
+		t.Fatalf("got %+v %v", msg, err)
+	}
+	if n, err := m.SPublish(ctx, "orders", "lost"); err != nil || n != 0 {
+		t.Fatalf("got %d %v, want no receiver", n, err)
+	}
+}
@@ -0,0 +1,492 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// sends PSYNC as a replica would and returns the first line of the reply,
+// the snapshot of a full resync is skipped
+func psync(t *testing.T, cn *conn, replID string, offset int) string {
+	t.Helper()
+	if err := cn.writeCommands([]string{protocol.SerializeCommand("PSYNC", replID, strconv.Itoa(offset))}); err != nil {
+		t.Fatal(err)
+	}
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(line, "+FULLRESYNC") {
+		header, err := cn.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			t.Fatalf("got %q, want the snapshot length", header)
+		}
+		if _, err := io.CopyN(io.Discard, cn.r, int64(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// a replica reconnecting with the id and offset it reached receives
+// the part of the stream it missed instead of a new snapshot
+func TestPartialResync(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	m := newTestClient(t, s, Options{})
+	if err := m.Set(ctx, "before", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := dialServer(t, s)
+	fields := strings.Fields(psync(t, first, "?", -1))
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("got %q, want a full resync", fields)
+	}
+	replID := fields[1]
+	offset, _ := strconv.Atoi(fields[2])
+	first.close()
+
+	if err := m.Set(ctx, "missed", "1"); err != nil {
+		t.Fatal(err)
+	}
+	second := dialServer(t, s)
+	if got := psync(t, second, replID, offset); got != "+CONTINUE "+replID {
+		t.Fatalf("got %q, want the replication to continue", got)
+	}
+	v, err := second.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Elems) != 3 || v.Elems[0].Str != "SET" || v.Elems[1].Str != "missed" {
+		t.Fatalf("got %+v, want the missed write", v)
+	}
+
+	// offsets the backlog doesn't hold and unknown histories resync
+	for _, tc := range []struct {
+		replID string
+		offset int
+	}{
+		{replID, offset + 1_000_000},
+		{strings.Repeat("0", 40), offset},
+	} {
+		if got := psync(t, dialServer(t, s), tc.replID, tc.offset); !strings.HasPrefix(got, "+FULLRESYNC") {
+			t.Fatalf("%s %d: got %q, want a full resync", tc.replID, tc.offset, got)
+		}
+	}
+}
+
+// a replica whose link drops reconnects by itself and catches up
+func TestReplicaReconnects(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	replica := startServer(t, protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port))
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "before", "1")
+
+	if n, err := m.ClientKill(ctx, "TYPE", "replica"); err != nil || n != 1 {
+		t.Fatalf("got %d %v, want the replica link killed", n, err)
+	}
+	if err := m.Set(ctx, "during", "1"); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, ctx, m, r, "after", "1")
+	if got, err := r.Get(ctx, "during"); err != nil || got != "1" {
+		t.Fatalf("got %q %v, the write sent while disconnected was lost", got, err)
+	}
+	info, err := r.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(info, "master_link_status:up") {
+		t.Fatalf("got %q, want the link up", info)
+	}
+	// the replica continued the master's history
+	masterInfo, err := m.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replID := infoField(masterInfo, "master_replid"); replID == "" || infoField(info, "master_replid") != replID {
+		t.Fatalf("got %q and %q, want the same replication id", info, masterInfo)
+	}
+}
+
+// returns the value of a field of an INFO reply
+func infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// REPLICAOF turns a master into a replica of another server, and
+// REPLICAOF NO ONE back into a master keeping the dataset
+func TestReplicaOf(t *testing.T) {
+	ctx := testContext(t)
+	a, b := startServer(t), startServer(t)
+	ca, cb := newTestClient(t, a, Options{}), newTestClient(t, b, Options{})
+	if err := ca.Set(ctx, "from", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Set(ctx, "only", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var replyErr Error
+	if err := cb.ReplicaOf(ctx, "127.0.0.1", 0); !errors.As(err, &replyErr) {
+		t.Fatalf("got %v, want the port refused", err)
+	}
+	port := a.Addr().(*net.TCPAddr).Port
+	if err := cb.ReplicaOf(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := stringReply(cb.Do(ctx, "REPLICAOF", "127.0.0.1", strconv.Itoa(port))); err != nil || got != "OK Already connected to specified master" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	waitReplicated(t, ctx, ca, cb, "synced", "1")
+	// the full resync replaced the dataset of b
+	if _, err := cb.Get(ctx, "only"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, want the key of b dropped", err)
+	}
+	info, err := cb.Info(ctx, "replication")
+	if err != nil || infoField(info, "role") != "slave" {
+		t.Fatalf("got %q %v, want b to be a replica", info, err)
+	}
+	aInfo, err := ca.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cb.ReplicaOfNoOne(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Set(ctx, "promoted", "1"); err != nil {
+		t.Fatalf("got %v, want writes accepted once promoted", err)
+	}
+	if got, err := cb.Get(ctx, "from"); err != nil || got != "a" {
+		t.Fatalf("got %q %v, want the dataset kept", got, err)
+	}
+	// the new history follows the one of a
+	info, err = cb.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infoField(info, "role") != "master" || infoField(info, "master_replid2") != infoField(aInfo, "master_replid") ||
+		infoField(info, "master_replid") == infoField(aInfo, "master_replid") {
+		t.Fatalf("got %q, want a new id following %q", info, infoField(aInfo, "master_replid"))
+	}
+}
+
+// the stream holds the effects of writes: relative expirations become
+// absolute, commands replicated as several are wrapped in MULTI/EXEC
+// and reads are left out
+func TestPropagation(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{})
+	replica := dialServer(t, s)
+	psync(t, replica, "?", -1)
+
+	if err := c.SetPX(ctx, "ttl", "1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "ttl"); err != nil {
+		t.Fatal(err)
+	}
+	tx := c.TxPipeline()
+	tx.Queue("SET", "a", "1")
+	tx.Queue("GET", "a")
+	tx.Queue("SET", "b", "2")
+	if _, err := tx.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Eval(ctx, "redis.call('SET', KEYS[1], 'x')", []string{"scripted"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Del(ctx, "a", "missing"); err != nil || n != 1 {
+		t.Fatalf("got %d %v", n, err)
+	}
+
+	want := [][]string{
+		{"MULTI"},
+		{"SET", "ttl", "1"},
+		{"PEXPIREAT", "ttl", ""},
+		{"EXEC"},
+		{"MULTI"},
+		{"SET", "a", "1"},
+		{"SET", "b", "2"},
+		{"EXEC"},
+		{"SET", "scripted", "x"},
+		{"DEL", "a", "missing"},
+	}
+	for _, cmd := range want {
+		v, err := replica.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(v.Elems))
+		for i, el := range v.Elems {
+			got[i] = el.Str
+		}
+		// the absolute expiration time is only checked to be a number
+		if cmd[0] == "PEXPIREAT" && len(got) == 3 {
+			if _, err := strconv.ParseInt(got[2], 10, 64); err == nil {
+				cmd[2] = got[2]
+			}
+		}
+		if !reflect.DeepEqual(got, cmd) {
+			t.Fatalf("got %q, want %q", got, cmd)
+		}
+	}
+}
+
+// writes don't wait for a replica which doesn't read its stream, the
+// replica is dropped once its output buffer goes past the hard limit
+func TestSlowReplicaDropped(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t, protocol.WithReplicaOutputBufferLimit(256<<10, 0, 0))
+	c := newTestClient(t, s, Options{})
+	// never reads past the snapshot
+	psync(t, dialServer(t, s), "?", -1)
+
+	// the socket buffers hold a few megabytes before the writes block
+	value := strings.Repeat("v", 64<<10)
+	for i := 0; ; i++ {
+		if err := c.Set(ctx, "key", value); err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.Info(ctx, "replication")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if infoField(info, "connected_slaves") == "0" {
+			return
+		}
+		if i == 1024 {
+			t.Fatal("the slow replica wasn't dropped")
+		}
+	}
+}
+
+// writes are refused unless enough replicas acknowledged their offset
+// within min-replicas-max-lag
+func TestMinReplicas(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t, protocol.WithMinReplicas(1, 500*time.Millisecond))
+	c := newTestClient(t, s, Options{})
+
+	var replyErr Error
+	if err := c.Set(ctx, "key", "1"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "NOREPLICAS") {
+		t.Fatalf("got %v, want NOREPLICAS", err)
+	}
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, want reads served", err)
+	}
+
+	replica := dialServer(t, s)
+	psync(t, replica, "?", -1)
+	if err := c.Set(ctx, "key", "1"); err != nil {
+		t.Fatalf("got %v, want the new replica to count", err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := c.Set(ctx, "key", "2"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "NOREPLICAS") {
+		t.Fatalf("got %v, want NOREPLICAS once the replica lags", err)
+	}
+	if err := replica.writeCommands([]string{protocol.SerializeCommand("REPLCONF", "ACK", "0")}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		err := c.Set(ctx, "key", "2")
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got %v, want the acknowledging replica to count again", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// replicas acknowledge their offset every second without being asked
+func TestReplicaAcks(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	replica := startServer(t, protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port))
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "key", "1")
+	if n, err := m.Wait(ctx, 1, time.Second); err != nil || n != 1 {
+		t.Fatalf("got %d %v, want the replica to acknowledge", n, err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	info, err := m.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := infoField(info, "slave0")
+	if !strings.Contains(line, ",lag=0,") && !strings.Contains(line, ",lag=1,") {
+		t.Fatalf("got %q, want the replica acknowledging every second", line)
+	}
+}
+
+// the snapshot is streamed to the replicas which asked for it during the
+// delay, with an end mark in place of a length, and loaded either way
+func TestDisklessSync(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t, protocol.WithDisklessSync(true, 200*time.Millisecond))
+	m := newTestClient(t, master, Options{})
+	if err := m.Set(ctx, "before", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := dialServer(t, master)
+	if err := raw.writeCommands([]string{protocol.SerializeCommand("PSYNC", "?", "-1")}); err != nil {
+		t.Fatal(err)
+	}
+	port := master.Addr().(*net.TCPAddr).Port
+	disk := startServer(t, protocol.WithMasterAs("127.0.0.1", port))
+	swap := startServer(t, protocol.WithMasterAs("127.0.0.1", port), protocol.WithDisklessLoad("swapdb"))
+
+	line, err := raw.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "+FULLRESYNC ") {
+		t.Fatalf("got %q %v", line, err)
+	}
+	header, err := raw.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, "$EOF:") || len(header) != len("$EOF:")+40+2 {
+		t.Fatalf("got %q %v, want an end mark", header, err)
+	}
+	mark := header[len("$EOF:") : len(header)-2]
+	var rdb []byte
+	for !strings.HasSuffix(string(rdb), mark) {
+		b, err := raw.r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdb = append(rdb, b)
+	}
+	if !strings.HasPrefix(string(rdb), "REDIS") || !strings.Contains(string(rdb), "before") {
+		t.Fatalf("got %q, want the snapshot", rdb)
+	}
+
+	for _, replica := range []*protocol.Server{disk, swap} {
+		r := newTestClient(t, replica, Options{})
+		waitReplicated(t, ctx, m, r, "after", "1")
+		if got, err := r.Get(ctx, "before"); err != nil || got != "1" {
+			t.Fatalf("got %q %v, want the snapshot loaded", got, err)
+		}
+	}
+}
+
+// a replica serves the stream of its master to its own replicas
+func TestSubReplicas(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	middle := startServer(t, protocol.WithMasterAs("127.0.0.1", master.Addr().(*net.TCPAddr).Port))
+	leaf := startServer(t, protocol.WithMasterAs("127.0.0.1", middle.Addr().(*net.TCPAddr).Port))
+	m := newTestClient(t, master, Options{})
+	mid := newTestClient(t, middle, Options{})
+	l := newTestClient(t, leaf, Options{})
+	waitReplicated(t, ctx, m, l, "chained", "1")
+
+	info, err := mid.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infoField(info, "role") != "slave" || infoField(info, "connected_slaves") != "1" {
+		t.Fatalf("got %q, want a replica with a replica", info)
+	}
+	leafInfo, err := l.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterInfo, err := m.Info(ctx, "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infoField(leafInfo, "master_replid") != infoField(masterInfo, "master_replid") {
+		t.Fatalf("got %q, want the history of the master", leafInfo)
+	}
+
+	// the promoted replica keeps its replica, which continues its history
+	if err := mid.ReplicaOfNoOne(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, ctx, mid, l, "promoted", "1")
+	if got, err := l.Get(ctx, "chained"); err != nil || got != "1" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if info, err = mid.Info(ctx, "replication"); err != nil {
+		t.Fatal(err)
+	}
+	if leafInfo, err = l.Info(ctx, "replication"); err != nil {
+		t.Fatal(err)
+	}
+	if infoField(leafInfo, "master_replid") != infoField(info, "master_replid") {
+		t.Fatalf("got %q, want the new history of %q", leafInfo, info)
+	}
+
+	// a replica without a link to its master can't be synced from
+	unlinked := startServer(t, protocol.WithMasterAs("127.0.0.1", 1))
+	if got := psync(t, dialServer(t, unlinked), "?", -1); !strings.HasPrefix(got, "-NOMASTERLINK") {
+		t.Fatalf("got %q, want NOMASTERLINK", got)
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	ctx := testContext(t)
+	master := startServer(t)
+	port := master.Addr().(*net.TCPAddr).Port
+	replica := startServer(t, protocol.WithMasterAs("127.0.0.1", port))
+	m := newTestClient(t, master, Options{})
+	r := newTestClient(t, replica, Options{})
+	waitReplicated(t, ctx, m, r, "key", "1")
+
+	var replyErr Error
+	if err := r.Set(ctx, "key", "2"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "READONLY") {
+		t.Fatalf("got %v, want READONLY", err)
+	}
+	// the refused write fails the transaction it was queued in
+	tx := r.TxPipeline()
+	tx.Queue("GET", "key")
+	tx.Queue("SET", "key", "2")
+	if _, err := tx.Exec(ctx); err == nil || !strings.HasPrefix(err.Error(), "EXECABORT") {
+		t.Fatalf("got %v, want EXECABORT", err)
+	}
+	if _, err := r.Eval(ctx, "return redis.call('SET', KEYS[1], '2')", []string{"key"}); err == nil {
+		t.Fatal("the script wrote to the read only replica")
+	}
+	if got, err := r.Get(ctx, "key"); err != nil || got != "1" {
+		t.Fatalf("got %q %v, want the value of the master", got, err)
+	}
+	info, err := r.Info(ctx, "replication")
+	if err != nil || infoField(info, "slave_read_only") != "1" {
+		t.Fatalf("got %q %v", info, err)
+	}
+
+	writable := startServer(t, protocol.WithMasterAs("127.0.0.1", port), protocol.WithReplicaReadOnly(false))
+	w := newTestClient(t, writable, Options{})
+	waitReplicated(t, ctx, m, w, "key", "1")
+	if err := w.Set(ctx, "local", "1"); err != nil {
+		t.Fatalf("got %v, want the write accepted", err)
+	}
+	// local writes stay on the replica
+	if _, err := m.Get(ctx, "local"); !errors.Is(err, ErrNil) {
+		t.Fatalf("got %v, the local write reached the master", err)
+	}
+}
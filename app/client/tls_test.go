@@ -0,0 +1,197 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// a certificate authority generated for the test, along with a
+// certificate it signed for 127.0.0.1, usable by servers and clients
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+
+	caFile   string
+	certFile string
+	keyFile  string
+	leaf     tls.Certificate
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{dir: t.TempDir()}
+	var err error
+	if ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	ca.caFile = writePEM(t, ca.dir, "ca.crt", "CERTIFICATE", der)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name + " leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca.cert, &leafKey.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.certFile = writePEM(t, ca.dir, "leaf.crt", "CERTIFICATE", leafDER)
+	ca.keyFile = writePEM(t, ca.dir, "leaf.key", "EC PRIVATE KEY", keyDER)
+	if ca.leaf, err = tls.LoadX509KeyPair(ca.certFile, ca.keyFile); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// the tls listener is disabled by port 0, a free port is picked instead
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startTLSServer(t *testing.T, ca *testCA, opts ...protocol.ServerOptFunc) *protocol.Server {
+	t.Helper()
+	opts = append([]protocol.ServerOptFunc{
+		protocol.WithTLS(freePort(t), ca.certFile, ca.keyFile, ca.caFile, tls.RequireAndVerifyClientCert),
+	}, opts...)
+	return startServer(t, opts...)
+}
+
+func newTLSClient(t *testing.T, s *protocol.Server, cfg *tls.Config) *Client {
+	t.Helper()
+	c := New(Options{Addr: s.TLSAddr().String(), TLSConfig: cfg})
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+func TestTLS(t *testing.T) {
+	ctx := testContext(t)
+	ca := newTestCA(t, "test CA")
+	s := startTLSServer(t, ca)
+
+	c := newTLSClient(t, s, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.leaf}})
+	if err := c.Set(ctx, "key", "over tls"); err != nil {
+		t.Fatal(err)
+	}
+	// plain tcp clients share the dataset
+	plain := newTestClient(t, s, Options{})
+	if got, err := plain.Get(ctx, "key"); err != nil || got != "over tls" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestTLSRejectsClients(t *testing.T) {
+	ctx := testContext(t)
+	ca := newTestCA(t, "test CA")
+	rogue := newTestCA(t, "rogue CA")
+	s := startTLSServer(t, ca)
+
+	tests := map[string]*tls.Config{
+		"no client certificate":       {RootCAs: ca.pool},
+		"untrusted client":            {RootCAs: ca.pool, Certificates: []tls.Certificate{rogue.leaf}},
+		"server signed by another CA": {RootCAs: rogue.pool, Certificates: []tls.Certificate{ca.leaf}},
+	}
+	for name, cfg := range tests {
+		c := newTLSClient(t, s, cfg)
+		err := c.Ping(ctx)
+		if err == nil {
+			t.Errorf("%s: ping succeeded", name)
+			continue
+		}
+		var replyErr Error
+		if errors.As(err, &replyErr) {
+			t.Errorf("%s: got reply %s, want the handshake to fail", name, replyErr)
+		}
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	ctx := testContext(t)
+	ca := newTestCA(t, "test CA")
+	master := startTLSServer(t, ca)
+	masterAddr := master.TLSAddr().(*net.TCPAddr)
+	replica := startServer(t,
+		protocol.WithMasterAs("127.0.0.1", masterAddr.Port),
+		protocol.WithTLS(0, ca.certFile, ca.keyFile, ca.caFile, tls.RequireAndVerifyClientCert),
+		protocol.WithTLSReplication(true),
+	)
+
+	m := newTLSClient(t, master, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.leaf}})
+	if err := m.Set(ctx, "key", "replicated"); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestClient(t, replica, Options{})
+	for {
+		got, err := r.Get(ctx, "key")
+		if err == nil && got == "replicated" {
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("the write didn't reach the replica: %q %v", got, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// returns the keys of an invalidate push or message
+func invalidatedKeys(t *testing.T, v protocol.Value) []string {
+	t.Helper()
+	n := len(v.Elems)
+	if n < 2 || v.Elems[0].Str != "invalidate" && (n != 3 || v.Elems[1].Str != "__redis__:invalidate") {
+		t.Fatalf("got %+v, want an invalidation", v)
+	}
+	var keys []string
+	for _, key := range v.Elems[n-1].Elems {
+		keys = append(keys, key.Str)
+	}
+	return keys
+}
+
+func TestTracking(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{})
+
+	cn := dialServer(t, s)
+	rawCommand(t, cn, "HELLO", "3")
+	if v := rawCommand(t, cn, "CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT"); !v.IsError() {
+		t.Fatalf("got %+v, want OPTIN and OPTOUT refused together", v)
+	}
+	if v := rawCommand(t, cn, "CLIENT", "TRACKING", "ON", "OPTIN"); v.Str != "OK" {
+		t.Fatalf("got %+v", v)
+	}
+	// only the read following CLIENT CACHING yes is tracked
+	rawCommand(t, cn, "GET", "skipped")
+	rawCommand(t, cn, "CLIENT", "CACHING", "YES")
+	rawCommand(t, cn, "GET", "cached")
+	for _, key := range []string{"skipped", "cached", "cached"} {
+		if err := c.Set(ctx, key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the key is forgotten once invalidated, the second SET isn't sent
+	if _, push := rawCommandWithPush(t, cn, "GET", "skipped"); !reflect.DeepEqual(invalidatedKeys(t, push), []string{"cached"}) {
+		t.Fatalf("got %+v, want cached invalidated", push)
+	}
+	if v := rawCommand(t, cn, "PING"); v.Str != "PONG" {
+		t.Fatalf("got %+v, want no other invalidation", v)
+	}
+}
+
+// RESP2 clients get invalidations through a subscriber of the
+// invalidation channel
+func TestTrackingRedirect(t *testing.T) {
+	ctx := testContext(t)
+	s := startServer(t)
+	c := newTestClient(t, s, Options{})
+
+	sub := dialServer(t, s)
+	id := rawCommand(t, sub, "CLIENT", "ID").Int
+	rawCommand(t, sub, "SUBSCRIBE", "__redis__:invalidate")
+
+	cn := dialServer(t, s)
+	if v := rawCommand(t, cn, "CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(id, 10), "BCAST", "PREFIX", "user:"); v.Str != "OK" {
+		t.Fatalf("got %+v", v)
+	}
+	if v := rawCommand(t, cn, "CLIENT", "GETREDIR"); v.Int != id {
+		t.Fatalf("got %+v, want %d", v, id)
+	}
+	info := rawCommand(t, cn, "CLIENT", "TRACKINGINFO")
+	if len(info.Elems) != 6 || !reflect.DeepEqual(info.Elems[1].Elems, []protocol.Value{{Type: '$', Str: "on"}, {Type: '$', Str: "bcast"}}) ||
+		info.Elems[3].Int != id || len(info.Elems[5].Elems) != 1 || info.Elems[5].Elems[0].Str != "user:" {
+		t.Fatalf("got %+v", info)
+	}
+
+	// keys outside of the prefix aren't broadcast
+	for _, key := range []string{"order:1", "user:1"} {
+		if err := c.Set(ctx, key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := sub.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Elems[0].Str != "message" || !reflect.DeepEqual(invalidatedKeys(t, v), []string{"user:1"}) {
+		t.Fatalf("got %+v, want user:1 invalidated", v)
+	}
+}
+
+// a key found expired by a client's own read is still invalidated for
+// that client under NOLOOP, expirations aren't writes of the client
+func TestTrackingExpiredNoLoop(t *testing.T) {
+	cn := dialServer(t, startServer(t))
+	if v := rawCommand(t, cn, "HELLO", "3"); v.Type != protocol.MapType {
+		t.Fatalf("got %+v", v)
+	}
+	if v := rawCommand(t, cn, "CLIENT", "TRACKING", "ON", "BCAST", "NOLOOP"); v.Str != "OK" {
+		t.Fatalf("got %+v", v)
+	}
+	// the script holds the executor, so the key is expired by its GET
+	// rather than by the timer
+	script := `redis.call('SET', KEYS[1], 'v', 'PX', 1)
+while redis.call('GET', KEYS[1]) do end
+return 1`
+	reply, push := rawCommandWithPush(t, cn, "EVAL", script, "1", "key")
+	if reply.Int != 1 {
+		t.Fatalf("got %+v", reply)
+	}
+	if push.Type != protocol.PushType || len(push.Elems) != 2 || push.Elems[0].Str != "invalidate" ||
+		len(push.Elems[1].Elems) != 1 || push.Elems[1].Elems[0].Str != "key" {
+		t.Fatalf("got %+v, want the key to be invalidated", push)
+	}
+}
@@ -0,0 +1,806 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/common"
+)
+
+const aclLogMaxLen = 128
+
+type keyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+func (p keyPattern) String() string {
+	switch {
+	case p.read && p.write:
+		return "~" + p.pattern
+	case p.read:
+		return "%R~" + p.pattern
+	default:
+		return "%W~" + p.pattern
+	}
+}
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string
+
+	// allowed commands, keyed by `cmd` or `cmd|sub`
+	commands map[string]bool
+	// command rules in the order they were applied, used to describe the user
+	commandRules []string
+	keys         []keyPattern
+	channels     []string
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		passwords: []string{},
+		commands:  make(map[string]bool),
+		keys:      []keyPattern{},
+		channels:  []string{},
+	}
+}
+
+func (u *aclUser) clone() *aclUser {
+	cp := *u
+	cp.passwords = append([]string{}, u.passwords...)
+	cp.commands = make(map[string]bool, len(u.commands))
+	for k, v := range u.commands {
+		cp.commands[k] = v
+	}
+	cp.commandRules = append([]string{}, u.commandRules...)
+	cp.keys = append([]keyPattern{}, u.keys...)
+	cp.channels = append([]string{}, u.channels...)
+	return &cp
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such password")
+}
+
+func isValidPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// allows or denies a command together with all of its subcommands,
+// or a single subcommand in `cmd|sub` form
+func (u *aclUser) setCommand(name string, allow bool) error {
+	cmd, sub, isSub := strings.Cut(name, "|")
+	spec, ok := commandTable[cmd]
+	if !ok {
+		return errors.New("Unknown command")
+	}
+	if isSub {
+		if sub == "" {
+			return errors.New("Unknown command")
+		}
+		u.commands[name] = allow
+		return nil
+	}
+
+	u.commands[cmd] = allow
+	for key := range u.commands {
+		if strings.HasPrefix(key, cmd+"|") {
+			delete(u.commands, key)
+		}
+	}
+	for sub := range spec.subcommands {
+		u.commands[cmd+"|"+sub] = allow
+	}
+	return nil
+}
+
+func (u *aclUser) setCategory(category string, allow bool) error {
+	if category == "all" {
+		for cmd := range commandTable {
+			_ = u.setCommand(cmd, allow)
+		}
+		return nil
+	}
+	known := false
+	for _, c := range commandCategories {
+		if c == category {
+			known = true
+		}
+	}
+	if !known {
+		return errors.New("Unknown command category")
+	}
+	for _, name := range commandsInCategory(category) {
+		u.commands[name] = allow
+	}
+	return nil
+}
+
+// applies a single ACL rule such as `on`, `>password`, `~key*` or `+@read`
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = []string{}
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = []string{}
+		return nil
+	case "allkeys":
+		return u.applyRule("~*")
+	case "resetkeys":
+		u.keys = []keyPattern{}
+		return nil
+	case "allchannels":
+		return u.applyRule("&*")
+	case "resetchannels":
+		u.channels = []string{}
+		return nil
+	case "allcommands":
+		return u.applyRule("+@all")
+	case "nocommands":
+		return u.applyRule("-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "nocommands", "off"} {
+			_ = u.applyRule(r)
+		}
+		return nil
+	}
+
+	if rule == "" {
+		return errors.New("Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case '<':
+		return u.removePassword(hashPassword(rule[1:]))
+	case '#':
+		if !isValidPasswordHash(rule[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(strings.ToLower(rule[1:]))
+	case '!':
+		return u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		u.keys = append(u.keys, keyPattern{pattern: rule[1:], read: true, write: true})
+	case '%':
+		perms, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || perms == "" {
+			return errors.New("Syntax error")
+		}
+		p := keyPattern{pattern: pattern}
+		for _, perm := range strings.ToUpper(perms) {
+			switch perm {
+			case 'R':
+				p.read = true
+			case 'W':
+				p.write = true
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		u.keys = append(u.keys, p)
+	case '&':
+		u.channels = append(u.channels, rule[1:])
+	case '+', '-':
+		allow := rule[0] == '+'
+		name := strings.ToLower(rule[1:])
+		var err error
+		if strings.HasPrefix(name, "@") {
+			err = u.setCategory(name[1:], allow)
+		} else {
+			err = u.setCommand(name, allow)
+		}
+		if err != nil {
+			return err
+		}
+		if name == "@all" {
+			u.commandRules = []string{}
+		}
+		u.commandRules = append(u.commandRules, string(rule[0])+name)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) commandsDescription() string {
+	if len(u.commandRules) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commandRules, " ")
+}
+
+func (u *aclUser) keysDescription() string {
+	patterns := make([]string, len(u.keys))
+	for i, p := range u.keys {
+		patterns[i] = p.String()
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (u *aclUser) channelsDescription() string {
+	patterns := make([]string, len(u.channels))
+	for i, p := range u.channels {
+		patterns[i] = "&" + p
+	}
+	return strings.Join(patterns, " ")
+}
+
+// describes the user as a list of rules, in ACL LIST and acl file format
+func (u *aclUser) describe() string {
+	parts := append([]string{"user", u.name}, u.flags()...)
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := u.keysDescription(); keys != "" {
+		parts = append(parts, keys)
+	} else {
+		parts = append(parts, "resetkeys")
+	}
+	if channels := u.channelsDescription(); channels != "" {
+		parts = append(parts, channels)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.commandsDescription())
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) canRun(cmd string, args []string) bool {
+	spec, ok := commandTable[cmd]
+	if !ok {
+		// unknown commands do nothing
+		return true
+	}
+	if len(args) > 1 && len(spec.subcommands) > 0 {
+		if allowed, ok := u.commands[cmd+"|"+strings.ToLower(args[1])]; ok {
+			return allowed
+		}
+	}
+	return u.commands[cmd]
+}
+
+func (u *aclUser) canAccessKey(ref keyRef) bool {
+	readOK, writeOK := !ref.read, !ref.write
+	for _, p := range u.keys {
+		if !common.GlobMatch(p.pattern, ref.key) {
+			continue
+		}
+		readOK = readOK || p.read
+		writeOK = writeOK || p.write
+	}
+	return readOK && writeOK
+}
+
+// subscription patterns are only allowed if they are allowed verbatim
+func (u *aclUser) canAccessChannel(channel string, isPattern bool) bool {
+	for _, p := range u.channels {
+		if isPattern {
+			if p == "*" || p == channel {
+				return true
+			}
+		} else if common.GlobMatch(p, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+type aclLogEntry struct {
+	id          int
+	count       int
+	reason      string
+	context     string
+	object      string
+	username    string
+	clientInfo  string
+	createdAt   time.Time
+	lastUpdated time.Time
+}
+
+// only used from the executor
+type aclRegistry struct {
+	users map[string]*aclUser
+	// users are loaded from and saved to this file, empty if not configured
+	file string
+
+	log       []*aclLogEntry
+	nextLogID int
+}
+
+// the default user can run any command without a password
+func newDefaultACLUser() *aclUser {
+	u := newACLUser(defaultUser)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		_ = u.applyRule(rule)
+	}
+	return u
+}
+
+func newACLRegistry() *aclRegistry {
+	defaultUser := newDefaultACLUser()
+	return &aclRegistry{
+		users: map[string]*aclUser{
+			defaultUser.name: defaultUser,
+		},
+		log: []*aclLogEntry{},
+	}
+}
+
+// clients are authenticated as default on connect if it needs no password
+func (acl *aclRegistry) defaultUserNeedsNoAuth() bool {
+	u, ok := acl.users[defaultUser]
+	return ok && u.enabled && u.nopass
+}
+
+func (acl *aclRegistry) authenticate(username, password string) bool {
+	u, ok := acl.users[username]
+	return ok && u.enabled && u.checkPassword(password)
+}
+
+// applies the rules to a copy of the user so that a failing rule
+// leaves the user untouched
+func (acl *aclRegistry) setUser(name string, rules []string) error {
+	u, ok := acl.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	acl.users[name] = u
+	return nil
+}
+
+func (acl *aclRegistry) usernames() []string {
+	names := make([]string, 0, len(acl.users))
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (acl *aclRegistry) addLogEntry(reason, context, object, username, clientInfo string) {
+	now := time.Now()
+	for _, e := range acl.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.lastUpdated = now
+			e.clientInfo = clientInfo
+			return
+		}
+	}
+	acl.log = append([]*aclLogEntry{{
+		id:          acl.nextLogID,
+		count:       1,
+		reason:      reason,
+		context:     context,
+		object:      object,
+		username:    username,
+		clientInfo:  clientInfo,
+		createdAt:   now,
+		lastUpdated: now,
+	}}, acl.log...)
+	acl.nextLogID++
+	if len(acl.log) > aclLogMaxLen {
+		acl.log = acl.log[:aclLogMaxLen]
+	}
+}
+
+type aclDenial struct {
+	reason string
+	object string
+}
+
+func (d *aclDenial) Error() string {
+	switch d.reason {
+	case "key":
+		return "No permissions to access a key"
+	case "channel":
+		return "No permissions to access a channel"
+	default:
+		return fmt.Sprintf("has no permissions to run the '%s' command", d.object)
+	}
+}
+
+// returns the reason the user cannot run the command, nil if it can
+func (u *aclUser) check(args []string) *aclDenial {
+	cmd := strings.ToLower(args[0])
+	if !u.canRun(cmd, args) {
+		object := cmd
+		if spec := commandTable[cmd]; len(args) > 1 && len(spec.subcommands) > 0 {
+			object = cmd + "|" + strings.ToLower(args[1])
+		}
+		return &aclDenial{reason: "command", object: object}
+	}
+	spec := commandTable[cmd]
+	if spec.keys != nil {
+		for _, ref := range spec.keys(args) {
+			if !u.canAccessKey(ref) {
+				return &aclDenial{reason: "key", object: ref.key}
+			}
+		}
+	}
+	if spec.channels != nil {
+		channels, patterns := spec.channels(args)
+		for _, ch := range channels {
+			if !u.canAccessChannel(ch, patterns) {
+				return &aclDenial{reason: "channel", object: ch}
+			}
+		}
+	}
+	return nil
+}
+
+func noPermError(username string, denial *aclDenial) string {
+	if denial.reason == "command" {
+		return fmt.Sprintf("NOPERM User %s %s", username, denial)
+	}
+	return fmt.Sprintf("NOPERM %s", denial)
+}
+
+// should be called from the executor
+//
+// checks that the client is authenticated and allowed to run the command,
+// replying with an error and returning false otherwise
+func (s *Server) authorize(c *Connection, msg Message) bool {
+	reply, denial := s.permissionError(c, msg)
+	if reply == "" {
+		return true
+	}
+	if denial != nil {
+		s.logDenial(c, denial, "toplevel")
+	}
+	c.Reply().WriteError(reply)
+	return false
+}
+
+// returns the error reply the command is refused with, empty if the
+// client may run it, along with the ACL denial if there is one
+//
+// nothing is logged, only the users are read
+func (s *Server) permissionError(c *Connection, msg Message) (string, *aclDenial) {
+	// the replication stream from the master is trusted
+	if c.slaveToMaster {
+		return "", nil
+	}
+	cmd := strings.ToLower(msg.data[0])
+	if !c.authenticated && cmd != "auth" && cmd != "hello" {
+		return "NOAUTH Authentication required.", nil
+	}
+	if !c.authenticated {
+		return "", nil
+	}
+	if denial := s.userDenial(c, msg.data); denial != nil {
+		return noPermError(c.user, denial), denial
+	}
+	return "", nil
+}
+
+// should be called from the executor
+//
+// checks the permissions of the client's user, logging denials
+func (s *Server) checkACL(c *Connection, args []string, context string) *aclDenial {
+	denial := s.userDenial(c, args)
+	if denial != nil {
+		s.logDenial(c, denial, context)
+	}
+	return denial
+}
+
+func (s *Server) userDenial(c *Connection, args []string) *aclDenial {
+	u, ok := s.acl.users[c.user]
+	if !ok {
+		// the user got deleted while the client was connected
+		return &aclDenial{reason: "command", object: strings.ToLower(args[0])}
+	}
+	return u.check(args)
+}
+
+// should be called from the executor
+func (s *Server) logDenial(c *Connection, denial *aclDenial, context string) {
+	s.acl.addLogEntry(denial.reason, context, denial.object, c.user, s.clientInfo(c))
+}
+
+// authenticates the client, replying WRONGPASS on failure
+func (s *Server) authenticateClient(c *Connection, username, password string) bool {
+	if !s.acl.authenticate(username, password) {
+		s.acl.addLogEntry("auth", "toplevel", "AUTH", username, s.clientInfo(c))
+		return false
+	}
+	c.user = username
+	c.authenticated = true
+	return true
+}
+
+func (s *Server) processAuthRequest(c *Connection, msg Message) error {
+	var username, password string
+	switch len(msg.data) {
+	case 2:
+		username, password = defaultUser, msg.data[1]
+	case 3:
+		username, password = msg.data[1], msg.data[2]
+	default:
+		return errors.New("incorrect number of arguments for the auth command")
+	}
+
+	if !s.authenticateClient(c, username, password) {
+		c.Reply().WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processACLRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the acl command")
+	}
+
+	switch strings.ToLower(msg.data[1]) {
+	case "whoami":
+		c.Reply().WriteBulkString(c.user)
+		return nil
+	case "users":
+		c.Reply().WriteBulkStrings(s.acl.usernames())
+		return nil
+	case "list":
+		w := c.Reply()
+		names := s.acl.usernames()
+		w.WriteArrayHeader(len(names))
+		for _, name := range names {
+			w.WriteBulkString(s.acl.users[name].describe())
+		}
+		return nil
+	case "setuser":
+		if len(msg.data) < 3 {
+			return errors.New("incorrect number of arguments for the acl setuser command")
+		}
+		if err := s.acl.setUser(msg.data[2], msg.data[3:]); err != nil {
+			c.Reply().WriteError(err.Error())
+			return nil
+		}
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "getuser":
+		if len(msg.data) != 3 {
+			return errors.New("incorrect number of arguments for the acl getuser command")
+		}
+		return s.processACLGetUser(c, msg.data[2])
+	case "deluser":
+		if len(msg.data) < 3 {
+			return errors.New("incorrect number of arguments for the acl deluser command")
+		}
+		return s.processACLDelUser(c, msg.data[2:])
+	case "cat":
+		return s.processACLCat(c, msg)
+	case "dryrun":
+		return s.processACLDryRun(c, msg)
+	case "log":
+		return s.processACLLog(c, msg)
+	case "load":
+		return s.processACLLoad(c)
+	case "save":
+		return s.processACLSave(c)
+	default:
+		return fmt.Errorf("unknown acl subcommand %s", msg.data[1])
+	}
+}
+
+func (s *Server) processACLGetUser(c *Connection, name string) error {
+	u, ok := s.acl.users[name]
+	if !ok {
+		c.Reply().WriteNull()
+		return nil
+	}
+
+	w := c.Reply()
+	w.WriteMapHeader(6)
+	w.WriteBulkString("flags")
+	w.WriteBulkStrings(u.flags())
+	w.WriteBulkString("passwords")
+	w.WriteBulkStrings(u.passwords)
+	w.WriteBulkString("commands")
+	w.WriteBulkString(u.commandsDescription())
+	w.WriteBulkString("keys")
+	w.WriteBulkString(u.keysDescription())
+	w.WriteBulkString("channels")
+	w.WriteBulkString(u.channelsDescription())
+	w.WriteBulkString("selectors")
+	w.WriteArrayHeader(0)
+	return nil
+}
+
+// deletes the users and disconnects the clients authenticated as them
+func (s *Server) processACLDelUser(c *Connection, names []string) error {
+	deleted := 0
+	for _, name := range names {
+		if name == defaultUser {
+			c.Reply().WriteError("ERR The 'default' user cannot be removed")
+			return nil
+		}
+	}
+	for _, name := range names {
+		if _, ok := s.acl.users[name]; !ok {
+			continue
+		}
+		delete(s.acl.users, name)
+		s.killClients(nil, clientKillFilter{user: name})
+		deleted++
+	}
+	c.Reply().WriteInt(deleted)
+	return nil
+}
+
+func (s *Server) processACLCat(c *Connection, msg Message) error {
+	var names []string
+	switch len(msg.data) {
+	case 2:
+		names = commandCategories
+	case 3:
+		category := strings.ToLower(msg.data[2])
+		known := false
+		for _, c := range commandCategories {
+			if c == category {
+				known = true
+			}
+		}
+		if !known {
+			c.Reply().WriteError(fmt.Sprintf("ERR Unknown category '%s'", msg.data[2]))
+			return nil
+		}
+		names = commandsInCategory(category)
+	default:
+		return errors.New("incorrect number of arguments for the acl cat command")
+	}
+
+	c.Reply().WriteBulkStrings(names)
+	return nil
+}
+
+func (s *Server) processACLDryRun(c *Connection, msg Message) error {
+	if len(msg.data) < 4 {
+		return errors.New("incorrect number of arguments for the acl dryrun command")
+	}
+	u, ok := s.acl.users[msg.data[2]]
+	if !ok {
+		c.Reply().WriteError(fmt.Sprintf("ERR User '%s' not found", msg.data[2]))
+		return nil
+	}
+	if _, ok := commandTable[strings.ToLower(msg.data[3])]; !ok {
+		c.Reply().WriteError(fmt.Sprintf("ERR Command '%s' not found", msg.data[3]))
+		return nil
+	}
+
+	if denial := u.check(msg.data[3:]); denial != nil {
+		reply := denial.Error()
+		if denial.reason == "command" {
+			reply = fmt.Sprintf("User %s %s", u.name, denial)
+		}
+		c.Reply().WriteBulkString(reply)
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processACLLog(c *Connection, msg Message) error {
+	count := len(s.acl.log)
+	if len(msg.data) == 3 {
+		if strings.ToLower(msg.data[2]) == "reset" {
+			s.acl.log = []*aclLogEntry{}
+			c.Reply().WriteSimpleString("OK")
+			return nil
+		}
+		n, err := strconv.Atoi(msg.data[2])
+		if err != nil || n < 0 {
+			c.Reply().WriteError("ERR value is out of range, must be positive")
+			return nil
+		}
+		if n < count {
+			count = n
+		}
+	}
+
+	now := time.Now()
+	w := c.Reply()
+	w.WriteArrayHeader(count)
+	for _, e := range s.acl.log[:count] {
+		w.WriteMapHeader(10)
+		w.WriteBulkString("count")
+		w.WriteInt(e.count)
+		w.WriteBulkString("reason")
+		w.WriteBulkString(e.reason)
+		w.WriteBulkString("context")
+		w.WriteBulkString(e.context)
+		w.WriteBulkString("object")
+		w.WriteBulkString(e.object)
+		w.WriteBulkString("username")
+		w.WriteBulkString(e.username)
+		w.WriteBulkString("age-seconds")
+		w.WriteBulkString(strconv.FormatFloat(now.Sub(e.createdAt).Seconds(), 'f', 3, 64))
+		w.WriteBulkString("client-info")
+		w.WriteBulkString(e.clientInfo)
+		w.WriteBulkString("entry-id")
+		w.WriteInt(e.id)
+		w.WriteBulkString("timestamp-created")
+		w.WriteInt(int(e.createdAt.UnixMilli()))
+		w.WriteBulkString("timestamp-last-updated")
+		w.WriteInt(int(e.lastUpdated.UnixMilli()))
+	}
+	return nil
+}
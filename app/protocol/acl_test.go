@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestACLUser(t *testing.T, rules ...string) *aclUser {
+	t.Helper()
+	u := newACLUser("alice")
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			t.Fatalf("applying rule %q: %s", rule, err)
+		}
+	}
+	return u
+}
+
+func TestACLRuleErrors(t *testing.T) {
+	for _, rule := range []string{"", "bogus", "%~key", "%X~key", "+nosuchcommand", "+@nosuchcategory", "#abc"} {
+		u := newACLUser("alice")
+		if err := u.applyRule(rule); err == nil {
+			t.Errorf("rule %q should be rejected", rule)
+		}
+	}
+}
+
+func TestACLPasswords(t *testing.T) {
+	u := newTestACLUser(t, "on", ">secret", ">other")
+	if !u.checkPassword("secret") || !u.checkPassword("other") {
+		t.Fatal("both passwords should be accepted")
+	}
+	if u.checkPassword("wrong") {
+		t.Fatal("wrong password should be refused")
+	}
+	if err := u.applyRule("<secret"); err != nil {
+		t.Fatal(err)
+	}
+	if u.checkPassword("secret") {
+		t.Fatal("removed password should be refused")
+	}
+	if err := u.applyRule("<secret"); err == nil {
+		t.Fatal("removing a missing password should fail")
+	}
+	if err := u.applyRule("nopass"); err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword("anything") {
+		t.Fatal("nopass user should accept any password")
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	u := newTestACLUser(t, "on", "nopass", "+@read", "-get", "+set", "%R~read:*", "~app:*", "&news.*")
+
+	tests := []struct {
+		args   []string
+		reason string
+		object string
+	}{
+		{args: []string{"GET", "app:1"}, reason: "command", object: "get"},
+		{args: []string{"SET", "app:1", "v"}},
+		{args: []string{"SET", "read:1", "v"}, reason: "key", object: "read:1"},
+		{args: []string{"SET", "other", "v"}, reason: "key", object: "other"},
+		{args: []string{"PUBLISH", "news.today", "hi"}, reason: "command", object: "publish"},
+		{args: []string{"SHUTDOWN"}, reason: "command", object: "shutdown"},
+	}
+	for _, tt := range tests {
+		denial := u.check(tt.args)
+		if tt.reason == "" {
+			if denial != nil {
+				t.Errorf("%v should be allowed, got %s", tt.args, denial)
+			}
+			continue
+		}
+		if denial == nil {
+			t.Errorf("%v should be denied", tt.args)
+			continue
+		}
+		if denial.reason != tt.reason || denial.object != tt.object {
+			t.Errorf("%v denied with %s %s, want %s %s", tt.args, denial.reason, denial.object, tt.reason, tt.object)
+		}
+	}
+
+	if err := u.applyRule("+publish"); err != nil {
+		t.Fatal(err)
+	}
+	if denial := u.check([]string{"PUBLISH", "news.today", "hi"}); denial != nil {
+		t.Errorf("publish to an allowed channel denied: %s", denial)
+	}
+	if denial := u.check([]string{"PUBLISH", "sports", "hi"}); denial == nil || denial.reason != "channel" {
+		t.Errorf("publish to another channel should be denied by channel, got %v", denial)
+	}
+}
+
+func TestACLDescribe(t *testing.T) {
+	u := newTestACLUser(t, "on", "nopass", "~app:*", "%R~read:*", "&news", "+@all", "-shutdown")
+	want := "user alice on nopass ~app:* %R~read:* &news +@all -shutdown"
+	if got := u.describe(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// describing then applying the rules gives the same user back
+	again := newTestACLUser(t, strings.Fields(want)[2:]...)
+	if got := again.describe(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	u = newTestACLUser(t, "reset")
+	if got, want := u.describe(), "user alice off resetkeys resetchannels -@all"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func writeACLFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseACLFile(t *testing.T) {
+	path := writeACLFile(t, "user alice on >secret ~cache:* +get", "", "user bob off")
+	users, err := parseACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default user is added when the file doesn't define it
+	if len(users) != 3 || users[defaultUser] == nil {
+		t.Fatalf("got %v", users)
+	}
+	if !users["alice"].checkPassword("secret") || users["bob"].enabled {
+		t.Fatal("the rules of the file weren't applied")
+	}
+
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"alice on"}, ":1: line should start with user keyword"},
+		{[]string{"user alice on", "user alice off"}, ":2: Duplicate user 'alice' found"},
+		{[]string{"user alice on", "user bob +nosuchcommand"}, ":2: Error in applying operation '+nosuchcommand'"},
+	} {
+		if _, err := parseACLFile(writeACLFile(t, tc.lines...)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.lines, err, tc.want)
+		}
+	}
+	if _, err := parseACLFile(filepath.Join(t.TempDir(), "missing.acl")); err == nil {
+		t.Error("a missing file should be an error")
+	}
+}
+
+func TestACLFileRoundTrip(t *testing.T) {
+	acl := newACLRegistry()
+	acl.file = filepath.Join(t.TempDir(), "users.acl")
+	acl.users["alice"] = newTestACLUser(t, "on", ">secret", "~cache:*", "&news", "+get", "+set")
+	if err := acl.save(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for name, u := range acl.users {
+		want[name] = u.describe()
+	}
+
+	acl.users = map[string]*aclUser{}
+	if err := acl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(acl.users) != len(want) {
+		t.Fatalf("got %d users, want %d", len(acl.users), len(want))
+	}
+	for name, u := range acl.users {
+		if got := u.describe(); got != want[name] {
+			t.Errorf("got %q, want %q", got, want[name])
+		}
+	}
+	// the temporary file is renamed over the acl file
+	if entries, _ := os.ReadDir(filepath.Dir(acl.file)); len(entries) != 1 {
+		t.Errorf("got %d files, want the acl file alone", len(entries))
+	}
+}
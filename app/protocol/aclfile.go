@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const aclFileNotConfigured = "ERR This Redis instance is not configured to use an ACL file. " +
+	"You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE " +
+	"(assuming you have a Redis configuration file set) in order to store users in the Redis configuration."
+
+// parses an acl file, one `user <name> <rules...>` line per user
+//
+// every line is validated, the users are only returned if the whole
+// file is valid
+func parseACLFile(path string) (map[string]*aclUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading ACLs, opening file '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	errs := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			errs = append(errs, fmt.Sprintf("%s:%d: line should start with user keyword", path, lineno))
+			continue
+		}
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			errs = append(errs, fmt.Sprintf("%s:%d: Duplicate user '%s' found", path, lineno, name))
+			continue
+		}
+		u := newACLUser(name)
+		for _, rule := range fields[2:] {
+			if err := u.applyRule(rule); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: Error in applying operation '%s': %s", path, lineno, rule, err))
+				break
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error loading ACLs, reading file '%s': %w", path, err)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, ". "))
+	}
+
+	// the default user keeps its defaults unless the file redefines it
+	if _, ok := users[defaultUser]; !ok {
+		users[defaultUser] = newDefaultACLUser()
+	}
+	return users, nil
+}
+
+// replaces every user with the ones of the acl file
+func (acl *aclRegistry) load() error {
+	users, err := parseACLFile(acl.file)
+	if err != nil {
+		return err
+	}
+	acl.users = users
+	return nil
+}
+
+// writes the users to a temporary file which then replaces the acl file,
+// so that a failed save never leaves a truncated file behind
+func (acl *aclRegistry) save() error {
+	var b strings.Builder
+	for _, name := range acl.usernames() {
+		b.WriteString(acl.users[name].describe())
+		b.WriteString("\n")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(acl.file), filepath.Base(acl.file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), acl.file)
+}
+
+// should be called from the executor
+//
+// disconnects the clients authenticated as users which no longer exist
+func (s *Server) killOrphanedClients() {
+	for _, client := range s.clients.list() {
+		if _, ok := s.acl.users[client.user]; !ok && client.authenticated {
+			client.Close()
+		}
+	}
+}
+
+func (s *Server) processACLLoad(c *Connection) error {
+	if s.acl.file == "" {
+		c.Reply().WriteError(aclFileNotConfigured)
+		return nil
+	}
+	if err := s.acl.load(); err != nil {
+		c.Reply().WriteError("ERR " + err.Error())
+		return nil
+	}
+	s.killOrphanedClients()
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processACLSave(c *Connection) error {
+	if s.acl.file == "" {
+		c.Reply().WriteError(aclFileNotConfigured)
+		return nil
+	}
+	if err := s.acl.save(); err != nil {
+		fmt.Printf("error saving acl file %s: %s\n", s.acl.file, err)
+		c.Reply().WriteError("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
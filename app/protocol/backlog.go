@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"time"
+)
+
+const (
+	defaultReplBacklogSize = 1024 * 1024
+	defaultReplBacklogTTL  = time.Hour
+)
+
+// circular buffer holding the most recent part of the replication stream,
+// replicas which reconnect within it resume with the bytes they missed
+// instead of a full resync
+//
+// bytes are stored at their stream offset modulo the buffer size
+type replBacklog struct {
+	buf []byte
+	// stream offset of the oldest byte held
+	start int
+	// stream offset right after the newest byte held
+	end int
+}
+
+func newReplBacklog(size, offset int) *replBacklog {
+	return &replBacklog{
+		buf:   make([]byte, size),
+		start: offset,
+		end:   offset,
+	}
+}
+
+func (b *replBacklog) write(p string) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%len(b.buf):], p)
+		p = p[n:]
+		b.end += n
+	}
+	if b.end-b.start > len(b.buf) {
+		b.start = b.end - len(b.buf)
+	}
+}
+
+// returns the stream from the offset onwards, false if the offset
+// is no longer or not yet held
+func (b *replBacklog) since(offset int) ([]byte, bool) {
+	if offset < b.start || offset > b.end {
+		return nil, false
+	}
+	out := make([]byte, 0, b.end-offset)
+	for offset < b.end {
+		pos := offset % len(b.buf)
+		n := len(b.buf) - pos
+		if n > b.end-offset {
+			n = b.end - offset
+		}
+		out = append(out, b.buf[pos:pos+n]...)
+		offset += n
+	}
+	return out, true
+}
+
+// should be called from the executor
+//
+// appends to the replication stream sent to replicas
+func (s *Server) feedReplicationStream(p string) {
+	mc := s.masterConfig
+	mc.offset += len(p)
+	if backlog := s.replBacklog(); backlog != nil {
+		backlog.write(p)
+	}
+}
+
+// should be called from the executor
+//
+// returns the backlog, nil once it was freed for having no replicas
+// for longer than repl-backlog-ttl
+func (s *Server) replBacklog() *replBacklog {
+	mc := s.masterConfig
+	if mc.backlog != nil && len(s.replicas) == 0 && s.replBacklogTTL > 0 &&
+		time.Since(mc.noReplicasSince) > s.replBacklogTTL {
+		mc.backlog = nil
+	}
+	return mc.backlog
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	b := newReplBacklog(8, 100)
+	if got, ok := b.since(100); !ok || len(got) != 0 {
+		t.Fatalf("empty backlog: got %q %v", got, ok)
+	}
+
+	b.write("abcde")
+	if got, ok := b.since(102); !ok || string(got) != "cde" {
+		t.Fatalf("got %q %v, want cde", got, ok)
+	}
+
+	// wraps around, the oldest bytes are dropped
+	b.write("fghij")
+	if b.start != 102 || b.end != 110 {
+		t.Fatalf("got start %d end %d, want 102 110", b.start, b.end)
+	}
+	if got, ok := b.since(102); !ok || string(got) != "cdefghij" {
+		t.Fatalf("got %q %v, want cdefghij", got, ok)
+	}
+	if got, ok := b.since(108); !ok || string(got) != "ij" {
+		t.Fatalf("got %q %v, want ij", got, ok)
+	}
+	if got, ok := b.since(110); !ok || len(got) != 0 {
+		t.Fatalf("got %q %v, want nothing", got, ok)
+	}
+
+	if _, ok := b.since(101); ok {
+		t.Fatal("an offset no longer held should not be found")
+	}
+	if _, ok := b.since(111); ok {
+		t.Fatal("an offset not reached yet should not be found")
+	}
+
+	// a write larger than the backlog keeps its last bytes
+	b.write("0123456789ABC")
+	if b.start != 115 || b.end != 123 {
+		t.Fatalf("got start %d end %d, want 115 123", b.start, b.end)
+	}
+	if got, ok := b.since(115); !ok || string(got) != "56789ABC" {
+		t.Fatalf("got %q %v, want 56789ABC", got, ok)
+	}
+}
@@ -0,0 +1,590 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultUser = "default"
+
+// connections served by handleClient, indexed by their id
+type clientRegistry struct {
+	lock    sync.RWMutex
+	clients map[int64]*Connection
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		lock:    sync.RWMutex{},
+		clients: make(map[int64]*Connection),
+	}
+}
+
+func (cr *clientRegistry) add(c *Connection) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.clients[c.id] = c
+}
+
+func (cr *clientRegistry) remove(c *Connection) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	delete(cr.clients, c.id)
+}
+
+func (cr *clientRegistry) get(id int64) (*Connection, bool) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	c, ok := cr.clients[id]
+	return c, ok
+}
+
+// returns the connections sorted by id
+func (cr *clientRegistry) list() []*Connection {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	clients := make([]*Connection, 0, len(cr.clients))
+	for _, c := range cr.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+type pauseMode int
+
+const (
+	pauseNone pauseMode = iota
+	pauseWrite
+	pauseAll
+)
+
+// state of CLIENT PAUSE, paused clients wait before reaching the executor
+type clientPause struct {
+	lock   sync.Mutex
+	mode   pauseMode
+	end    time.Time
+	timer  *time.Timer
+	resume chan struct{}
+}
+
+func newClientPause() *clientPause {
+	return &clientPause{
+		lock:   sync.Mutex{},
+		mode:   pauseNone,
+		resume: make(chan struct{}),
+	}
+}
+
+func (p *clientPause) pause(timeout time.Duration, mode pauseMode) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	end := time.Now().Add(timeout)
+	// an ongoing stricter or longer pause is never shortened
+	if p.mode != pauseNone {
+		if end.Before(p.end) {
+			end = p.end
+		}
+		if p.mode > mode {
+			mode = p.mode
+		}
+		p.timer.Stop()
+	}
+	p.mode = mode
+	p.end = end
+	p.timer = time.AfterFunc(time.Until(end), p.unpause)
+}
+
+func (p *clientPause) unpause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.mode == pauseNone {
+		return
+	}
+	p.timer.Stop()
+	p.mode = pauseNone
+	close(p.resume)
+	p.resume = make(chan struct{})
+}
+
+// blocks while commands of the given kind are paused
+func (p *clientPause) wait(write bool) {
+	for {
+		p.lock.Lock()
+		mode, resume := p.mode, p.resume
+		p.lock.Unlock()
+		if mode == pauseNone || (mode == pauseWrite && !write) {
+			return
+		}
+		<-resume
+	}
+}
+
+// commands which are held back by CLIENT PAUSE WRITE, writes and
+// everything that might end up writing or propagating
+func isMayWriteCommand(cmd string, args []string) bool {
+	if isWriteCommand(cmd, args) {
+		return true
+	}
+	switch cmd {
+	case "eval", "evalsha", "fcall", "function", "publish", "spublish":
+		return true
+	}
+	return false
+}
+
+func clientType(c *Connection, ps *pubSub) string {
+	switch {
+	case c.slaveToMaster:
+		return "master"
+	case c.replica:
+		return "replica"
+	case ps.hasSubscriptions(c):
+		return "pubsub"
+	default:
+		return "normal"
+	}
+}
+
+// single line describing the client in CLIENT LIST and CLIENT INFO format
+func (s *Server) clientInfo(c *Connection) string {
+	flags := ""
+	switch {
+	case c.slaveToMaster:
+		flags += "M"
+	case c.replica:
+		flags += "S"
+	}
+	if s.pubsub.hasSubscriptions(c) {
+		flags += "P"
+	}
+	redirect := s.tracking.redirection(c)
+	if redirect >= 0 {
+		flags += "t"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if c.isUnixSocket() {
+		flags += "U"
+	}
+	if c.inMulti() {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	sub, psub, ssub := s.pubsub.counts(c)
+
+	multi := -1
+	if c.inMulti() {
+		multi = len(c.multi.queued)
+	}
+
+	addr, laddr := c.addrs()
+	now := time.Now()
+	return fmt.Sprintf(
+		"id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=%d ssub=%d "+
+			"multi=%d qbuf=%d qbuf-free=%d obl=0 oll=%d omem=0 cmd=%s user=%s redir=%d resp=%d",
+		c.id, addr, laddr, c.name,
+		int(now.Sub(c.createdAt).Seconds()), int(now.Sub(c.lastInteraction).Seconds()),
+		flags, sub, psub, ssub, multi,
+		c.queryBuffer, c.rw.Reader.Size()-c.queryBuffer, len(c.pushes),
+		c.lastCommand, c.user, redirect, c.protocol,
+	)
+}
+
+func (s *Server) processClientRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the client command")
+	}
+
+	switch strings.ToLower(msg.data[1]) {
+	case "id":
+		c.Reply().WriteInt(int(c.id))
+		return nil
+	case "setname":
+		if len(msg.data) != 3 {
+			return errors.New("incorrect number of arguments for the client setname command")
+		}
+		if strings.ContainsFunc(msg.data[2], func(r rune) bool { return r <= ' ' || r > '~' }) {
+			c.Reply().WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return nil
+		}
+		c.name = msg.data[2]
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "getname":
+		if c.name == "" {
+			c.Reply().WriteNull()
+			return nil
+		}
+		c.Reply().WriteBulkString(c.name)
+		return nil
+	case "info":
+		c.Reply().WriteBulkString(s.clientInfo(c) + "\n")
+		return nil
+	case "list":
+		return s.processClientList(c, msg)
+	case "kill":
+		return s.processClientKill(c, msg)
+	case "pause":
+		return s.processClientPause(c, msg)
+	case "unpause":
+		s.pause.unpause()
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "no-evict":
+		if len(msg.data) != 3 {
+			return errors.New("incorrect number of arguments for the client no-evict command")
+		}
+		switch strings.ToLower(msg.data[2]) {
+		case "on":
+			c.noEvict = true
+		case "off":
+			c.noEvict = false
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "reply":
+		return s.processClientReply(c, msg)
+	case "tracking":
+		return s.processClientTracking(c, msg)
+	case "caching":
+		return s.processClientCaching(c, msg)
+	case "getredir":
+		c.Reply().WriteInt(int(s.tracking.redirection(c)))
+		return nil
+	case "trackinginfo":
+		s.tracking.info(c, c.Reply())
+		return nil
+	default:
+		return fmt.Errorf("unknown client subcommand %s", msg.data[1])
+	}
+}
+
+func (s *Server) processClientTracking(c *Connection, msg Message) error {
+	if len(msg.data) < 3 {
+		return errors.New("incorrect number of arguments for the client tracking command")
+	}
+
+	switch strings.ToLower(msg.data[2]) {
+	case "off":
+		s.tracking.disable(c)
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "on":
+	default:
+		c.Reply().WriteError("ERR syntax error")
+		return nil
+	}
+
+	opts := trackingOptions{}
+	for i := 3; i < len(msg.data); i++ {
+		switch strings.ToLower(msg.data[i]) {
+		case "redirect":
+			if i+1 >= len(msg.data) {
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+			id, err := strconv.ParseInt(msg.data[i+1], 10, 64)
+			if err != nil {
+				c.Reply().WriteError("ERR Invalid client ID")
+				return nil
+			}
+			if _, ok := s.clients.get(id); !ok {
+				c.Reply().WriteError("ERR The client ID you want redirect to does not exist")
+				return nil
+			}
+			opts.redirect = id
+			i++
+		case "prefix":
+			if i+1 >= len(msg.data) {
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+			opts.prefixes = append(opts.prefixes, msg.data[i+1])
+			i++
+		case "bcast":
+			opts.bcast = true
+		case "optin":
+			opts.optIn = true
+		case "optout":
+			opts.optOut = true
+		case "noloop":
+			opts.noLoop = true
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+	}
+
+	if err := s.tracking.enable(c, opts); err != nil {
+		c.Reply().WriteError(err.Error())
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processClientCaching(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the client caching command")
+	}
+	var caching trackingCaching
+	switch strings.ToLower(msg.data[2]) {
+	case "yes":
+		caching = cachingYes
+	case "no":
+		caching = cachingNo
+	default:
+		c.Reply().WriteError("ERR syntax error")
+		return nil
+	}
+	if err := s.tracking.setCaching(c, caching); err != nil {
+		c.Reply().WriteError(err.Error())
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processClientList(c *Connection, msg Message) error {
+	clientTypeFilter := ""
+	ids := map[int64]unit{}
+	for i := 2; i < len(msg.data); i++ {
+		switch strings.ToLower(msg.data[i]) {
+		case "type":
+			if i+1 >= len(msg.data) {
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+			clientTypeFilter = strings.ToLower(msg.data[i+1])
+			if clientTypeFilter == "slave" {
+				clientTypeFilter = "replica"
+			}
+			switch clientTypeFilter {
+			case "normal", "master", "replica", "pubsub":
+			default:
+				c.Reply().WriteError(fmt.Sprintf("ERR Unknown client type '%s'", msg.data[i+1]))
+				return nil
+			}
+			i++
+		case "id":
+			if i+1 >= len(msg.data) {
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+			for i+1 < len(msg.data) {
+				id, err := strconv.ParseInt(msg.data[i+1], 10, 64)
+				if err != nil || id <= 0 {
+					c.Reply().WriteError("ERR Invalid client ID")
+					return nil
+				}
+				ids[id] = unit{}
+				i++
+			}
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+	}
+
+	var sb strings.Builder
+	for _, client := range s.clients.list() {
+		if clientTypeFilter != "" && clientType(client, s.pubsub) != clientTypeFilter {
+			continue
+		}
+		if _, ok := ids[client.id]; len(ids) > 0 && !ok {
+			continue
+		}
+		sb.WriteString(s.clientInfo(client))
+		sb.WriteString("\n")
+	}
+	c.Reply().WriteBulkString(sb.String())
+	return nil
+}
+
+// filters of CLIENT KILL, zero values match every client
+type clientKillFilter struct {
+	id         int64
+	addr       string
+	laddr      string
+	user       string
+	clientType string
+	maxAge     time.Duration
+	skipMe     bool
+}
+
+func (f clientKillFilter) matches(s *Server, self, c *Connection) bool {
+	if f.skipMe && c == self {
+		return false
+	}
+	if f.id != 0 && c.id != f.id {
+		return false
+	}
+	if c.conn == nil {
+		return false
+	}
+	addr, laddr := c.addrs()
+	if f.addr != "" && addr != f.addr {
+		return false
+	}
+	if f.laddr != "" && laddr != f.laddr {
+		return false
+	}
+	if f.user != "" && c.user != f.user {
+		return false
+	}
+	if f.clientType != "" && clientType(c, s.pubsub) != f.clientType {
+		return false
+	}
+	if f.maxAge != 0 && time.Since(c.createdAt) < f.maxAge {
+		return false
+	}
+	return true
+}
+
+func (s *Server) processClientKill(c *Connection, msg Message) error {
+	if len(msg.data) < 3 {
+		return errors.New("incorrect number of arguments for the client kill command")
+	}
+
+	// old form, CLIENT KILL addr:port
+	if len(msg.data) == 3 {
+		filter := clientKillFilter{addr: msg.data[2]}
+		killed := s.killClients(c, filter)
+		if killed == 0 {
+			c.Reply().WriteError("ERR No such client")
+			return nil
+		}
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	}
+
+	filter := clientKillFilter{skipMe: true}
+	if (len(msg.data)-2)%2 != 0 {
+		c.Reply().WriteError("ERR syntax error")
+		return nil
+	}
+	for i := 2; i < len(msg.data); i += 2 {
+		val := msg.data[i+1]
+		switch strings.ToLower(msg.data[i]) {
+		case "id":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || id <= 0 {
+				c.Reply().WriteError("ERR client-id should be greater than 0")
+				return nil
+			}
+			filter.id = id
+		case "addr":
+			filter.addr = val
+		case "laddr":
+			filter.laddr = val
+		case "user":
+			filter.user = val
+		case "type":
+			filter.clientType = strings.ToLower(val)
+			if filter.clientType == "slave" {
+				filter.clientType = "replica"
+			}
+		case "maxage":
+			age, err := strconv.Atoi(val)
+			if err != nil || age <= 0 {
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+			filter.maxAge = time.Duration(age) * time.Second
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				c.Reply().WriteError("ERR syntax error")
+				return nil
+			}
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+	}
+
+	c.Reply().WriteInt(s.killClients(c, filter))
+	return nil
+}
+
+// closes every client matching the filter and returns their count,
+// the calling client is closed once its reply is written
+func (s *Server) killClients(self *Connection, filter clientKillFilter) int {
+	killed := 0
+	for _, client := range s.clients.list() {
+		if !filter.matches(s, self, client) {
+			continue
+		}
+		if client == self {
+			client.closeAfterReply = true
+		} else {
+			client.Close()
+		}
+		killed++
+	}
+	return killed
+}
+
+func (s *Server) processClientPause(c *Connection, msg Message) error {
+	if len(msg.data) != 3 && len(msg.data) != 4 {
+		return errors.New("incorrect number of arguments for the client pause command")
+	}
+	ms, err := strconv.Atoi(msg.data[2])
+	if err != nil || ms < 0 {
+		c.Reply().WriteError("ERR timeout is not an integer or out of range")
+		return nil
+	}
+	mode := pauseAll
+	if len(msg.data) == 4 {
+		switch strings.ToLower(msg.data[3]) {
+		case "write":
+			mode = pauseWrite
+		case "all":
+			mode = pauseAll
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	s.pause.pause(time.Duration(ms)*time.Millisecond, mode)
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processClientReply(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the client reply command")
+	}
+	switch strings.ToLower(msg.data[2]) {
+	case "on":
+		c.replyMode = replyOn
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "off":
+		c.replyMode = replyOff
+	case "skip":
+		c.replyMode = replySkip
+	default:
+		c.Reply().WriteError("ERR syntax error")
+		return nil
+	}
+	return nil
+}
@@ -10,12 +10,102 @@ import (
 )
 
 func (s *Server) processPingRequest(c *Connection, msg Message) error {
-	if len(msg.data) != 1 {
+	if len(msg.data) > 2 {
 		return errors.New("incorrect number of arguments for the ping command")
 	}
 
-	_, err := c.WriteString(SerializeSimpleString("PONG"))
-	return err
+	// subscribers get their reply in the same stream as the messages
+	if c.inSubscriberMode() {
+		payload := ""
+		if len(msg.data) == 2 {
+			payload = msg.data[1]
+		}
+		w := c.Reply()
+		w.WriteArrayHeader(2)
+		w.WriteBulkString("pong")
+		w.WriteBulkString(payload)
+		return nil
+	}
+
+	if len(msg.data) == 2 {
+		c.Reply().WriteBulkString(msg.data[1])
+		return nil
+	}
+	c.Reply().WriteSimpleString("PONG")
+	return nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *Server) processHelloRequest(c *Connection, msg Message) error {
+	protocol := c.protocol
+	if len(msg.data) > 1 {
+		var err error
+		protocol, err = strconv.Atoi(msg.data[1])
+		if err != nil || protocol < 2 || protocol > 3 {
+			c.Reply().WriteError("NOPROTO unsupported protocol version")
+			return nil
+		}
+	}
+	var username, password, name string
+	auth, setName := false, false
+	for i := 2; i < len(msg.data); i++ {
+		switch strings.ToLower(msg.data[i]) {
+		case "auth":
+			if i+2 >= len(msg.data) {
+				return errors.New("incorrect number of arguments for the hello command")
+			}
+			username, password, auth = msg.data[i+1], msg.data[i+2], true
+			i += 2
+		case "setname":
+			if i+1 >= len(msg.data) {
+				return errors.New("incorrect number of arguments for the hello command")
+			}
+			name, setName = msg.data[i+1], true
+			i++
+		default:
+			c.Reply().WriteError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", msg.data[i]))
+			return nil
+		}
+	}
+
+	if auth && !s.authenticateClient(c, username, password) {
+		c.Reply().WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return nil
+	}
+	if !c.authenticated {
+		c.Reply().WriteError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return nil
+	}
+	if setName {
+		if strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) {
+			c.Reply().WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return nil
+		}
+		c.name = name
+	}
+	c.protocol = protocol
+
+	role := "master"
+	if s.masterConfig == nil {
+		role = "replica"
+	}
+	w := c.Reply()
+	w.WriteMapHeader(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("redis")
+	w.WriteBulkString("version")
+	w.WriteBulkString("7.2.0")
+	w.WriteBulkString("proto")
+	w.WriteInt(c.protocol)
+	w.WriteBulkString("id")
+	w.WriteInt(int(c.id))
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString(role)
+	w.WriteBulkString("modules")
+	w.WriteArrayHeader(0)
+	return nil
 }
 
 func (s *Server) processEchoRequest(c *Connection, msg Message) error {
@@ -24,8 +114,8 @@ func (s *Server) processEchoRequest(c *Connection, msg Message) error {
 	}
 
 	fmt.Printf("echoing \"%s\"\n", msg.data[1])
-	_, err := c.WriteString(SerializeBulkString(msg.data[1]))
-	return err
+	c.Reply().WriteBulkString(msg.data[1])
+	return nil
 }
 
 func (s *Server) processGetRequest(c *Connection, msg Message) error {
@@ -35,18 +125,13 @@ func (s *Server) processGetRequest(c *Connection, msg Message) error {
 
 	key := msg.data[1]
 	val, ok := s.store.Get(key)
+	s.tracking.remember(c, key)
 	if !ok {
 		fmt.Printf("key %s does not exist\n", key)
-		_, err := c.WriteString(SerializeNullBulkString())
-		if err != nil {
-			return err
-		}
+		c.Reply().WriteNull()
 	} else {
 		fmt.Printf("key %s exists, value %s\n", key, val)
-		_, err := c.WriteString(SerializeBulkString(val))
-		if err != nil {
-			return err
-		}
+		c.Reply().WriteBulkString(val)
 	}
 	return nil
 }
@@ -58,14 +143,8 @@ func (s *Server) processSetRequest(c *Connection, msg Message) error {
 
 	if len(msg.data) == 3 {
 		fmt.Printf("setting key %s val %s\n", msg.data[1], msg.data[2])
-		err := s.Set(msg.data[1], msg.data[2])
-		if err != nil {
-			fmt.Printf("error while propogating set command: %s", err)
-		}
-		_, err = c.WriteString(SerializeSimpleString("OK"))
-		if err != nil {
-			return err
-		}
+		s.store.Set(msg.data[1], msg.data[2])
+		c.Reply().WriteSimpleString("OK")
 	} else if len(msg.data) == 5 {
 		if strings.ToLower(msg.data[3]) == "px" {
 			dur, err := strconv.Atoi(msg.data[4])
@@ -73,13 +152,47 @@ func (s *Server) processSetRequest(c *Connection, msg Message) error {
 				return err
 			}
 			fmt.Printf("setting key %s val %s for %d ms\n", msg.data[1], msg.data[2], dur)
-			s.store.SetWithTTL(msg.data[1], msg.data[2], time.Duration(dur)*time.Millisecond)
+			expireAt := s.store.SetWithTTL(msg.data[1], msg.data[2], time.Duration(dur)*time.Millisecond)
+			// replicas would expire the key later than the master,
+			// by the time the command took to reach them
+			s.alsoPropagate("SET", msg.data[1], msg.data[2])
+			s.alsoPropagate("PEXPIREAT", msg.data[1], strconv.FormatInt(expireAt.UnixMilli(), 10))
 		}
-		_, err := c.WriteString(SerializeSimpleString("OK"))
-		if err != nil {
-			return err
+		c.Reply().WriteSimpleString("OK")
+	}
+	return nil
+}
+
+// PEXPIREAT key unix-time-milliseconds
+func (s *Server) processPexpireatRequest(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the pexpireat command")
+	}
+	ms, err := strconv.ParseInt(msg.data[2], 10, 64)
+	if err != nil {
+		c.Reply().WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	if !s.store.ExpireAt(msg.data[1], time.UnixMilli(ms)) {
+		c.Reply().WriteInt(0)
+		return nil
+	}
+	c.Reply().WriteInt(1)
+	return nil
+}
+
+// DEL key [key ...]
+func (s *Server) processDelRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the del command")
+	}
+	deleted := 0
+	for _, key := range msg.data[1:] {
+		if s.store.Delete(key) {
+			deleted++
 		}
 	}
+	c.Reply().WriteInt(deleted)
 	return nil
 }
 
@@ -87,19 +200,36 @@ func (s *Server) processInfoRequest(c *Connection, msg Message) error {
 	if len(msg.data) != 2 {
 		return errors.New("incorrect number of arguments for the info command")
 	}
-	if msg.data[1] == "replication" {
+	if strings.ToLower(msg.data[1]) == "replication" {
 		var sb strings.Builder
 		if s.masterConfig != nil {
 			sb.WriteString(fmt.Sprintf("role:%s\n", "master"))
+			sb.WriteString(fmt.Sprintf("connected_slaves:%d\n", len(s.replicas)))
+			s.replicasInfo(&sb)
+			if s.minReplicasToWrite > 0 {
+				sb.WriteString(fmt.Sprintf("min_slaves_good_slaves:%d\n", s.goodReplicas()))
+			}
 			sb.WriteString(fmt.Sprintf("master_replid:%s\n", s.masterConfig.id))
 			sb.WriteString(fmt.Sprintf("master_repl_offset:%d\n", s.masterConfig.offset))
+			if s.masterConfig.replID2 != "" {
+				sb.WriteString(fmt.Sprintf("master_replid2:%s\n", s.masterConfig.replID2))
+				sb.WriteString(fmt.Sprintf("second_repl_offset:%d\n", s.masterConfig.secondOffset))
+			}
+			if backlog := s.replBacklog(); backlog != nil {
+				sb.WriteString("repl_backlog_active:1\n")
+				sb.WriteString(fmt.Sprintf("repl_backlog_size:%d\n", len(backlog.buf)))
+				sb.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\n", backlog.start))
+				sb.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\n", backlog.end-backlog.start))
+			} else {
+				sb.WriteString("repl_backlog_active:0\n")
+			}
 		} else {
 			sb.WriteString(fmt.Sprintf("role:%s\n", "slave"))
+			s.replicaInfo(&sb)
+			sb.WriteString(fmt.Sprintf("connected_slaves:%d\n", len(s.replicas)))
+			s.replicasInfo(&sb)
 		}
-		_, err := c.WriteString(SerializeBulkString(sb.String()))
-		if err != nil {
-			return err
-		}
+		c.Reply().WriteBulkString(sb.String())
 	}
 	return nil
 }
@@ -110,7 +240,15 @@ func (s *Server) processReplConfRequest(c *Connection, msg Message) error {
 		return errors.New("incorrect number of arguments for the replconf command")
 	}
 
-	switch msg.data[1] {
+	switch strings.ToLower(msg.data[1]) {
+	case "listening-port":
+		port, err := strconv.Atoi(msg.data[2])
+		if err != nil {
+			c.Reply().WriteError("ERR value is not an integer or out of range")
+			return nil
+		}
+		c.replicaPort = port
+		c.Reply().WriteSimpleString("OK")
 	case "getack":
 		if s.slaveConfig == nil {
 			return errors.New("non-master should not receive getack")
@@ -120,10 +258,7 @@ func (s *Server) processReplConfRequest(c *Connection, msg Message) error {
 			return err
 		}
 	default:
-		_, err := c.WriteString(SerializeSimpleString("OK"))
-		if err != nil {
-			return err
-		}
+		c.Reply().WriteSimpleString("OK")
 	}
 
 	return nil
@@ -133,35 +268,106 @@ func (s *Server) processPsyncRequest(c *Connection, msg Message) error {
 	if len(msg.data) != 3 {
 		return errors.New("incorrect number of arguments for the psync command")
 	}
-	_, err := c.WriteString(
-		SerializeSimpleString(
-			fmt.Sprintf("FULLRESYNC %s %d", s.masterConfig.id, s.masterConfig.offset),
-		),
-	)
-	if err != nil {
+	// sub-replicas follow the stream of the master, which this replica
+	// can only serve once it is in sync
+	if s.slaveConfig != nil && (s.slaveConfig.state != replStateConnected || s.slaveConfig.backlog == nil) {
+		c.Reply().WriteError("NOMASTERLINK Can't SYNC while not connected with my master")
+		return nil
+	}
+	// the client loop stops reading from replicas, so the replication
+	// stream is flushed as it is written
+	if err := c.stopBatching(); err != nil {
 		return err
 	}
-
-	_, err = c.WriteString(strings.TrimSuffix(SerializeBulkString(getEmptyRDBFileBinary()), "\r\n"))
-	if err != nil {
+	w := c.Reply()
+	replID, offset := s.replicationPosition()
+	if missed, ok := s.partialResync(msg.data[1], msg.data[2]); ok {
+		fmt.Printf("continuing replication from offset %s\n", msg.data[2])
+		w.WriteSimpleString("CONTINUE " + replID)
+		w.WriteRaw(missed)
+	} else if s.disklessSync {
+		// the replica is replied to once the transfer starts
+		s.queueDisklessSync(c)
+		return nil
+	} else {
+		w.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d", replID, offset))
+		w.WriteRDB(s.snapshot())
+	}
+	if err := c.flushReply(); err != nil {
 		return err
 	}
+	s.attachReplica(c).synced()
+	return nil
+}
 
-	s.masterConfig.slaves = append(s.masterConfig.slaves, &SlaveConnection{
-		Connection: c,
-		offset:     0,
-	})
+// should be called from the executor
+//
+// starts propagating the replication stream to c, which is synced up to
+// the current offset
+func (s *Server) attachReplica(c *Connection) *SlaveConnection {
+	if mc := s.masterConfig; mc != nil && s.replBacklog() == nil {
+		mc.backlog = newReplBacklog(s.replBacklogSize, mc.offset)
+	}
+	c.replica = true
+	// replicas acknowledge their offset every second, a silent one
+	// is considered gone
+	c.readTimeout = s.replTimeout
+	sc := newSlaveConnection(c, s.replicaOutputLimit)
+	s.replicas = append(s.replicas, sc)
+	return sc
+}
 
-	return nil
+// should be called from the executor
+//
+// returns the replication id and offset of the stream this server serves
+// to its replicas, a replica serves the stream of its master
+func (s *Server) replicationPosition() (string, int) {
+	if s.masterConfig != nil {
+		return s.masterConfig.id, s.masterConfig.offset
+	}
+	return s.slaveConfig.replID, s.slaveConfig.offset
 }
 
-func (s *Server) processWaitRequest(c *Connection, msg Message) error {
-	// this will probably get turned into a function parameter
-	ctx := context.Background()
+// should be called from the executor
+//
+// returns the part of the replication stream a replica missed, false if
+// the replica should do a full resync instead
+func (s *Server) partialResync(replID, offset string) ([]byte, bool) {
+	from, err := strconv.Atoi(offset)
+	if err != nil {
+		return nil, false
+	}
+	id, replID2, secondOffset, backlog := "", "", 0, (*replBacklog)(nil)
+	if mc := s.masterConfig; mc != nil {
+		id, replID2, secondOffset, backlog = mc.id, mc.replID2, mc.secondOffset, s.replBacklog()
+	} else {
+		sc := s.slaveConfig
+		id, replID2, secondOffset, backlog = sc.replID, sc.replID2, sc.secondOffset, sc.backlog
+	}
+	// replicas of the previous history share it up to the point
+	// where the history changed
+	if replID != id && (replID != replID2 || replID2 == "" || from > secondOffset) {
+		return nil, false
+	}
+	if backlog == nil {
+		return nil, false
+	}
+	return backlog.since(from)
+}
 
+// replies once enough replicas acknowledged every write propagated before
+// the command, or once the timeout expires
+//
+// the client is parked while waiting for acknowledgements so that other
+// clients are served in the meantime
+func (s *Server) processWaitRequest(c *Connection, msg Message) error {
 	if len(msg.data) != 3 {
 		return errors.New("incorrect number of arguments for the wait command")
 	}
+	if s.masterConfig == nil {
+		c.Reply().WriteError("ERR WAIT cannot be used with replica instances.")
+		return nil
+	}
 
 	reqInSyncReplCount, err := strconv.Atoi(msg.data[1])
 	if err != nil {
@@ -173,48 +379,47 @@ func (s *Server) processWaitRequest(c *Connection, msg Message) error {
 		return fmt.Errorf("wait command third arg should be integer but %w", err)
 	}
 
+	target := s.masterConfig.offset
+	total := len(s.replicas)
 	currInSyncCount := 0
-	for _, sc := range s.masterConfig.slaves {
-		fmt.Printf("master offset %d replica offset is %d\n", s.masterConfig.offset, sc.offset)
-		if s.masterConfig.offset == sc.offset {
+	for _, sc := range s.replicas {
+		fmt.Printf("master offset %d replica offset is %d\n", target, sc.offset.Load())
+		if sc.offset.Load() >= int64(target) {
 			currInSyncCount++
 		}
 	}
 	fmt.Printf("%d replicas are currently in sync\n", currInSyncCount)
 
-	if s.areEnoughReplicasInSync(currInSyncCount, reqInSyncReplCount) {
+	if areEnoughReplicasInSync(currInSyncCount, reqInSyncReplCount, total) {
 		fmt.Printf("enough replicas are in sync for wait command\n")
-		_, err = c.WriteString(SerializeInteger(currInSyncCount))
-		return err
+		c.Reply().WriteInt(currInSyncCount)
+		return nil
 	}
 
 	fmt.Printf("not enough replicas were in sync, resyncing with slaves\n")
-	inSyncCount := 0
-	ctx, ctxCancel := context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
-	defer ctxCancel()
-
-	ch := s.SyncSlaves(ctx)
-	for inSyncCount = range ch {
-		fmt.Printf("%d replicas are in sync\n", inSyncCount)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Duration(ms)*time.Millisecond)
+	ch := s.SyncSlaves(ctx, target)
+	s.blockClient(c, func() error {
+		defer ctxCancel()
+		inSyncCount := 0
+		for inSyncCount = range ch {
+			fmt.Printf("%d replicas are in sync\n", inSyncCount)
 
-		if s.areEnoughReplicasInSync(inSyncCount, reqInSyncReplCount) {
-			fmt.Printf("enough replicas are in sync %d\n", inSyncCount)
-			_, err = c.WriteString(SerializeInteger(inSyncCount))
-			return err
+			if areEnoughReplicasInSync(inSyncCount, reqInSyncReplCount, total) {
+				fmt.Printf("enough replicas are in sync %d\n", inSyncCount)
+				c.Reply().WriteInt(inSyncCount)
+				return nil
+			}
 		}
-	}
 
-	fmt.Printf("%d replicas are in sync, responding due to timeout\n", inSyncCount)
-	_, err = c.WriteString(SerializeInteger(inSyncCount))
-	if err != nil {
-		return err
-	}
-
-	return ctx.Err()
+		fmt.Printf("%d replicas are in sync, responding due to timeout\n", inSyncCount)
+		c.Reply().WriteInt(inSyncCount)
+		return ctx.Err()
+	})
+	return nil
 }
 
-func (s *Server) areEnoughReplicasInSync(curr, required int) bool {
-	total := len(s.masterConfig.slaves)
+func areEnoughReplicasInSync(curr, required, total int) bool {
 	return curr >= required ||
 		curr == total
 }
@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ACL categories of commands, without the leading @
+var commandCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// a key accessed by a command
+type keyRef struct {
+	key   string
+	read  bool
+	write bool
+}
+
+type commandSpec struct {
+	categories []string
+	// categories of the subcommands, subcommands missing here
+	// share the categories of the command
+	subcommands map[string][]string
+	// returns the keys accessed by the command, nil if none
+	keys func(args []string) []keyRef
+	// returns the pub/sub channels accessed by the command,
+	// patterns is set if the channels are subscription patterns
+	channels func(args []string) (channels []string, patterns bool)
+}
+
+func (spec commandSpec) hasCategory(category string) bool {
+	for _, c := range spec.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func firstKey(read, write bool) func(args []string) []keyRef {
+	return func(args []string) []keyRef {
+		if len(args) < 2 {
+			return nil
+		}
+		return []keyRef{{key: args[1], read: read, write: write}}
+	}
+}
+
+// keys of commands taking nothing but keys from idx on, such as DEL
+func keysFrom(idx int, read, write bool) func(args []string) []keyRef {
+	return func(args []string) []keyRef {
+		if len(args) <= idx {
+			return nil
+		}
+		keys := make([]keyRef, 0, len(args)-idx)
+		for _, key := range args[idx:] {
+			keys = append(keys, keyRef{key: key, read: read, write: write})
+		}
+		return keys
+	}
+}
+
+// keys of EVAL and FCALL style commands, numkeys followed by the keys
+func numKeysAt(idx int, read, write bool) func(args []string) []keyRef {
+	return func(args []string) []keyRef {
+		if len(args) <= idx {
+			return nil
+		}
+		n, err := strconv.Atoi(args[idx])
+		if err != nil || n < 0 || idx+1+n > len(args) {
+			return nil
+		}
+		keys := make([]keyRef, n)
+		for i, key := range args[idx+1 : idx+1+n] {
+			keys[i] = keyRef{key: key, read: read, write: write}
+		}
+		return keys
+	}
+}
+
+func channelArgs(from int, patterns bool) func(args []string) ([]string, bool) {
+	return func(args []string) ([]string, bool) {
+		if len(args) <= from {
+			return nil, patterns
+		}
+		return args[from:], patterns
+	}
+}
+
+func publishChannel(args []string) ([]string, bool) {
+	if len(args) < 2 {
+		return nil, false
+	}
+	return args[1:2], false
+}
+
+var commandTable = map[string]commandSpec{
+	"ping":      {categories: []string{"fast", "connection"}},
+	"echo":      {categories: []string{"fast", "connection"}},
+	"hello":     {categories: []string{"fast", "connection"}},
+	"auth":      {categories: []string{"fast", "connection"}},
+	"get":       {categories: []string{"read", "string", "fast"}, keys: firstKey(true, false)},
+	"set":       {categories: []string{"write", "string", "slow"}, keys: firstKey(false, true)},
+	"pexpireat": {categories: []string{"keyspace", "write", "fast"}, keys: firstKey(false, true)},
+	"del":       {categories: []string{"keyspace", "write", "slow"}, keys: keysFrom(1, false, true)},
+	"info":      {categories: []string{"slow", "dangerous"}},
+	"replconf":  {categories: []string{"admin", "slow", "dangerous"}},
+	"psync":     {categories: []string{"admin", "slow", "dangerous"}},
+	"shutdown":  {categories: []string{"admin", "slow", "dangerous"}},
+	"replicaof": {categories: []string{"admin", "slow", "dangerous"}},
+	"slaveof":   {categories: []string{"admin", "slow", "dangerous"}},
+	"wait":      {categories: []string{"slow", "connection"}},
+	"multi":     {categories: []string{"fast", "transaction"}},
+	"exec":      {categories: []string{"slow", "transaction"}},
+	"discard":   {categories: []string{"fast", "transaction"}},
+	"eval":      {categories: []string{"slow", "scripting"}, keys: numKeysAt(2, true, true)},
+	"evalsha":   {categories: []string{"slow", "scripting"}, keys: numKeysAt(2, true, true)},
+	"fcall":     {categories: []string{"slow", "scripting"}, keys: numKeysAt(2, true, true)},
+	"fcall_ro":  {categories: []string{"slow", "scripting"}, keys: numKeysAt(2, true, false)},
+	"script":    {categories: []string{"slow", "scripting"}},
+	"function": {
+		categories: []string{"slow", "scripting"},
+		subcommands: map[string][]string{
+			"load":    {"write", "slow", "scripting"},
+			"delete":  {"write", "slow", "scripting"},
+			"flush":   {"write", "slow", "scripting"},
+			"restore": {"write", "slow", "scripting"},
+		},
+	},
+	"subscribe":    {categories: []string{"pubsub", "slow"}, channels: channelArgs(1, false)},
+	"psubscribe":   {categories: []string{"pubsub", "slow"}, channels: channelArgs(1, true)},
+	"ssubscribe":   {categories: []string{"pubsub", "slow"}, channels: channelArgs(1, false)},
+	"unsubscribe":  {categories: []string{"pubsub", "slow"}},
+	"punsubscribe": {categories: []string{"pubsub", "slow"}},
+	"sunsubscribe": {categories: []string{"pubsub", "slow"}},
+	"publish":      {categories: []string{"pubsub", "fast"}, channels: publishChannel},
+	"spublish":     {categories: []string{"pubsub", "fast"}, channels: publishChannel},
+	"pubsub":       {categories: []string{"pubsub", "slow"}},
+	"client": {
+		categories: []string{"slow", "connection"},
+		subcommands: map[string][]string{
+			"kill":     {"admin", "slow", "dangerous", "connection"},
+			"list":     {"admin", "slow", "dangerous", "connection"},
+			"pause":    {"admin", "slow", "dangerous", "connection"},
+			"unpause":  {"admin", "slow", "dangerous", "connection"},
+			"no-evict": {"admin", "slow", "dangerous", "connection"},
+		},
+	},
+	"acl": {
+		categories: []string{"slow"},
+		subcommands: map[string][]string{
+			"setuser": {"admin", "slow", "dangerous"},
+			"getuser": {"admin", "slow", "dangerous"},
+			"deluser": {"admin", "slow", "dangerous"},
+			"list":    {"admin", "slow", "dangerous"},
+			"users":   {"admin", "slow", "dangerous"},
+			"dryrun":  {"admin", "slow", "dangerous"},
+			"log":     {"admin", "slow", "dangerous"},
+			"load":    {"admin", "slow", "dangerous"},
+			"save":    {"admin", "slow", "dangerous"},
+		},
+	},
+}
+
+// reports whether the command, or its subcommand, modifies the dataset
+func isWriteCommand(cmd string, args []string) bool {
+	spec, ok := commandTable[cmd]
+	if !ok {
+		return false
+	}
+	if len(args) > 1 {
+		if categories, ok := spec.subcommands[strings.ToLower(args[1])]; ok {
+			return commandSpec{categories: categories}.hasCategory("write")
+		}
+	}
+	return spec.hasCategory("write")
+}
+
+// returns the commands and subcommands, in `cmd|sub` form,
+// which belong to the category
+func commandsInCategory(category string) []string {
+	names := []string{}
+	for name, spec := range commandTable {
+		if spec.hasCategory(category) {
+			names = append(names, name)
+		}
+		for sub, categories := range spec.subcommands {
+			if (commandSpec{categories: categories}).hasCategory(category) {
+				names = append(names, name+"|"+sub)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
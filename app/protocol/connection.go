@@ -2,56 +2,292 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pending pushes above this limit disconnect the subscriber
+// instead of blocking the publisher
+const pushQueueLimit = 1024
+
+var lastConnectionID atomic.Int64
+
+// limits of the requests sent by clients, past which the connection is
+// closed instead of allocating what the client announced
+const (
+	maxBulkLen      = 512 * 1024 * 1024
+	maxMultibulkLen = 1024 * 1024
+)
+
+// malformed requests, the client is replied with the error and the
+// connection closed as the rest of the stream can't be parsed
+var errProtocol = errors.New("Protocol error")
+
+type replyMode int
+
+const (
+	replyOn replyMode = iota
+	replyOff
+	replySkip
 )
 
 type Connection struct {
+	id   int64
 	conn net.Conn
 	rw   *bufio.ReadWriter
 	lock sync.Mutex
+	// serializes writes of replies and pushes
+	writeLock sync.Mutex
+	// replies are buffered until the connection reads from the network
+	// again, so that a pipeline of commands is answered with one write
+	batching bool
 
 	slaveToMaster bool
+	// reads fail once nothing was received for this long, 0 waits forever
+	readTimeout time.Duration
+	// unix nanoseconds of the last read from the network
+	lastRead atomic.Int64
+	// set once the client issues PSYNC and becomes a replica
+	replica bool
+	// port the replica listens on, announced through REPLCONF
+	replicaPort int
+
+	// metadata shown by CLIENT LIST, modified from the executor
+	name            string
+	user            string
+	authenticated   bool
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCommand     string
+	queryBuffer     int
+	noEvict         bool
+	closeAfterReply bool
+
+	replyMode replyMode
+	// reply of the current command
+	reply ReplyWriter
+	// replies of the current command are dropped after CLIENT REPLY SKIP
+	skipping bool
+	// set by blocking commands, finishes the command outside of the executor
+	blockedOn func() error
+	// commands queued after MULTI, nil outside of transactions
+	multi *transaction
+
+	// RESP protocol version negotiated through HELLO
+	protocol int
+
+	// only modified by the connection's own goroutine
+	// while the pub/sub registry is locked
+	channels      map[string]unit
+	patterns      map[string]unit
+	shardChannels map[string]unit
+
+	// client side caching state, guarded by the tracking table lock
+	tracking *trackingState
+
+	pushes     chan []byte
+	pusherOnce sync.Once
+	pushing    atomic.Bool
 }
 
 type SlaveConnection struct {
 	*Connection
-	offset int
+	// last offset acknowledged by the replica
+	offset atomic.Int64
+	// unix nanoseconds of the last acknowledgement
+	lastAck atomic.Int64
+	// closed and replaced on every acknowledgement
+	ackLock sync.Mutex
+	acked   chan unit
+
+	limit outputBufferLimit
+	// replication stream waiting for the writer goroutine
+	outLock sync.Mutex
+	out     []byte
+	// bytes queued or being written
+	pending atomic.Int64
+	// when pending went past the soft limit, zero while below it,
+	// modified from the executor
+	softLimitSince time.Time
+	// set once a write to the replica failed
+	broken atomic.Bool
+	// closed once the snapshot or the missed part of the stream was
+	// written, the queued stream follows
+	ready    chan unit
+	outReady chan unit
+	stop     chan unit
+	stopOnce sync.Once
+	stopped  chan unit
+}
+
+// flushes the buffered replies of the connection before blocking on a read
+type flushingReader struct {
+	c *Connection
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	if err := r.c.flush(); err != nil {
+		return 0, err
+	}
+	if r.c.readTimeout > 0 {
+		r.c.conn.SetReadDeadline(time.Now().Add(r.c.readTimeout))
+	}
+	n, err := r.c.conn.Read(p)
+	if n > 0 {
+		r.c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
 }
 
 func NewConn(conn net.Conn, slaveToMaster bool) *Connection {
-	r := bufio.NewReader(conn)
+	now := time.Now()
+	c := &Connection{
+		id:              lastConnectionID.Add(1),
+		conn:            conn,
+		lock:            sync.Mutex{},
+		batching:        !slaveToMaster,
+		slaveToMaster:   slaveToMaster,
+		user:            defaultUser,
+		createdAt:       now,
+		lastInteraction: now,
+		protocol:        2,
+		channels:        make(map[string]unit),
+		patterns:        make(map[string]unit),
+		shardChannels:   make(map[string]unit),
+		pushes:          make(chan []byte, pushQueueLimit),
+	}
+	c.reply.c = c
+	r := bufio.NewReader(flushingReader{c: c})
 	w := bufio.NewWriter(conn)
-	rw := bufio.NewReadWriter(r, w)
-	return &Connection{
-		conn:          conn,
-		rw:            rw,
+	c.rw = bufio.NewReadWriter(r, w)
+	return c
+}
+
+func (c *Connection) isUnixSocket() bool {
+	if c.conn == nil {
+		return false
+	}
+	_, ok := c.conn.LocalAddr().(*net.UnixAddr)
+	return ok
+}
+
+// remote and local addresses shown by CLIENT LIST, unix socket clients
+// have no address of their own and are shown as the socket path
+func (c *Connection) addrs() (string, string) {
+	if c.conn == nil {
+		return "", ""
+	}
+	if c.isUnixSocket() {
+		path := c.conn.LocalAddr().String()
+		return path + ":0", path
+	}
+	return c.conn.RemoteAddr().String(), c.conn.LocalAddr().String()
+}
+
+// returns a connection which records every reply written to it
+// instead of sending it over the network
+//
+// used to capture the output of commands called from scripts
+func newRecorderConn() (*Connection, *bytes.Buffer) {
+	var buf bytes.Buffer
+	r := bufio.NewReader(&bytes.Buffer{})
+	w := bufio.NewWriter(&buf)
+	c := &Connection{
+		conn:          nil,
+		rw:            bufio.NewReadWriter(r, w),
+		user:          defaultUser,
 		lock:          sync.Mutex{},
-		slaveToMaster: slaveToMaster,
+		protocol:      2,
+		channels:      make(map[string]unit),
+		patterns:      make(map[string]unit),
+		shardChannels: make(map[string]unit),
 	}
+	c.reply.c = c
+	return c, &buf
 }
 
 func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
-func (c *Connection) WriteString(s string) (int, error) {
-	if c.slaveToMaster {
-		return 0, nil
-	}
-	n, err := c.rw.WriteString(s)
-	if err != nil {
+func (c *Connection) discardsReplies() bool {
+	return c.slaveToMaster || c.replyMode == replyOff || c.skipping
+}
+
+func (c *Connection) write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	n, err := c.rw.Write(p)
+	if err != nil || c.batching {
 		return n, err
 	}
 	err = c.rw.Flush()
 	return n, err
 }
 
+func (c *Connection) flush() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.rw.Flush()
+}
+
+// stops batching, replies written afterwards are flushed right away
+func (c *Connection) stopBatching() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.batching = false
+	return c.rw.Flush()
+}
+
+// queues the serialized push to be written by the push writer
+// goroutine, p must not be modified afterwards
+//
+// never blocks, a connection which cannot keep up with its pushes
+// gets disconnected
+func (c *Connection) Push(p []byte) {
+	c.pusherOnce.Do(func() {
+		c.pushing.Store(true)
+		go c.writePushes()
+	})
+	select {
+	case c.pushes <- p:
+	default:
+		fmt.Printf("client %d push queue is full, disconnecting\n", c.id)
+		c.Close()
+	}
+}
+
+func (c *Connection) writePushes() {
+	for p := range c.pushes {
+		if _, err := c.write(p); err != nil {
+			fmt.Printf("couldn't write push to client %d: %s\n", c.id, err)
+		}
+		// pushes queued together are flushed together
+		if len(c.pushes) == 0 {
+			if err := c.flush(); err != nil {
+				fmt.Printf("couldn't write push to client %d: %s\n", c.id, err)
+			}
+		}
+	}
+}
+
+// stops the push writer goroutine, no pushes should be queued afterwards
+func (c *Connection) closePushes() {
+	close(c.pushes)
+}
+
 func (c *Connection) ReplyGetAck(offset int) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 	n, err := c.rw.WriteString(
 		SerializeArray(
 			SerializeBulkString("REPLCONF"),
@@ -72,7 +308,7 @@ func (c *Connection) nextString() (string, int, error) {
 	if err != nil {
 		return "", 0, err
 	}
-	s = strings.ToLower(strings.Trim(s, "\r\n"))
+	s = strings.Trim(s, "\r\n")
 	return s, len(s) + 2, nil
 }
 
@@ -83,112 +319,189 @@ func (c *Connection) parseWord() (string, int, error) {
 		return "", 0, err
 	}
 	readBytes += n
+	if len(lead) == 0 {
+		return "", 0, fmt.Errorf("%w: expected '$', got an empty line", errProtocol)
+	}
 	switch lead[0] {
 	case '+':
 		s, err := DeserializeSimpleString(lead)
-		return s, readBytes, err
-	case '$':
-		data, n, err := c.nextString()
 		if err != nil {
+			return "", 0, fmt.Errorf("%w: %s", errProtocol, err)
+		}
+		return s, readBytes, nil
+	case '$':
+		// bulk strings are binary safe, read exactly the announced length
+		length, err := strconv.Atoi(lead[1:])
+		if err != nil || length < 0 || length > maxBulkLen {
+			return "", 0, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(c.rw, buf); err != nil {
 			return "", 0, err
 		}
-		readBytes += n
-		return DeserializeBulkString(data), readBytes, nil
+		readBytes += len(buf)
+		return DeserializeBulkString(string(buf[:length])), readBytes, nil
 	default:
-		return "", 0, fmt.Errorf("unsupported starting character: %c", lead[0])
+		return "", 0, fmt.Errorf("%w: expected '$', got '%c'", errProtocol, lead[0])
 	}
 }
 
+// reads the next command, empty arrays are skipped
 func (c *Connection) nextCommand() (Message, error) {
 	var msg Message
-	lead, n, err := c.nextString()
-	if err != nil {
-		return msg, err
-	}
-	msg.readBytes += n
-	// Parse number of arguments
-	if lead[0] != '*' {
-		return msg, fmt.Errorf("Leading command string should be array but was %s", lead)
-	}
-	arrLength, err := strconv.Atoi(lead[1:])
-	if err != nil {
-		return msg, err
-	}
-
-	msg.data = make([]string, arrLength)
-
-	for i := 0; i < arrLength; i++ {
-		msg.data[i], n, err = c.parseWord()
+	for len(msg.data) == 0 {
+		lead, n, err := c.nextString()
 		if err != nil {
 			return msg, err
 		}
 		msg.readBytes += n
+		// Parse number of arguments
+		if len(lead) == 0 || lead[0] != '*' {
+			return msg, fmt.Errorf("%w: expected '*', got %q", errProtocol, lead)
+		}
+		arrLength, err := strconv.Atoi(lead[1:])
+		if err != nil || arrLength < 0 || arrLength > maxMultibulkLen {
+			return msg, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+		}
+
+		msg.data = make([]string, arrLength)
+
+		for i := 0; i < arrLength; i++ {
+			msg.data[i], n, err = c.parseWord()
+			if err != nil {
+				return msg, err
+			}
+			msg.readBytes += n
+		}
 	}
 	fmt.Printf("incoming: %s\n", msg.data)
 	return msg, nil
 }
 
-func (c *Connection) parseRDBFile() (string, error) {
+// returns a reader of the rdb file sent by the master after FULLRESYNC,
+// which is either prefixed by its length or, when the master streams it,
+// delimited by an EOF mark
+//
+// the reader stops at the end of the file, the replication stream which
+// follows is left for nextCommand
+func (c *Connection) rdbPayload() (io.Reader, error) {
 	lead, _, err := c.nextString()
 	if err != nil {
-		return "", err
-	}
-	if lead[0] != '$' {
-		return "", fmt.Errorf("expected symbol $ but got %c", lead[0])
+		return nil, err
 	}
-	i, err := strconv.Atoi(lead[1:])
-	if err != nil {
-		return "", fmt.Errorf("expected number after $ but got %s", lead[1:])
+	if len(lead) == 0 || lead[0] != '$' {
+		return nil, fmt.Errorf("expected symbol $ but got %q", lead)
 	}
-	buf := make([]byte, i)
-	for counter := 0; counter < i; counter++ {
-		b, err := c.rw.ReadByte()
-		if err != nil {
-			return "", fmt.Errorf("couldn't read byte: %s", lead[1:])
+	if mark, ok := strings.CutPrefix(lead, "$EOF:"); ok {
+		if len(mark) != rdbEOFMarkLen {
+			return nil, fmt.Errorf("expected an EOF mark of %d bytes but got %q", rdbEOFMarkLen, mark)
 		}
-		buf[counter] = b
+		return &eofMarkReader{r: c.rw.Reader, mark: []byte(mark)}, nil
+	}
+	n, err := strconv.Atoi(lead[1:])
+	if err != nil {
+		return nil, fmt.Errorf("expected number after $ but got %s", lead[1:])
 	}
+	return io.LimitReader(c.rw, int64(n)), nil
+}
 
-	return string(buf), nil
+// reads until the EOF mark, which is not returned
+//
+// bytes are only consumed from r once they are known to come before the
+// end of the mark
+type eofMarkReader struct {
+	r    *bufio.Reader
+	mark []byte
+	// last bytes read, which might be the start of the mark
+	tail []byte
+	// bytes known to come before the mark, not returned yet
+	out  []byte
+	done bool
 }
 
-func (sc *SlaveConnection) Sync(ctx context.Context, ch chan<- int) {
-	sc.lock.Lock()
-	defer sc.lock.Unlock()
+func (r *eofMarkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
 
-	_, err := sc.WriteString(CommandReplConfGetAck)
-	if err != nil {
-		return
+func (r *eofMarkReader) fill() error {
+	if _, err := r.r.Peek(1); err != nil {
+		// the link closed before the end of the file
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	peeked, _ := r.r.Peek(r.r.Buffered())
+	data := append(r.tail, peeked...)
+	if i := bytes.Index(data, r.mark); i >= 0 {
+		_, err := r.r.Discard(i + len(r.mark) - len(r.tail))
+		r.out, r.tail, r.done = data[:i], nil, true
+		return err
+	}
+	keep := len(r.mark) - 1
+	if keep > len(data) {
+		keep = len(data)
 	}
+	r.out = data[:len(data)-keep]
+	r.tail = append([]byte(nil), data[len(data)-keep:]...)
+	_, err := r.r.Discard(len(peeked))
+	return err
+}
 
-	cmdChan := make(chan Message)
-	go func() {
-		defer close(cmdChan)
+// reads the acknowledgements the replica sends every second and in reply
+// to GETACK, until the link breaks or times out
+func (sc *SlaveConnection) readAcks() {
+	for {
 		msg, err := sc.nextCommand()
-		fmt.Println("recv: ", msg.data)
 		if err != nil {
-			fmt.Printf("%s\n", err)
-		}
-		cmdChan <- msg
-	}()
-	select {
-	case <-ctx.Done():
-		return
-	case msg, ok := <-cmdChan:
-		if !ok {
+			fmt.Printf("stopped reading acknowledgements of replica %d: %s\n", sc.id, err)
+			sc.broken.Store(true)
+			sc.Close()
 			return
 		}
-
-		fmt.Println("recv: ", msg.data)
 		offset, err := msg.parseReplConfAck()
 		if err != nil {
 			fmt.Printf("%s\n", err)
-			return
+			continue
 		}
-
-		fmt.Printf("received offset %d\n", offset)
-		sc.offset = offset
-		ch <- offset
+		sc.offset.Store(int64(offset))
+		sc.lastAck.Store(time.Now().UnixNano())
+		sc.ackLock.Lock()
+		close(sc.acked)
+		sc.acked = make(chan unit)
+		sc.ackLock.Unlock()
 	}
+}
+
+// returns a channel which is closed by the next acknowledgement
+func (sc *SlaveConnection) nextAck() <-chan unit {
+	sc.ackLock.Lock()
+	defer sc.ackLock.Unlock()
+	return sc.acked
+}
 
+// sends on ch once the replica acknowledged the target offset
+func (sc *SlaveConnection) waitOffset(ctx context.Context, target int, ch chan<- unit) {
+	for {
+		acked := sc.nextAck()
+		if sc.offset.Load() >= int64(target) {
+			ch <- unit{}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-acked:
+		}
+	}
 }
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// returns a connection reading the given bytes as if sent by a client
+func newTestConn(input string) *Connection {
+	c, _ := newRecorderConn()
+	c.rw.Reader = bufio.NewReader(strings.NewReader(input))
+	return c
+}
+
+func TestNextCommand(t *testing.T) {
+	input := "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n" +
+		"*0\r\n*1\r\n+PING\r\n"
+	c := newTestConn(input)
+
+	msg, err := c.nextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ECHO", "a\r\nb"}; !reflect.DeepEqual(msg.data, want) {
+		t.Fatalf("got %q, want %q", msg.data, want)
+	}
+	if msg.readBytes != 24 {
+		t.Fatalf("got %d bytes read, want 24", msg.readBytes)
+	}
+
+	// empty arrays are skipped but still count toward the bytes read
+	msg, err = c.nextCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PING"}; !reflect.DeepEqual(msg.data, want) {
+		t.Fatalf("got %q, want %q", msg.data, want)
+	}
+	if msg.readBytes != 15 {
+		t.Fatalf("got %d bytes read, want 15", msg.readBytes)
+	}
+
+	if _, err = c.nextCommand(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+func TestNextCommandProtocolErrors(t *testing.T) {
+	for _, input := range []string{
+		"\r\n",
+		"PING\r\n",
+		"*-1\r\n",
+		"*abc\r\n",
+		"*99999999999\r\n",
+		"*1\r\n\r\n",
+		"*1\r\n$-5\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$99999999999\r\n",
+		"*1\r\n:1\r\n",
+	} {
+		_, err := newTestConn(input).nextCommand()
+		if !errors.Is(err, errProtocol) {
+			t.Errorf("%q: got %v, want a protocol error", input, err)
+		}
+	}
+}
+
+func TestEOFMarkReader(t *testing.T) {
+	mark := strings.Repeat("m", rdbEOFMarkLen)
+	// the payload holds a partial mark, which must not end the read
+	payload := "REDIS0011" + strings.Repeat("x", 5000) + mark[:rdbEOFMarkLen-1] + "yz"
+	rest := "*1\r\n$4\r\nPING\r\n"
+
+	for name, src := range map[string]io.Reader{
+		"buffered":    strings.NewReader(payload + mark + rest),
+		"byte a time": iotest.OneByteReader(strings.NewReader(payload + mark + rest)),
+	} {
+		br := bufio.NewReaderSize(src, 16)
+		got, err := io.ReadAll(&eofMarkReader{r: br, mark: []byte(mark)})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if string(got) != payload {
+			t.Fatalf("%s: got %d bytes, want the %d bytes before the mark", name, len(got), len(payload))
+		}
+		// what follows the mark is left for the next reader
+		left, _ := io.ReadAll(br)
+		if string(left) != rest {
+			t.Fatalf("%s: got %q left, want %q", name, left, rest)
+		}
+	}
+
+	_, err := io.ReadAll(&eofMarkReader{r: bufio.NewReader(strings.NewReader(payload)), mark: []byte(mark)})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("a stream ending before the mark should fail")
+	}
+}
+
+// counts the writes reaching the network
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int32
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// the replies of pipelined commands are written at once, when the
+// server runs out of commands to read
+func TestPipelineBatching(t *testing.T) {
+	s := newTestServer(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	var writes atomic.Int32
+	done := make(chan unit)
+	go func() {
+		defer close(done)
+		s.handleClient(NewConn(countingConn{Conn: server, writes: &writes}, false))
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	pipeline := strings.Repeat("*1\r\n$4\r\nPING\r\n", 3) + "*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"
+	if _, err := client.Write([]byte(pipeline)); err != nil {
+		t.Fatal(err)
+	}
+	want := "+PONG\r\n+PONG\r\n+PONG\r\n$2\r\nhi\r\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if n := writes.Load(); n != 1 {
+		t.Fatalf("got %d writes, want the replies batched in 1", n)
+	}
+	client.Close()
+	<-done
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/common"
+)
+
+const (
+	defaultDisklessSyncDelay = 5 * time.Second
+
+	// streamed rdb files end with a random mark of this length instead
+	// of being prefixed by their length
+	rdbEOFMarkLen = 40
+)
+
+// how replicas load the rdb file received on full resync
+const (
+	// the file is read in full before the dataset is replaced
+	disklessLoadDisabled = "disabled"
+	// the file is parsed into a new dataset as it is received, which
+	// replaces the current one once complete
+	disklessLoadSwapDB = "swapdb"
+)
+
+// replicas waiting for the next diskless transfer, which starts once
+// repl-diskless-sync-delay elapsed since the first of them asked for it
+type disklessTransfer struct {
+	// replication id the replicas asked to sync with
+	replID  string
+	waiting []*Connection
+}
+
+// should be called from the executor
+//
+// queues the replica for the next diskless transfer, replicas arriving
+// during the delay share the same transfer
+func (s *Server) queueDisklessSync(c *Connection) {
+	c.replica = true
+	if s.diskless == nil {
+		replID, _ := s.replicationPosition()
+		s.diskless = &disklessTransfer{replID: replID}
+		fmt.Printf("starting diskless sync in %s\n", s.disklessSyncDelay)
+		time.AfterFunc(s.disklessSyncDelay, func() {
+			s.exec.do(s.startDisklessSync)
+		})
+	}
+	s.diskless.waiting = append(s.diskless.waiting, c)
+}
+
+// should be called from the executor
+//
+// takes the snapshot the waiting replicas sync from and streams it to
+// them in the background, the stream propagated meanwhile is queued in
+// their output buffers
+func (s *Server) startDisklessSync() {
+	transfer := s.diskless
+	s.diskless = nil
+	// the history of the server changed during the delay, the replicas
+	// ask again when they reconnect
+	replID, offset := s.replicationPosition()
+	if replID != transfer.replID || (s.slaveConfig != nil && s.slaveConfig.state != replStateConnected) {
+		for _, c := range transfer.waiting {
+			c.Close()
+		}
+		return
+	}
+
+	snapshot := s.snapshotState()
+	mark := common.RandomString(rdbEOFMarkLen)
+	var header ReplyWriter
+	header.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d", replID, offset))
+	header.WriteRDBMarkHeader(mark)
+	replicas := make([]*SlaveConnection, 0, len(transfer.waiting))
+	for _, c := range transfer.waiting {
+		if _, err := c.write(header.buf); err != nil {
+			fmt.Printf("couldn't start diskless sync with replica %d: %s\n", c.id, err)
+			c.Close()
+			continue
+		}
+		replicas = append(replicas, s.attachReplica(c))
+	}
+	if len(replicas) == 0 {
+		return
+	}
+	go transferRDB(snapshot, mark, replicas)
+}
+
+// streams the snapshot to every replica of a diskless transfer, the
+// replicas whose link broke are closed and dropped on the next
+// propagation
+func transferRDB(snapshot rdbSnapshot, mark string, replicas []*SlaveConnection) {
+	w := &replicasWriter{replicas: replicas, failed: make([]bool, len(replicas))}
+	err := writeRDB(w, snapshot)
+	if err == nil {
+		_, err = w.Write([]byte(mark))
+	}
+	if err != nil {
+		fmt.Printf("diskless sync failed: %s\n", err)
+	} else {
+		fmt.Printf("diskless sync with %d replicas done\n", len(replicas))
+	}
+	for i, sc := range replicas {
+		if err != nil || w.failed[i] {
+			sc.broken.Store(true)
+			sc.Close()
+		}
+		sc.synced()
+	}
+}
+
+// writes the same bytes to several replicas, a replica whose write fails
+// is skipped afterwards
+type replicasWriter struct {
+	replicas []*SlaveConnection
+	failed   []bool
+}
+
+func (w *replicasWriter) Write(p []byte) (int, error) {
+	written := false
+	for i, sc := range w.replicas {
+		if w.failed[i] {
+			continue
+		}
+		if _, err := sc.write(p); err != nil {
+			fmt.Printf("couldn't stream snapshot to replica %d: %s\n", sc.id, err)
+			w.failed[i] = true
+			continue
+		}
+		written = true
+	}
+	if !written {
+		return 0, errors.New("every replica of the transfer failed")
+	}
+	return len(p), nil
+}
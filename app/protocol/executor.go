@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errExecutorStopped = errors.New("executor is stopped")
+
+// runs every command on a single goroutine, so that command handlers
+// can use the server state without locking
+//
+// connections parse requests on their own goroutines and hand them to
+// the executor, blocking commands such as WAIT park their client and
+// finish outside of the executor so that other clients are served
+// in the meantime
+type executor struct {
+	tasks chan func()
+	// closed by stop, tasks are not run anymore afterwards
+	stopped  chan unit
+	stopOnce sync.Once
+}
+
+func newExecutor() *executor {
+	e := &executor{
+		tasks:   make(chan func()),
+		stopped: make(chan unit),
+	}
+	go e.run()
+	return e
+}
+
+func (e *executor) run() {
+	for {
+		select {
+		case task := <-e.tasks:
+			task()
+		case <-e.stopped:
+			return
+		}
+	}
+}
+
+// ends the executor goroutine once the task being run returns
+func (e *executor) stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopped)
+	})
+}
+
+// runs fn on the executor and waits for it to return, fn is not run
+// once the executor is stopped
+//
+// must not be called from the executor itself
+func (e *executor) do(fn func()) {
+	_ = e.doContext(context.Background(), fn)
+}
+
+// runs fn on the executor and waits for it to return, or for ctx to be
+// done, in which case fn may still run later
+//
+// must not be called from the executor itself
+func (e *executor) doContext(ctx context.Context, fn func()) error {
+	done := make(chan unit)
+	select {
+	case e.tasks <- func() {
+		defer close(done)
+		fn()
+	}:
+	case <-e.stopped:
+		return errExecutorStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// should be called from the executor
+//
+// parks the client once the current command returns, wait is then run on
+// the client's own goroutine and must reply to the client by itself
+//
+// wait must not use the server state other than through `s.exec.do`
+func (s *Server) blockClient(c *Connection, wait func() error) {
+	c.blockedOn = wait
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecutor(t *testing.T) {
+	e := newExecutor()
+	ran := false
+	e.do(func() {
+		ran = true
+	})
+	if !ran {
+		t.Fatal("the task didn't run")
+	}
+
+	// a task holding the executor doesn't hold callers past their deadline
+	holding, release := make(chan unit), make(chan unit)
+	go e.do(func() {
+		close(holding)
+		<-release
+	})
+	<-holding
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := e.doContext(ctx, func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to expire", err)
+	}
+
+	e.stop()
+	close(release)
+	select {
+	case <-e.stopped:
+	default:
+		t.Fatal("the executor should be stopped")
+	}
+	e.do(func() {
+		t.Error("a task ran after the executor stopped")
+	})
+	if err := e.doContext(context.Background(), func() {}); !errors.Is(err, errExecutorStopped) {
+		t.Fatalf("got %v, want errExecutorStopped", err)
+	}
+	e.stop()
+}
+
+// tasks handed by many goroutines run one at a time, the race detector
+// catches them sharing the counter otherwise
+func TestExecutorSerializes(t *testing.T) {
+	e := newExecutor()
+	defer e.stop()
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e.do(func() {
+					counter++
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if counter != 800 {
+		t.Fatalf("got %d, want 800", counter)
+	}
+}
+
+func TestShutdownStopsExecutor(t *testing.T) {
+	s, err := NewServer([]ServerOptFunc{WithAddressAndPort("127.0.0.1", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.exec.stopped:
+	default:
+		t.Fatal("the executor outlived the server")
+	}
+}
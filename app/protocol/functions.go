@@ -0,0 +1,597 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/codecrafters-io/redis-starter-go/app/common"
+)
+
+const functionEngineLua = "LUA"
+
+// library code is only expected to register its functions, loading it
+// is stopped once it runs longer than this
+const libraryLoadTimeout = 500 * time.Millisecond
+
+var functionFlags = map[string]unit{
+	"no-writes":             {},
+	"allow-oom":             {},
+	"allow-stale":           {},
+	"no-cluster":            {},
+	"allow-cross-slot-keys": {},
+}
+
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*libraryFunction
+	// the library code ran in this state, its functions are called in it
+	state *lua.LState
+}
+
+func (lib *functionLibrary) close() {
+	lib.state.Close()
+}
+
+type libraryFunction struct {
+	name        string
+	description string
+	flags       []string
+	library     *functionLibrary
+	callback    *lua.LFunction
+}
+
+func (f *libraryFunction) hasFlag(flag string) bool {
+	for _, fl := range f.flags {
+		if fl == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// only modified from the executor
+type functionRegistry struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*libraryFunction
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*libraryFunction),
+	}
+}
+
+// adds the library to the registry, replacing the library
+// with the same name if replace is set
+func (fr *functionRegistry) add(lib *functionLibrary, replace bool) error {
+	old, exists := fr.libraries[lib.name]
+	if exists && !replace {
+		return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if f, ok := fr.functions[name]; ok && f.library != old {
+			return fmt.Errorf("ERR Function %s already exists", name)
+		}
+	}
+	if exists {
+		fr.delete(old.name)
+	}
+	fr.libraries[lib.name] = lib
+	for name, f := range lib.functions {
+		fr.functions[name] = f
+	}
+	return nil
+}
+
+// returns the removed library, nil if there is none with that name
+func (fr *functionRegistry) delete(name string) *functionLibrary {
+	lib, ok := fr.libraries[name]
+	if !ok {
+		return nil
+	}
+	for fname := range lib.functions {
+		delete(fr.functions, fname)
+	}
+	delete(fr.libraries, name)
+	return lib
+}
+
+// removes every library and closes their states
+func (fr *functionRegistry) flush() {
+	for _, lib := range fr.libraries {
+		lib.close()
+	}
+	fr.libraries = make(map[string]*functionLibrary)
+	fr.functions = make(map[string]*libraryFunction)
+}
+
+// returns the libraries sorted by name
+func (fr *functionRegistry) list() []*functionLibrary {
+	libs := make([]*functionLibrary, 0, len(fr.libraries))
+	for _, lib := range fr.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool {
+		return libs[i].name < libs[j].name
+	})
+	return libs
+}
+
+// returns the code of every library, used for rdb files and dumps
+func (fr *functionRegistry) codes() []string {
+	libs := fr.list()
+	codes := make([]string, len(libs))
+	for i, lib := range libs {
+		codes[i] = lib.code
+	}
+	return codes
+}
+
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parses the `#!<engine> name=<library>` header of the library code
+func parseLibraryHeader(code string) (string, error) {
+	header, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return "", errors.New("ERR Missing library metadata")
+	}
+	parts := strings.Fields(header[2:])
+	if len(parts) == 0 {
+		return "", errors.New("ERR Missing library metadata")
+	}
+	if strings.ToUpper(parts[0]) != functionEngineLua {
+		return "", fmt.Errorf("ERR Engine '%s' not found", parts[0])
+	}
+
+	name := ""
+	for _, part := range parts[1:] {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || key != "name" {
+			return "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = val
+	}
+	if name == "" {
+		return "", errors.New("ERR Library name was not given")
+	}
+	if !isValidFunctionName(name) {
+		return "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// runs the library code in a fresh lua state, which is kept to call the
+// functions the code registers
+//
+// libraries are not allowed to touch the dataset while being loaded,
+// redis.call only becomes available once the code ran
+func (s *Server) evalLibrary(code string) (*functionLibrary, error) {
+	name, err := parseLibraryHeader(code)
+	if err != nil {
+		return nil, err
+	}
+
+	L := newScriptState()
+	lib := &functionLibrary{
+		name:      name,
+		code:      code,
+		functions: make(map[string]*libraryFunction),
+		state:     L,
+	}
+
+	mod := s.registerRedisModule(L)
+	call, pcall := mod.RawGetString("call"), mod.RawGetString("pcall")
+	forbidden := func(L *lua.LState) int {
+		L.RaiseError("redis.call and redis.pcall are not allowed while loading a library")
+		return 0
+	}
+	mod.RawSetString("call", L.NewFunction(forbidden))
+	mod.RawSetString("pcall", L.NewFunction(forbidden))
+	mod.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		f, cb, err := parseRegisterFunctionArgs(L)
+		if err != nil {
+			L.RaiseError("%s", err)
+			return 0
+		}
+		if _, ok := lib.functions[f.name]; ok {
+			L.RaiseError("Function %s already exists", f.name)
+			return 0
+		}
+		f.library = lib
+		f.callback = cb
+		lib.functions[f.name] = f
+		return 0
+	}))
+
+	// the header is not valid lua, blank it out while keeping line numbers intact
+	body := ""
+	if idx := strings.IndexByte(code, '\n'); idx >= 0 {
+		body = code[idx:]
+	}
+
+	fn, err := L.LoadString(body)
+	if err != nil {
+		L.Close()
+		return nil, fmt.Errorf("ERR Error compiling function: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), libraryLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		if ctx.Err() != nil {
+			return nil, errors.New("ERR FUNCTION LOAD timeout")
+		}
+		return nil, luaError(err)
+	}
+	if len(lib.functions) == 0 {
+		L.Close()
+		return nil, errors.New("ERR No functions registered")
+	}
+
+	mod.RawSetString("call", call)
+	mod.RawSetString("pcall", pcall)
+	mod.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}))
+	return lib, nil
+}
+
+// supports both redis.register_function(name, callback) and
+// redis.register_function{function_name=..., callback=..., flags=..., description=...}
+func parseRegisterFunctionArgs(L *lua.LState) (*libraryFunction, *lua.LFunction, error) {
+	f := &libraryFunction{flags: []string{}}
+	var cb *lua.LFunction
+
+	switch first := L.Get(1).(type) {
+	case lua.LString:
+		fn, ok := L.Get(2).(*lua.LFunction)
+		if !ok || L.GetTop() != 2 {
+			return nil, nil, errors.New("wrong number of arguments to redis.register_function")
+		}
+		f.name = string(first)
+		cb = fn
+	case *lua.LTable:
+		var err error
+		first.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch k.String() {
+			case "function_name":
+				f.name = v.String()
+			case "callback":
+				fn, ok := v.(*lua.LFunction)
+				if !ok {
+					err = errors.New("callback argument given to redis.register_function must be a function")
+					return
+				}
+				cb = fn
+			case "description":
+				f.description = v.String()
+			case "flags":
+				tb, ok := v.(*lua.LTable)
+				if !ok {
+					err = errors.New("flags argument to redis.register_function must be a table representing function flags")
+					return
+				}
+				tb.ForEach(func(_, flag lua.LValue) {
+					if _, ok := functionFlags[flag.String()]; !ok {
+						err = fmt.Errorf("unknown flag given: %s", flag.String())
+						return
+					}
+					f.flags = append(f.flags, flag.String())
+				})
+			default:
+				err = fmt.Errorf("unknown argument given to redis.register_function: %s", k.String())
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if cb == nil {
+			return nil, nil, errors.New("redis.register_function must get a callback argument")
+		}
+	default:
+		return nil, nil, errors.New("calling redis.register_function with a single argument is only applicable to Lua table")
+	}
+
+	if !isValidFunctionName(f.name) {
+		return nil, nil, errors.New("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return f, cb, nil
+}
+
+func (s *Server) processFunctionRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the function command")
+	}
+
+	switch strings.ToLower(msg.data[1]) {
+	case "load":
+		return s.processFunctionLoad(c, msg)
+	case "delete":
+		if len(msg.data) != 3 {
+			return errors.New("incorrect number of arguments for the function delete command")
+		}
+		lib := s.functions.delete(msg.data[2])
+		if lib == nil {
+			c.Reply().WriteError("ERR Library not found")
+			return nil
+		}
+		lib.close()
+		s.alsoPropagate(msg.data...)
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "flush":
+		s.functions.flush()
+		s.alsoPropagate(msg.data...)
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "list":
+		return s.processFunctionList(c, msg)
+	case "stats":
+		return s.processFunctionStats(c)
+	case "dump":
+		c.Reply().WriteBulkString(encodeFunctionsPayload(s.functions.codes()))
+		return nil
+	case "restore":
+		return s.processFunctionRestore(c, msg)
+	case "kill":
+		return s.processScriptKill(c)
+	default:
+		return fmt.Errorf("unknown function subcommand %s", msg.data[1])
+	}
+}
+
+func (s *Server) processFunctionLoad(c *Connection, msg Message) error {
+	if len(msg.data) != 3 && len(msg.data) != 4 {
+		return errors.New("incorrect number of arguments for the function load command")
+	}
+	replace := false
+	if len(msg.data) == 4 {
+		if strings.ToLower(msg.data[2]) != "replace" {
+			return fmt.Errorf("unknown function load argument %s", msg.data[2])
+		}
+		replace = true
+	}
+	code := msg.data[len(msg.data)-1]
+
+	lib, err := s.evalLibrary(code)
+	if err != nil {
+		c.Reply().WriteError(err.Error())
+		return nil
+	}
+	old := s.functions.libraries[lib.name]
+	if err = s.functions.add(lib, replace); err != nil {
+		lib.close()
+		c.Reply().WriteError(err.Error())
+		return nil
+	}
+	if old != nil {
+		old.close()
+	}
+
+	s.alsoPropagate(msg.data...)
+	c.Reply().WriteBulkString(lib.name)
+	return nil
+}
+
+func (s *Server) processFunctionList(c *Connection, msg Message) error {
+	pattern := ""
+	withCode := false
+	for i := 2; i < len(msg.data); i++ {
+		switch strings.ToLower(msg.data[i]) {
+		case "withcode":
+			withCode = true
+		case "libraryname":
+			if i+1 >= len(msg.data) {
+				return errors.New("library name argument was not given")
+			}
+			pattern = msg.data[i+1]
+			i++
+		default:
+			return fmt.Errorf("unknown function list argument %s", msg.data[i])
+		}
+	}
+
+	libs := []*functionLibrary{}
+	for _, lib := range s.functions.list() {
+		if pattern == "" || common.GlobMatch(pattern, lib.name) {
+			libs = append(libs, lib)
+		}
+	}
+
+	w := c.Reply()
+	w.WriteArrayHeader(len(libs))
+	for _, lib := range libs {
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if withCode {
+			w.WriteArrayHeader(8)
+		} else {
+			w.WriteArrayHeader(6)
+		}
+		w.WriteBulkString("library_name")
+		w.WriteBulkString(lib.name)
+		w.WriteBulkString("engine")
+		w.WriteBulkString(functionEngineLua)
+		w.WriteBulkString("functions")
+		w.WriteArrayHeader(len(names))
+		for _, name := range names {
+			f := lib.functions[name]
+			w.WriteArrayHeader(6)
+			w.WriteBulkString("name")
+			w.WriteBulkString(f.name)
+			w.WriteBulkString("description")
+			if f.description != "" {
+				w.WriteBulkString(f.description)
+			} else {
+				w.WriteNull()
+			}
+			w.WriteBulkString("flags")
+			w.WriteBulkStrings(f.flags)
+		}
+		if withCode {
+			w.WriteBulkString("library_code")
+			w.WriteBulkString(lib.code)
+		}
+	}
+	return nil
+}
+
+func (s *Server) processFunctionStats(c *Connection) error {
+	w := c.Reply()
+	w.WriteArrayHeader(4)
+	w.WriteBulkString("running_script")
+	if rs := s.scripting.current(); rs != nil && rs.name != "" {
+		w.WriteArrayHeader(6)
+		w.WriteBulkString("name")
+		w.WriteBulkString(rs.name)
+		w.WriteBulkString("command")
+		w.WriteBulkStrings(rs.command)
+		w.WriteBulkString("duration_ms")
+		w.WriteInt(int(time.Since(rs.startedAt).Milliseconds()))
+	} else {
+		w.WriteNull()
+	}
+	w.WriteBulkString("engines")
+	w.WriteArrayHeader(2)
+	w.WriteBulkString(functionEngineLua)
+	w.WriteArrayHeader(4)
+	w.WriteBulkString("libraries_count")
+	w.WriteInt(len(s.functions.libraries))
+	w.WriteBulkString("functions_count")
+	w.WriteInt(len(s.functions.functions))
+	return nil
+}
+
+func (s *Server) processFunctionRestore(c *Connection, msg Message) error {
+	if len(msg.data) != 3 && len(msg.data) != 4 {
+		return errors.New("incorrect number of arguments for the function restore command")
+	}
+	policy := "append"
+	if len(msg.data) == 4 {
+		policy = strings.ToLower(msg.data[3])
+		if policy != "append" && policy != "replace" && policy != "flush" {
+			return fmt.Errorf("unknown function restore policy %s", msg.data[3])
+		}
+	}
+
+	codes, err := decodeFunctionsPayload(msg.data[2])
+	if err != nil {
+		c.Reply().WriteError(fmt.Sprintf("ERR DUMP payload version or checksum are wrong: %s", err))
+		return nil
+	}
+	if err = s.restoreFunctions(codes, policy); err != nil {
+		c.Reply().WriteError(err.Error())
+		return nil
+	}
+
+	s.alsoPropagate(msg.data...)
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+// loads every library into a scratch registry first so that
+// a failing library leaves the current one untouched
+func (s *Server) restoreFunctions(codes []string, policy string) error {
+	restored := newFunctionRegistry()
+	if policy != "flush" {
+		for _, lib := range s.functions.list() {
+			_ = restored.add(lib, false)
+		}
+	}
+	var loaded []*functionLibrary
+	for _, code := range codes {
+		lib, err := s.evalLibrary(code)
+		if err == nil {
+			loaded = append(loaded, lib)
+			err = restored.add(lib, policy == "replace")
+		}
+		if err != nil {
+			for _, lib := range loaded {
+				lib.close()
+			}
+			return err
+		}
+	}
+	// libraries left out of the restored registry won't be called anymore
+	for _, lib := range append(s.functions.list(), loaded...) {
+		if restored.libraries[lib.name] != lib {
+			lib.close()
+		}
+	}
+	s.functions = restored
+	return nil
+}
+
+func (s *Server) processFcallRequest(c *Connection, msg Message, readOnly bool) error {
+	if len(msg.data) < 3 {
+		return errors.New("incorrect number of arguments for the fcall command")
+	}
+
+	f, ok := s.functions.functions[msg.data[1]]
+	if !ok {
+		c.Reply().WriteError("ERR Function not found")
+		return nil
+	}
+	if readOnly && !f.hasFlag("no-writes") {
+		c.Reply().WriteError("ERR Can not execute a script with write flag using *_ro command.")
+		return nil
+	}
+
+	numKeys, err := strconv.Atoi(msg.data[2])
+	if err != nil {
+		c.Reply().WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	if numKeys < 0 {
+		c.Reply().WriteError("ERR Number of keys can't be negative")
+		return nil
+	}
+	if numKeys > len(msg.data)-3 {
+		c.Reply().WriteError("ERR Number of keys can't be greater than number of args")
+		return nil
+	}
+	keys, argv := msg.data[3:3+numKeys], msg.data[3+numKeys:]
+
+	L := f.library.state
+	err = s.callScriptFunction(c.Reply(), L, f.callback, &runningScript{
+		name:     f.name,
+		command:  msg.data,
+		readOnly: f.hasFlag("no-writes"),
+	}, stringsToLuaTable(L, keys), stringsToLuaTable(L, argv))
+	if err != nil {
+		c.Reply().WriteError(err.Error())
+	}
+	return nil
+}
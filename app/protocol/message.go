@@ -3,6 +3,7 @@ package protocol
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type Message struct {
@@ -14,10 +15,10 @@ func (m Message) parseReplConfAck() (int, error) {
 	if len(m.data) != 3 {
 		return 0, fmt.Errorf("repl conf ack length should be 3, got %d", len(m.data))
 	}
-	if m.data[0] != "replconf" {
+	if !strings.EqualFold(m.data[0], "replconf") {
 		return 0, fmt.Errorf("repl conf ack first word should be 'replconf', got %s", m.data[0])
 	}
-	if m.data[1] != "ack" {
+	if !strings.EqualFold(m.data[1], "ack") {
 		return 0, fmt.Errorf("repl conf ack second word should be 'ack', got %s", m.data[1])
 	}
 	offset, err := strconv.Atoi(m.data[2])
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commands which cannot be queued inside a transaction
+var multiForbiddenCommands = map[string]unit{
+	"multi":        {},
+	"wait":         {},
+	"psync":        {},
+	"replconf":     {},
+	"shutdown":     {},
+	"subscribe":    {},
+	"psubscribe":   {},
+	"ssubscribe":   {},
+	"unsubscribe":  {},
+	"punsubscribe": {},
+	"sunsubscribe": {},
+}
+
+// commands queued between MULTI and EXEC
+type transaction struct {
+	queued []Message
+	// set when a command failed to be queued, EXEC then aborts
+	aborted bool
+}
+
+func (c *Connection) inMulti() bool {
+	return c.multi != nil
+}
+
+// should be called from the executor
+//
+// queues the command of a client inside a transaction, replying QUEUED
+func (s *Server) queueCommand(c *Connection, msg Message) {
+	cmd := strings.ToLower(msg.data[0])
+	if _, ok := commandTable[cmd]; !ok {
+		c.multi.aborted = true
+		c.Reply().WriteError(fmt.Sprintf("ERR unknown command '%s'", msg.data[0]))
+		return
+	}
+	if _, ok := multiForbiddenCommands[cmd]; ok {
+		c.multi.aborted = true
+		c.Reply().WriteError(fmt.Sprintf("ERR Command not allowed inside a transaction: %s", cmd))
+		return
+	}
+	c.multi.queued = append(c.multi.queued, msg)
+	c.Reply().WriteSimpleString("QUEUED")
+}
+
+func (s *Server) processMultiRequest(c *Connection, msg Message) error {
+	if c.inMulti() {
+		c.Reply().WriteError("ERR MULTI calls can not be nested")
+		return nil
+	}
+	c.multi = &transaction{}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+func (s *Server) processDiscardRequest(c *Connection, msg Message) error {
+	if !c.inMulti() {
+		c.Reply().WriteError("ERR DISCARD without MULTI")
+		return nil
+	}
+	c.multi = nil
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+// runs the queued commands one after another, their replies form
+// the elements of EXEC's reply
+//
+// commands run back to back on the executor so no other client
+// observes the transaction half applied
+func (s *Server) processExecRequest(c *Connection, msg Message) error {
+	if !c.inMulti() {
+		c.Reply().WriteError("ERR EXEC without MULTI")
+		return nil
+	}
+	tx := c.multi
+	c.multi = nil
+	if tx.aborted {
+		c.Reply().WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return nil
+	}
+
+	w := c.Reply()
+	w.WriteArrayHeader(len(tx.queued))
+	for _, queued := range tx.queued {
+		before := len(w.buf)
+		err := s.call(c, queued)
+		// every command needs a reply for the array to stay well formed
+		if len(w.buf) == before {
+			if err == nil {
+				w.WriteNull()
+			} else {
+				w.WriteError(fmt.Sprintf("ERR %s", err))
+			}
+		}
+	}
+	return nil
+}
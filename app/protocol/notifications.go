@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// classes of keyspace events, selected through notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZset
+	notifyExpired
+	notifyStream
+	notifyKeyMiss
+	notifyNew
+
+	// `A` does not include key-miss and new key events
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyStream
+)
+
+var keyspaceEventFlags = map[rune]int{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	's': notifySet,
+	'h': notifyHash,
+	'z': notifyZset,
+	'x': notifyExpired,
+	't': notifyStream,
+	'm': notifyKeyMiss,
+	'n': notifyNew,
+	'A': notifyAll,
+}
+
+// parses the notify-keyspace-events flag string, an empty string
+// disables notifications
+func ParseKeyspaceEventFlags(flags string) (int, error) {
+	classes := 0
+	for _, r := range flags {
+		class, ok := keyspaceEventFlags[r]
+		if !ok {
+			return 0, fmt.Errorf("invalid keyspace event flag %c", r)
+		}
+		classes |= class
+	}
+	return classes, nil
+}
+
+// runs the expiration of a key on the executor, called from the
+// store's timers
+func (s *Server) runExpiration(fn func()) {
+	s.exec.do(fn)
+}
+
+// should be called from the executor
+//
+// called by the store for every keyspace event
+func (s *Server) onKeyspaceEvent(class int, event, key string) {
+	// a new key is always followed by the event which created it
+	if class&(notifyKeyMiss|notifyNew) == 0 {
+		// expirations aren't caused by the client being served, even
+		// when its read found the key expired, so NOLOOP doesn't apply
+		var writer *Connection
+		if class != notifyExpired {
+			writer = s.currentClient.Load()
+		}
+		s.tracking.invalidate(key, writer)
+	}
+	if class == notifyExpired {
+		s.propagateExpiration(key)
+	}
+	s.notifyKeyspaceEvent(class, event, key)
+}
+
+// should be called from the executor
+//
+// publishes the event to the keyspace and keyevent channels
+// if notifications for its class are enabled
+func (s *Server) notifyKeyspaceEvent(class int, event, key string) {
+	flags := s.keyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		s.pubsub.publish(fmt.Sprintf("__keyspace@0__:%s", key), event)
+	}
+	if flags&notifyKeyevent != 0 {
+		s.pubsub.publish(fmt.Sprintf("__keyevent@0__:%s", event), key)
+	}
+}
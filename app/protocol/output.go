@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// client-output-buffer-limit of replicas, 0 disables a limit
+//
+// a replica is dropped once the replication stream waiting to be written
+// to it goes past the hard limit, or stays past the soft limit for longer
+// than softFor
+type outputBufferLimit struct {
+	hard    int
+	soft    int
+	softFor time.Duration
+}
+
+var defaultReplicaOutputLimit = outputBufferLimit{
+	hard:    256 * 1024 * 1024,
+	soft:    64 * 1024 * 1024,
+	softFor: 60 * time.Second,
+}
+
+var errReplicaLinkBroken = errors.New("the link with the replica is broken")
+
+func newSlaveConnection(c *Connection, limit outputBufferLimit) *SlaveConnection {
+	sc := &SlaveConnection{
+		Connection: c,
+		limit:      limit,
+		acked:      make(chan unit),
+		ready:      make(chan unit),
+		outReady:   make(chan unit, 1),
+		stop:       make(chan unit),
+		stopped:    make(chan unit),
+	}
+	sc.lastAck.Store(time.Now().UnixNano())
+	go sc.writeOutput()
+	go sc.readAcks()
+	return sc
+}
+
+// should be called from the executor
+//
+// queues a part of the replication stream without waiting for the replica
+// to receive it
+//
+// not-nil error means the replica is past its output buffer limits or its
+// link broke, and should be dropped
+func (sc *SlaveConnection) send(p string) error {
+	if sc.broken.Load() {
+		return errReplicaLinkBroken
+	}
+	sc.outLock.Lock()
+	sc.out = append(sc.out, p...)
+	sc.outLock.Unlock()
+	pending := sc.pending.Add(int64(len(p)))
+	select {
+	case sc.outReady <- unit{}:
+	default:
+	}
+	return sc.checkOutputLimit(int(pending))
+}
+
+// should be called from the executor
+func (sc *SlaveConnection) checkOutputLimit(pending int) error {
+	l := sc.limit
+	if l.hard > 0 && pending > l.hard {
+		return fmt.Errorf("%d bytes waiting for the replica, past the hard limit", pending)
+	}
+	if l.soft == 0 || pending <= l.soft {
+		sc.softLimitSince = time.Time{}
+		return nil
+	}
+	if sc.softLimitSince.IsZero() {
+		sc.softLimitSince = time.Now()
+	}
+	if time.Since(sc.softLimitSince) > l.softFor {
+		return fmt.Errorf("%d bytes waiting for the replica, past the soft limit for %s", pending, l.softFor)
+	}
+	return nil
+}
+
+// lets the writer goroutine start once the data the replica syncs from
+// was written to it
+func (sc *SlaveConnection) synced() {
+	close(sc.ready)
+}
+
+// writes the queued replication stream to the replica until it is
+// stopped, what is queued by then is still written
+func (sc *SlaveConnection) writeOutput() {
+	defer close(sc.stopped)
+	select {
+	case <-sc.ready:
+	case <-sc.stop:
+		return
+	}
+	for {
+		stopping := false
+		select {
+		case <-sc.outReady:
+		case <-sc.stop:
+			stopping = true
+		}
+		sc.outLock.Lock()
+		out := sc.out
+		sc.out = nil
+		sc.outLock.Unlock()
+		if len(out) > 0 {
+			if _, err := sc.write(out); err != nil {
+				fmt.Printf("couldn't write to replica %d: %s\n", sc.id, err)
+				sc.broken.Store(true)
+				return
+			}
+			sc.pending.Add(-int64(len(out)))
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// stops the writer goroutine once it wrote what is queued
+func (sc *SlaveConnection) stopOutput() {
+	sc.stopOnce.Do(func() {
+		close(sc.stop)
+	})
+}
@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutputBufferLimit(t *testing.T) {
+	sc := &SlaveConnection{limit: outputBufferLimit{hard: 100, soft: 50, softFor: 50 * time.Millisecond}}
+	if err := sc.checkOutputLimit(101); err == nil {
+		t.Fatal("the replica past the hard limit should be dropped")
+	}
+	// past the soft limit for less than softFor
+	if err := sc.checkOutputLimit(60); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := sc.checkOutputLimit(60); err == nil {
+		t.Fatal("the replica past the soft limit for longer than softFor should be dropped")
+	}
+	// going back under the soft limit resets the timer
+	if err := sc.checkOutputLimit(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.checkOutputLimit(60); err != nil {
+		t.Fatal(err)
+	}
+
+	unlimited := &SlaveConnection{}
+	if err := unlimited.checkOutputLimit(1 << 30); err != nil {
+		t.Fatalf("got %v, zero limits are disabled", err)
+	}
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commands sent to the replicas on behalf of the command being executed
+type propagation struct {
+	cmds [][]string
+}
+
+// should be called from the executor
+//
+// runs the command and propagates its effects to the replicas
+//
+// write commands which changed the dataset are propagated as they are,
+// unless their handler propagated a deterministic form of the command
+// through alsoPropagate. Commands run by transactions and scripts are
+// gathered and propagated once the outermost command finishes, wrapped
+// in MULTI/EXEC when there are several of them so that replicas apply
+// them at once
+func (s *Server) call(c *Connection, msg Message) error {
+	outer := s.propagation
+	p := &propagation{}
+	s.propagation = p
+	dirty := s.store.dirty.Load()
+	err := s.execute(c, msg)
+	s.propagation = outer
+
+	if len(p.cmds) == 0 && s.store.dirty.Load() != dirty &&
+		isWriteCommand(strings.ToLower(msg.data[0]), msg.data) {
+		p.cmds = append(p.cmds, msg.data)
+	}
+	if outer != nil {
+		outer.cmds = append(outer.cmds, p.cmds...)
+		return err
+	}
+	s.propagateAll(p.cmds)
+	return err
+}
+
+// should be called from the executor
+//
+// propagates args in place of the command being executed, handlers of
+// non-deterministic commands use it so that replicas converge with the
+// master, e.g. relative expiration times become absolute ones
+func (s *Server) alsoPropagate(args ...string) {
+	if s.propagation == nil {
+		if err := s.propagateCommand(args...); err != nil {
+			fmt.Printf("error while propagating %s command: %s\n", args[0], err)
+		}
+		return
+	}
+	s.propagation.cmds = append(s.propagation.cmds, args)
+}
+
+// should be called from the executor
+//
+// replicas don't expire keys on their own, the master deletes expired
+// keys through a DEL so that replicas agree with it whatever their
+// clocks, the DEL goes out right away, ahead of the command which found
+// the key expired
+func (s *Server) propagateExpiration(key string) {
+	if err := s.propagateCommand("DEL", key); err != nil {
+		fmt.Printf("error while propagating the expiration of %s: %s\n", key, err)
+	}
+}
+
+// should be called from the executor
+func (s *Server) propagateAll(cmds [][]string) {
+	if len(cmds) == 0 || s.masterConfig == nil {
+		return
+	}
+	if len(cmds) > 1 {
+		cmds = append(append([][]string{{"MULTI"}}, cmds...), []string{"EXEC"})
+	}
+	for _, args := range cmds {
+		if err := s.propagateCommand(args...); err != nil {
+			fmt.Printf("error while propagating %s command: %s\n", args[0], err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/common"
+)
+
+// commands a RESP2 connection can run while it has subscriptions
+var subscriberModeCommands = map[string]unit{
+	"subscribe":    {},
+	"psubscribe":   {},
+	"ssubscribe":   {},
+	"unsubscribe":  {},
+	"punsubscribe": {},
+	"sunsubscribe": {},
+	"ping":         {},
+}
+
+type subscriptionKind int
+
+const (
+	channelSubscription subscriptionKind = iota
+	patternSubscription
+	shardChannelSubscription
+)
+
+// names used in the replies of the subscribe and unsubscribe commands
+var subscriptionReplyNames = map[subscriptionKind][2]string{
+	channelSubscription:      {"subscribe", "unsubscribe"},
+	patternSubscription:      {"psubscribe", "punsubscribe"},
+	shardChannelSubscription: {"ssubscribe", "sunsubscribe"},
+}
+
+// registry of channel, pattern and shard channel subscriptions
+//
+// has its own lock so that publishing does not depend on the executor
+type pubSub struct {
+	lock          sync.RWMutex
+	channels      map[string]map[*Connection]unit
+	patterns      map[string]map[*Connection]unit
+	shardChannels map[string]map[*Connection]unit
+}
+
+func newPubSub() *pubSub {
+	return &pubSub{
+		lock:          sync.RWMutex{},
+		channels:      make(map[string]map[*Connection]unit),
+		patterns:      make(map[string]map[*Connection]unit),
+		shardChannels: make(map[string]map[*Connection]unit),
+	}
+}
+
+func (ps *pubSub) registry(kind subscriptionKind) map[string]map[*Connection]unit {
+	switch kind {
+	case patternSubscription:
+		return ps.patterns
+	case shardChannelSubscription:
+		return ps.shardChannels
+	default:
+		return ps.channels
+	}
+}
+
+func (c *Connection) subscriptions(kind subscriptionKind) map[string]unit {
+	switch kind {
+	case patternSubscription:
+		return c.patterns
+	case shardChannelSubscription:
+		return c.shardChannels
+	default:
+		return c.channels
+	}
+}
+
+func (c *Connection) inSubscriberMode() bool {
+	return c.protocol < 3 &&
+		c.subscriptionCount(channelSubscription)+c.subscriptionCount(shardChannelSubscription) > 0
+}
+
+// number of subscriptions reported in subscribe and unsubscribe replies,
+// shard channels are counted separately from channels and patterns
+func (c *Connection) subscriptionCount(kind subscriptionKind) int {
+	if kind == shardChannelSubscription {
+		return len(c.shardChannels)
+	}
+	return len(c.channels) + len(c.patterns)
+}
+
+func subscriptionReply(c *Connection, kind, name string, count int) []byte {
+	w := c.pushWriter()
+	w.WritePushHeader(3)
+	w.WriteBulkString(kind)
+	w.WriteBulkString(name)
+	w.WriteInt(count)
+	return w.buf
+}
+
+// a message delivered to a subscriber, made of bulk strings
+func messagePush(c *Connection, elements ...string) []byte {
+	w := c.pushWriter()
+	w.WritePushHeader(len(elements))
+	for _, el := range elements {
+		w.WriteBulkString(el)
+	}
+	return w.buf
+}
+
+func (ps *pubSub) subscribe(c *Connection, kind subscriptionKind, names []string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	registry, subscribed := ps.registry(kind), c.subscriptions(kind)
+	for _, name := range names {
+		if _, ok := subscribed[name]; !ok {
+			subscribed[name] = unit{}
+			if registry[name] == nil {
+				registry[name] = make(map[*Connection]unit)
+			}
+			registry[name][c] = unit{}
+		}
+		c.Push(subscriptionReply(c, subscriptionReplyNames[kind][0], name, c.subscriptionCount(kind)))
+	}
+}
+
+// unsubscribes from the given names, or from every subscription
+// of the kind if none given
+func (ps *pubSub) unsubscribe(c *Connection, kind subscriptionKind, names []string, notify bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	registry, subscribed := ps.registry(kind), c.subscriptions(kind)
+	replyName := subscriptionReplyNames[kind][1]
+	if len(names) == 0 {
+		for name := range subscribed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 && notify {
+			w := c.pushWriter()
+			w.WritePushHeader(3)
+			w.WriteBulkString(replyName)
+			w.WriteNull()
+			w.WriteInt(c.subscriptionCount(kind))
+			c.Push(w.buf)
+		}
+	}
+	for _, name := range names {
+		delete(subscribed, name)
+		if subs, ok := registry[name]; ok {
+			delete(subs, c)
+			if len(subs) == 0 {
+				delete(registry, name)
+			}
+		}
+		if notify {
+			c.Push(subscriptionReply(c, replyName, name, c.subscriptionCount(kind)))
+		}
+	}
+}
+
+// removes every subscription of a disconnecting client
+func (ps *pubSub) removeConnection(c *Connection) {
+	ps.unsubscribe(c, channelSubscription, nil, false)
+	ps.unsubscribe(c, patternSubscription, nil, false)
+	ps.unsubscribe(c, shardChannelSubscription, nil, false)
+}
+
+// queues the message to every subscriber and returns the number of
+// clients that received it
+func (ps *pubSub) publish(channel, message string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	receivers := 0
+	for c := range ps.channels[channel] {
+		c.Push(messagePush(c, "message", channel, message))
+		receivers++
+	}
+	for pattern, subs := range ps.patterns {
+		if !common.GlobMatch(pattern, channel) {
+			continue
+		}
+		for c := range subs {
+			c.Push(messagePush(c, "pmessage", pattern, channel, message))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// queues the message to every subscriber of the shard channel and
+// returns the number of clients that received it
+func (ps *pubSub) spublish(channel, message string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	for c := range ps.shardChannels[channel] {
+		c.Push(messagePush(c, "smessage", channel, message))
+	}
+	return len(ps.shardChannels[channel])
+}
+
+// returns the active channels of the kind matching the pattern,
+// every channel if empty
+func (ps *pubSub) activeChannels(kind subscriptionKind, pattern string) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	channels := []string{}
+	for ch := range ps.registry(kind) {
+		if pattern == "" || common.GlobMatch(pattern, ch) {
+			channels = append(channels, ch)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (ps *pubSub) subscriberCount(kind subscriptionKind, channel string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(ps.registry(kind)[channel])
+}
+
+func (ps *pubSub) isSubscribed(c *Connection, channel string) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	_, ok := ps.channels[channel][c]
+	return ok
+}
+
+func (ps *pubSub) hasSubscriptions(c *Connection) bool {
+	sub, psub, ssub := ps.counts(c)
+	return sub+psub+ssub > 0
+}
+
+// number of channels, patterns and shard channels the client is subscribed to
+func (ps *pubSub) counts(c *Connection) (int, int, int) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(c.channels), len(c.patterns), len(c.shardChannels)
+}
+
+func (ps *pubSub) patternCount() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(ps.patterns)
+}
+
+func (s *Server) processSubscribeRequest(c *Connection, msg Message, kind subscriptionKind) error {
+	if len(msg.data) < 2 {
+		return fmt.Errorf("incorrect number of arguments for the %s command", strings.ToLower(msg.data[0]))
+	}
+	s.pubsub.subscribe(c, kind, msg.data[1:])
+	return nil
+}
+
+func (s *Server) processUnsubscribeRequest(c *Connection, msg Message, kind subscriptionKind) error {
+	s.pubsub.unsubscribe(c, kind, msg.data[1:], true)
+	return nil
+}
+
+func (s *Server) processPublishRequest(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the publish command")
+	}
+	receivers := s.pubsub.publish(msg.data[1], msg.data[2])
+	s.alsoPropagate(msg.data...)
+	c.Reply().WriteInt(receivers)
+	return nil
+}
+
+// shard channels belong to the hash slot of their name, this node
+// serves every slot so the message is delivered locally and
+// propagated to the replicas of the shard
+func (s *Server) processSpublishRequest(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the spublish command")
+	}
+	receivers := s.pubsub.spublish(msg.data[1], msg.data[2])
+	s.alsoPropagate(msg.data...)
+	c.Reply().WriteInt(receivers)
+	return nil
+}
+
+func (s *Server) processPubSubRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the pubsub command")
+	}
+
+	switch strings.ToLower(msg.data[1]) {
+	case "channels":
+		return s.processPubSubChannels(c, msg, channelSubscription)
+	case "shardchannels":
+		return s.processPubSubChannels(c, msg, shardChannelSubscription)
+	case "numsub":
+		return s.processPubSubNumSub(c, msg, channelSubscription)
+	case "shardnumsub":
+		return s.processPubSubNumSub(c, msg, shardChannelSubscription)
+	case "numpat":
+		c.Reply().WriteInt(s.pubsub.patternCount())
+		return nil
+	default:
+		return fmt.Errorf("unknown pubsub subcommand %s", msg.data[1])
+	}
+}
+
+func (s *Server) processPubSubChannels(c *Connection, msg Message, kind subscriptionKind) error {
+	pattern := ""
+	if len(msg.data) > 2 {
+		pattern = msg.data[2]
+	}
+	c.Reply().WriteBulkStrings(s.pubsub.activeChannels(kind, pattern))
+	return nil
+}
+
+func (s *Server) processPubSubNumSub(c *Connection, msg Message, kind subscriptionKind) error {
+	w := c.Reply()
+	w.WriteMapHeader(len(msg.data) - 2)
+	for _, ch := range msg.data[2:] {
+		w.WriteBulkString(ch)
+		w.WriteInt(s.pubsub.subscriberCount(kind, ch))
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	rdbVersion = 11
+
+	rdbOpcodeFunction2    = 0xF5
+	rdbOpcodeIdle         = 0xF8
+	rdbOpcodeFreq         = 0xF9
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+
+	rdbTypeString = 0
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+
+	// streamed rdb files are handed to the destination in chunks of
+	// about this size
+	rdbChunkSize = 64 * 1024
+)
+
+var crc64Table = func() [256]uint64 {
+	// reflected form of the crc-64-jones polynomial used by redis
+	const poly = 0x95ac9329ac4bc9b5
+	var t [256]uint64
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// a single key of the dataset in an rdb file
+type rdbEntry struct {
+	key      string
+	val      string
+	expireAt time.Time
+}
+
+// contents of an rdb file which this server understands
+type rdbSnapshot struct {
+	functions []string
+	entries   []rdbEntry
+	// replication stream the dataset corresponds to, empty if unknown
+	replID     string
+	replOffset int
+}
+
+type rdbWriter struct {
+	buf bytes.Buffer
+	// receives the buffered bytes as they accumulate, nil keeps
+	// everything in buf
+	dst io.Writer
+	crc uint64
+	err error
+}
+
+// hands the buffered bytes to dst, unless fewer than a chunk are
+// buffered and force is not set
+func (w *rdbWriter) flush(force bool) {
+	if w.dst == nil || w.err != nil || (!force && w.buf.Len() < rdbChunkSize) {
+		return
+	}
+	w.crc = crc64(w.crc, w.buf.Bytes())
+	_, w.err = w.dst.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.buf.WriteByte(b)
+}
+
+func (w *rdbWriter) writeLength(n int) {
+	switch {
+	case n < 1<<6:
+		w.buf.WriteByte(byte(n))
+	case n < 1<<14:
+		w.buf.WriteByte(byte(n>>8) | 0x40)
+		w.buf.WriteByte(byte(n))
+	default:
+		w.buf.WriteByte(0x80)
+		_ = binary.Write(&w.buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeLength(len(s))
+	w.buf.WriteString(s)
+}
+
+func (w *rdbWriter) writeFunctions(libraries []string) {
+	for _, code := range libraries {
+		w.writeByte(rdbOpcodeFunction2)
+		w.writeString(code)
+	}
+}
+
+// serializes the snapshot into the rdb file format, checksum included
+func encodeRDB(snapshot rdbSnapshot) []byte {
+	var buf bytes.Buffer
+	_ = writeRDB(&buf, snapshot)
+	return buf.Bytes()
+}
+
+// streams the snapshot in the rdb file format to dst, checksum included
+func writeRDB(dst io.Writer, snapshot rdbSnapshot) error {
+	w := &rdbWriter{dst: dst}
+	w.buf.WriteString(fmt.Sprintf("REDIS%04d", rdbVersion))
+	w.writeByte(rdbOpcodeAux)
+	w.writeString("redis-ver")
+	w.writeString("7.2.0")
+	w.writeByte(rdbOpcodeAux)
+	w.writeString("redis-bits")
+	w.writeString("64")
+	if snapshot.replID != "" {
+		w.writeByte(rdbOpcodeAux)
+		w.writeString("repl-id")
+		w.writeString(snapshot.replID)
+		w.writeByte(rdbOpcodeAux)
+		w.writeString("repl-offset")
+		w.writeString(strconv.Itoa(snapshot.replOffset))
+	}
+	w.writeFunctions(snapshot.functions)
+
+	if len(snapshot.entries) > 0 {
+		w.writeByte(rdbOpcodeSelectDB)
+		w.writeLength(0)
+		for _, e := range snapshot.entries {
+			if !e.expireAt.IsZero() {
+				w.writeByte(rdbOpcodeExpireTimeMs)
+				_ = binary.Write(&w.buf, binary.LittleEndian, uint64(e.expireAt.UnixMilli()))
+			}
+			w.writeByte(rdbTypeString)
+			w.writeString(e.key)
+			w.writeString(e.val)
+			w.flush(false)
+		}
+	}
+
+	w.writeByte(rdbOpcodeEOF)
+	w.flush(true)
+	_ = binary.Write(&w.buf, binary.LittleEndian, w.crc)
+	w.flush(true)
+	return w.err
+}
+
+type rdbReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	return r.r.ReadByte()
+}
+
+// returns the length, or the special encoding type if encoded is true
+func (r *rdbReader) readLength() (n int, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return int(b & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return int(b&0x3F)<<8 | int(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			var n uint32
+			err = binary.Read(r.r, binary.BigEndian, &n)
+			return int(n), false, err
+		case 0x81:
+			var n uint64
+			if err = binary.Read(r.r, binary.BigEndian, &n); err != nil {
+				return 0, false, err
+			}
+			if n > maxBulkLen {
+				return 0, false, fmt.Errorf("invalid length %d", n)
+			}
+			return int(n), false, nil
+		default:
+			return 0, false, fmt.Errorf("unknown length encoding %x", b)
+		}
+	default:
+		return int(b & 0x3F), true, nil
+	}
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+	if encoded {
+		switch n {
+		case rdbEncInt8:
+			var i int8
+			err = binary.Read(r.r, binary.LittleEndian, &i)
+			return strconv.Itoa(int(i)), err
+		case rdbEncInt16:
+			var i int16
+			err = binary.Read(r.r, binary.LittleEndian, &i)
+			return strconv.Itoa(int(i)), err
+		case rdbEncInt32:
+			var i int32
+			err = binary.Read(r.r, binary.LittleEndian, &i)
+			return strconv.Itoa(int(i)), err
+		default:
+			return "", fmt.Errorf("unsupported string encoding %d", n)
+		}
+	}
+	if n > maxBulkLen {
+		return "", fmt.Errorf("invalid string length %d", n)
+	}
+	// the whole input is at hand for payloads, a length past its end
+	// is rejected before allocating
+	if in, ok := r.r.(interface{ Len() int }); ok && n > in.Len() {
+		return "", fmt.Errorf("string length %d exceeds the input: %w", n, io.ErrUnexpectedEOF)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r.r, buf)
+	return string(buf), err
+}
+
+// parses an rdb file, only string keys are supported
+func decodeRDB(data []byte) (rdbSnapshot, error) {
+	var entries []rdbEntry
+	snapshot, err := readRDB(bytes.NewReader(data), func(e rdbEntry) {
+		entries = append(entries, e)
+	})
+	snapshot.entries = entries
+	return snapshot, err
+}
+
+// parses an rdb file as it is read from src, every key is handed to load
+// instead of being kept in the returned snapshot
+//
+// reading stops after the EOF opcode, the checksum is left unread when
+// src is a bufio.Reader or another io.ByteReader
+func readRDB(src io.Reader, load func(rdbEntry)) (rdbSnapshot, error) {
+	var snapshot rdbSnapshot
+	br, ok := src.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		br = bufio.NewReader(src)
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:5]) != "REDIS" {
+		return snapshot, errors.New("rdb file should start with REDIS")
+	}
+	r := &rdbReader{r: br}
+
+	var expireAt time.Time
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return snapshot, fmt.Errorf("unexpected end of rdb file: %w", err)
+		}
+		switch opcode {
+		case rdbOpcodeEOF:
+			return snapshot, nil
+		case rdbOpcodeAux:
+			key, err := r.readString()
+			if err != nil {
+				return snapshot, err
+			}
+			val, err := r.readString()
+			if err != nil {
+				return snapshot, err
+			}
+			switch key {
+			case "repl-id":
+				snapshot.replID = val
+			case "repl-offset":
+				if snapshot.replOffset, err = strconv.Atoi(val); err != nil {
+					return snapshot, fmt.Errorf("invalid repl-offset %s", val)
+				}
+			}
+		case rdbOpcodeFunction2:
+			code, err := r.readString()
+			if err != nil {
+				return snapshot, err
+			}
+			snapshot.functions = append(snapshot.functions, code)
+		case rdbOpcodeSelectDB:
+			if _, _, err = r.readLength(); err != nil {
+				return snapshot, err
+			}
+		case rdbOpcodeResizeDB:
+			if _, _, err = r.readLength(); err != nil {
+				return snapshot, err
+			}
+			if _, _, err = r.readLength(); err != nil {
+				return snapshot, err
+			}
+		case rdbOpcodeExpireTimeMs:
+			var ms uint64
+			if err = binary.Read(r.r, binary.LittleEndian, &ms); err != nil {
+				return snapshot, err
+			}
+			expireAt = time.UnixMilli(int64(ms))
+		case rdbOpcodeExpireTime:
+			var sec uint32
+			if err = binary.Read(r.r, binary.LittleEndian, &sec); err != nil {
+				return snapshot, err
+			}
+			expireAt = time.Unix(int64(sec), 0)
+		case rdbOpcodeIdle:
+			if _, _, err = r.readLength(); err != nil {
+				return snapshot, err
+			}
+		case rdbOpcodeFreq:
+			if _, err = r.readByte(); err != nil {
+				return snapshot, err
+			}
+		case rdbTypeString:
+			key, err := r.readString()
+			if err != nil {
+				return snapshot, err
+			}
+			val, err := r.readString()
+			if err != nil {
+				return snapshot, err
+			}
+			load(rdbEntry{key: key, val: val, expireAt: expireAt})
+			expireAt = time.Time{}
+		default:
+			return snapshot, fmt.Errorf("unsupported rdb opcode %x", opcode)
+		}
+	}
+}
+
+// serializes function libraries into the FUNCTION DUMP payload format
+//
+// payload is the rdb encoding of the libraries followed by
+// the rdb version and a checksum
+func encodeFunctionsPayload(libraries []string) string {
+	w := &rdbWriter{}
+	w.writeFunctions(libraries)
+	_ = binary.Write(&w.buf, binary.LittleEndian, uint16(rdbVersion))
+	checksum := crc64(0, w.buf.Bytes())
+	_ = binary.Write(&w.buf, binary.LittleEndian, checksum)
+	return w.buf.String()
+}
+
+func decodeFunctionsPayload(payload string) ([]string, error) {
+	data := []byte(payload)
+	if len(data) < 10 {
+		return nil, errors.New("payload is too short")
+	}
+	footer := len(data) - 10
+	version := binary.LittleEndian.Uint16(data[footer : footer+2])
+	if version > rdbVersion {
+		return nil, errors.New("payload version is not supported")
+	}
+	checksum := binary.LittleEndian.Uint64(data[footer+2:])
+	if checksum != crc64(0, data[:footer+2]) {
+		return nil, errors.New("payload checksum mismatch")
+	}
+
+	br := bytes.NewReader(data[:footer])
+	r := &rdbReader{r: br}
+	libraries := []string{}
+	for br.Len() > 0 {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if opcode != rdbOpcodeFunction2 {
+			return nil, fmt.Errorf("given type is not a function: %x", opcode)
+		}
+		code, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, code)
+	}
+	return libraries, nil
+}
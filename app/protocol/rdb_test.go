@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestFunctionsPayload(t *testing.T) {
+	libraries := []string{
+		"#!lua name=first\nredis.register_function('one', function() return 1 end)",
+		"#!lua name=second\nredis.register_function('two', function() return 2 end)",
+	}
+	payload := encodeFunctionsPayload(libraries)
+	got, err := decodeFunctionsPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, libraries) {
+		t.Fatalf("got %q, want %q", got, libraries)
+	}
+
+	corrupted := []byte(payload)
+	corrupted[3] ^= 0xFF
+	if _, err := decodeFunctionsPayload(string(corrupted)); err == nil {
+		t.Fatal("a corrupted payload should be rejected")
+	}
+	if _, err := decodeFunctionsPayload(payload[:5]); err == nil {
+		t.Fatal("a truncated payload should be rejected")
+	}
+}
+
+// counts the writes rdb streaming hands to the destination
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	snapshot := rdbSnapshot{
+		functions: []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"},
+		entries: []rdbEntry{
+			{key: "short", val: "v"},
+			{key: "expiring", val: "soon", expireAt: expireAt},
+			{key: "large", val: strings.Repeat("x", 3*rdbChunkSize)},
+			{key: "binary", val: "a\r\n\x00b"},
+		},
+		replID:     strings.Repeat("a", 40),
+		replOffset: 1234,
+	}
+
+	var w countingWriter
+	if err := writeRDB(&w, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes < 3 {
+		t.Fatalf("got %d writes, the snapshot should be streamed in chunks", w.writes)
+	}
+	data := w.Bytes()
+	if !bytes.Equal(data, encodeRDB(snapshot)) {
+		t.Fatal("streamed and encoded rdb files differ")
+	}
+	footer := len(data) - 8
+	if got, want := binary.LittleEndian.Uint64(data[footer:]), crc64(0, data[:footer]); got != want {
+		t.Fatalf("got checksum %x, want %x", got, want)
+	}
+
+	got, err := decodeRDB(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, snapshot) {
+		t.Fatalf("got %+v, want %+v", got, snapshot)
+	}
+
+	// reading stops right before the checksum, which is left in the
+	// buffered reader given to readRDB
+	r := bufio.NewReader(bytes.NewReader(data))
+	if _, err := readRDB(r, func(rdbEntry) {}); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, data[footer:]) {
+		t.Fatalf("got %d bytes left after the rdb file, want the 8 bytes of the checksum", len(rest))
+	}
+}
+
+func TestRDBErrors(t *testing.T) {
+	if _, err := decodeRDB([]byte("NOTREDIS0011")); err == nil {
+		t.Fatal("a file without the REDIS header should be rejected")
+	}
+	data := encodeRDB(rdbSnapshot{entries: []rdbEntry{{key: "k", val: "v"}}})
+	if _, err := decodeRDB(data[:len(data)-12]); err == nil {
+		t.Fatal("a truncated file should be rejected")
+	}
+}
+
+// builds a FUNCTION DUMP payload around body, with a valid checksum
+func craftFunctionsPayload(body []byte) string {
+	w := &rdbWriter{}
+	w.buf.Write(body)
+	_ = binary.Write(&w.buf, binary.LittleEndian, uint16(rdbVersion))
+	_ = binary.Write(&w.buf, binary.LittleEndian, crc64(0, w.buf.Bytes()))
+	return w.buf.String()
+}
+
+func TestRDBCraftedLengths(t *testing.T) {
+	tests := []struct {
+		name   string
+		length []byte
+		// lengths within the cap can only be caught when the end of
+		// the input is known
+		capped bool
+	}{
+		{"64 bit length", []byte{0x81, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, true},
+		{"negative as int", []byte{0x81, 0x80, 0, 0, 0, 0, 0, 0, 0}, true},
+		{"32 bit length", []byte{0x80, 0xFF, 0xFF, 0xFF, 0xFF}, true},
+		{"past the end of the input", []byte{0x80, 0, 0, 0x10, 0}, false},
+	}
+	for _, tt := range tests {
+		body := append([]byte{rdbOpcodeFunction2}, tt.length...)
+		if _, err := decodeFunctionsPayload(craftFunctionsPayload(body)); err == nil {
+			t.Errorf("%s: the payload should be rejected", tt.name)
+		}
+
+		data := append([]byte("REDIS0011"), rdbTypeString)
+		data = append(data, tt.length...)
+		if _, err := decodeRDB(data); err == nil {
+			t.Errorf("%s: the rdb file should be rejected", tt.name)
+		}
+		if !tt.capped {
+			continue
+		}
+		_, err := readRDB(iotest.OneByteReader(bytes.NewReader(data)), func(rdbEntry) {})
+		if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: got %v, the streamed length should be rejected before reading", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/common"
+)
+
+const (
+	defaultReplTimeout    = 60 * time.Second
+	defaultReplPingPeriod = 10 * time.Second
+	// how often replicas acknowledge their offset to the master
+	replAckPeriod = time.Second
+
+	defaultMinReplicasMaxLag = 10 * time.Second
+
+	// delays between attempts to reconnect with the master
+	replRetryMin = 100 * time.Millisecond
+	replRetryMax = 10 * time.Second
+)
+
+// the replication link was replaced or dropped by REPLICAOF while it
+// was being set up
+var errReplicationStopped = errors.New("replication with this master was stopped")
+
+// state of a replica's link with its master
+type replState int
+
+const (
+	// dialing the master
+	replStateConnect replState = iota
+	// PING, AUTH and REPLCONF
+	replStateHandshake
+	// PSYNC and the transfer of the snapshot
+	replStateSync
+	// following the replication stream
+	replStateConnected
+	// waiting before reconnecting
+	replStateDisconnected
+)
+
+func (st replState) String() string {
+	switch st {
+	case replStateConnect:
+		return "connect"
+	case replStateHandshake:
+		return "handshake"
+	case replStateSync:
+		return "sync"
+	case replStateConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+func (s *Server) setReplState(sc *slaveConfig, state replState) {
+	s.exec.do(func() {
+		if sc.state == replStateConnected && state != replStateConnected {
+			sc.downSince = time.Now()
+		}
+		sc.state = state
+	})
+}
+
+// should be called from the executor
+//
+// connects with the master in the background
+func (s *Server) startReplication() {
+	sc := s.slaveConfig
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.cancel = cancel
+	sc.downSince = time.Now()
+	if !s.trackHandler() {
+		cancel()
+		return
+	}
+	go func() {
+		defer s.handlers.Done()
+		s.replicate(ctx, sc)
+	}()
+}
+
+// keeps the link with the master up until ctx is cancelled, reconnecting
+// with an exponential backoff when the handshake fails or the link drops
+func (s *Server) replicate(ctx context.Context, sc *slaveConfig) {
+	retry := replRetryMin
+	for {
+		conn, err := s.handshakeMaster(ctx, sc)
+		if err == nil {
+			retry = replRetryMin
+			conn.readTimeout = s.replTimeout
+			s.exec.do(func() {
+				if s.slaveConfig != sc {
+					err = errReplicationStopped
+					return
+				}
+				sc.conn = conn
+				sc.state = replStateConnected
+			})
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			fmt.Printf("connected with master %s\n", sc.addr)
+			stop := context.AfterFunc(ctx, func() {
+				conn.Close()
+			})
+			acking := make(chan unit)
+			go s.ackMaster(conn, acking)
+			s.handleClient(conn)
+			close(acking)
+			stop()
+			fmt.Printf("lost connection with master %s\n", sc.addr)
+		} else {
+			fmt.Printf("handshake with master failed, %s\n", err)
+		}
+
+		s.exec.do(func() {
+			sc.conn = nil
+		})
+		s.setReplState(sc, replStateDisconnected)
+		select {
+		case <-ctx.Done():
+			return
+		// the link isn't cancelled if shutting down timed out
+		case <-s.stopping:
+			return
+		case <-time.After(retry):
+		}
+		retry *= 2
+		if retry > replRetryMax {
+			retry = replRetryMax
+		}
+	}
+}
+
+// sends REPLCONF ACK with the replication offset every second until done
+// is closed, which tells the master how far behind this replica is
+func (s *Server) ackMaster(conn *Connection, done <-chan unit) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		offset, current := 0, false
+		s.exec.do(func() {
+			if s.slaveConfig != nil && s.slaveConfig.conn == conn {
+				offset, current = s.slaveConfig.offset, true
+			}
+		})
+		if !current {
+			continue
+		}
+		if _, err := conn.ReplyGetAck(offset); err != nil {
+			fmt.Printf("couldn't acknowledge offset to master: %s\n", err)
+			return
+		}
+	}
+}
+
+// pings the replicas every repl-ping-replica-period until shutdown
+func (s *Server) pingReplicas() {
+	ticker := time.NewTicker(s.replPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+			s.exec.do(func() {
+				if s.masterConfig != nil && len(s.replicas) > 0 {
+					s.propagateCommand("PING")
+				}
+			})
+		}
+	}
+}
+
+// should be called from the executor
+//
+// writes the fields of INFO replication describing the link with the master
+func (s *Server) replicaInfo(sb *strings.Builder) {
+	sc := s.slaveConfig
+	host, port, _ := net.SplitHostPort(sc.addr)
+	sb.WriteString(fmt.Sprintf("master_host:%s\n", host))
+	sb.WriteString(fmt.Sprintf("master_port:%s\n", port))
+	if sc.state == replStateConnected {
+		sb.WriteString("master_link_status:up\n")
+	} else {
+		sb.WriteString("master_link_status:down\n")
+	}
+	lastIO := -1
+	if sc.conn != nil {
+		lastIO = int(time.Since(time.Unix(0, sc.conn.lastRead.Load())).Seconds())
+	}
+	sb.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\n", lastIO))
+	syncing := 0
+	if sc.state == replStateSync {
+		syncing = 1
+	}
+	sb.WriteString(fmt.Sprintf("master_sync_in_progress:%d\n", syncing))
+	sb.WriteString(fmt.Sprintf("slave_repl_offset:%d\n", sc.offset))
+	readOnly := 0
+	if s.replicaReadOnly {
+		readOnly = 1
+	}
+	sb.WriteString(fmt.Sprintf("slave_read_only:%d\n", readOnly))
+	if sc.state != replStateConnected {
+		sb.WriteString(fmt.Sprintf("master_link_down_since_seconds:%d\n", int(time.Since(sc.downSince).Seconds())))
+	}
+	sb.WriteString(fmt.Sprintf("master_replid:%s\n", sc.replID))
+	sb.WriteString(fmt.Sprintf("master_repl_offset:%d\n", sc.offset))
+}
+
+// should be called from the executor
+//
+// writes the fields of INFO replication describing the replicas, the lag
+// is the number of seconds since a replica last acknowledged its offset
+func (s *Server) replicasInfo(sb *strings.Builder) {
+	for i, sc := range s.replicas {
+		host, _, _ := net.SplitHostPort(sc.conn.RemoteAddr().String())
+		lag := int(time.Since(time.Unix(0, sc.lastAck.Load())).Seconds())
+		sb.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d,output_buffer=%d\n",
+			i, host, sc.replicaPort, sc.offset.Load(), lag, sc.pending.Load()))
+	}
+}
+
+// should be called from the executor
+//
+// returns the number of replicas which acknowledged their offset within
+// min-replicas-max-lag
+func (s *Server) goodReplicas() int {
+	good := 0
+	for _, sc := range s.replicas {
+		if time.Since(time.Unix(0, sc.lastAck.Load())) <= s.minReplicasMaxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+//
+// a master turning into a replica tries to continue its own history with
+// the new master, which succeeds if that master was one of its replicas,
+// and resyncs from scratch otherwise
+func (s *Server) processReplicaOfRequest(c *Connection, msg Message) error {
+	if len(msg.data) != 3 {
+		return errors.New("incorrect number of arguments for the replicaof command")
+	}
+	if strings.ToLower(msg.data[1]) == "no" && strings.ToLower(msg.data[2]) == "one" {
+		if s.slaveConfig != nil {
+			s.promoteToMaster()
+		}
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	}
+	port, err := strconv.Atoi(msg.data[2])
+	if err != nil || port <= 0 || port > 65535 {
+		c.Reply().WriteError("ERR Invalid master port")
+		return nil
+	}
+	addr := net.JoinHostPort(msg.data[1], msg.data[2])
+	if s.slaveConfig != nil && s.slaveConfig.addr == addr {
+		c.Reply().WriteSimpleString("OK Already connected to specified master")
+		return nil
+	}
+
+	sc := &slaveConfig{addr: addr}
+	if s.slaveConfig != nil {
+		prev := s.slaveConfig
+		prev.cancel()
+		sc.replID, sc.offset, sc.backlog = prev.replID, prev.offset, prev.backlog
+		sc.replID2, sc.secondOffset = prev.replID2, prev.secondOffset
+	} else {
+		mc := s.masterConfig
+		// replicas can't follow this server until it is in sync with the
+		// new master, they reconnect as its sub-replicas
+		s.dropReplicas()
+		sc.replID, sc.offset, sc.backlog = mc.id, mc.offset, s.replBacklog()
+		s.masterConfig = nil
+	}
+	fmt.Printf("replicating %s\n", addr)
+	s.slaveConfig = sc
+	s.store.keepExpired = true
+	s.startReplication()
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+// should be called from the executor
+//
+// stops replicating and starts a new history, the dataset is kept
+func (s *Server) promoteToMaster() {
+	sc := s.slaveConfig
+	sc.cancel()
+	s.slaveConfig = nil
+	backlog := sc.backlog
+	if backlog == nil {
+		backlog = newReplBacklog(s.replBacklogSize, sc.offset)
+	}
+	s.masterConfig = &masterConfig{
+		id:              common.RandomString(40),
+		replID2:         sc.replID,
+		secondOffset:    sc.offset,
+		offset:          sc.offset,
+		backlog:         backlog,
+		noReplicasSince: time.Now(),
+	}
+	// sub-replicas learn the new id when they reconnect and continue
+	// from the previous one
+	s.dropReplicas()
+	// the keys kept for the previous master are deleted, and the
+	// deletions go to the backlog for the sub-replicas
+	s.store.keepExpired = false
+	s.store.expireDue()
+	fmt.Printf("promoted to master, previous replication id %s\n", sc.replID)
+}
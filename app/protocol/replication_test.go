@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, opts ...ServerOptFunc) *Server {
+	t.Helper()
+	s, err := NewServer(append([]ServerOptFunc{WithoutTCP()}, opts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.exec.stop)
+	return s
+}
+
+// REPLICAOF NO ONE ran while the link with the master was being set up,
+// whatever the master sends must not touch the dataset
+func TestStaleSync(t *testing.T) {
+	for _, mode := range []string{disklessLoadDisabled, disklessLoadSwapDB} {
+		s := newTestServer(t, WithDisklessLoad(mode))
+		s.exec.do(func() {
+			s.store.Set("key", "promoted")
+		})
+		sc := &slaveConfig{addr: "127.0.0.1:6379", replID: strings.Repeat("a", 40), offset: 10}
+
+		rdb := encodeRDB(rdbSnapshot{entries: []rdbEntry{{key: "key", val: "stale"}}})
+		input := fmt.Sprintf("+FULLRESYNC %s 100\r\n$%d\r\n%s", strings.Repeat("b", 40), len(rdb), rdb)
+		if err := s.psyncWithMaster(sc, newTestConn(input)); !errors.Is(err, errReplicationStopped) {
+			t.Fatalf("%s: got %v, want the sync to be abandoned", mode, err)
+		}
+		var got string
+		s.exec.do(func() {
+			got, _ = s.store.Get("key")
+		})
+		if got != "promoted" {
+			t.Fatalf("%s: got %q, the stale snapshot replaced the dataset", mode, got)
+		}
+
+		input = fmt.Sprintf("+CONTINUE %s\r\n", strings.Repeat("c", 40))
+		if err := s.psyncWithMaster(sc, newTestConn(input)); !errors.Is(err, errReplicationStopped) {
+			t.Fatalf("%s: got %v, want the sync to be abandoned", mode, err)
+		}
+		if sc.replID != strings.Repeat("a", 40) || sc.offset != 10 {
+			t.Fatalf("%s: got %s %d, the stale link took the new history", mode, sc.replID, sc.offset)
+		}
+	}
+}
+
+// a replica keeps the keys which expired for its master to delete them,
+// once promoted it deletes them itself and feeds the DELs to its backlog
+func TestPromoteExpiresKeys(t *testing.T) {
+	s := newTestServer(t, WithMasterAs("127.0.0.1", 6379))
+	s.exec.do(func() {
+		s.slaveConfig.cancel = func() {}
+		s.store.SetWithTTL("key", "value", time.Millisecond)
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	var found, kept bool
+	s.exec.do(func() {
+		_, found = s.store.Get("key")
+		_, kept = s.store.m["key"]
+	})
+	if found || !kept {
+		t.Fatalf("got found %v kept %v, want the key kept but missed by reads", found, kept)
+	}
+
+	var stream []byte
+	s.exec.do(func() {
+		s.promoteToMaster()
+		_, kept = s.store.m["key"]
+		stream, _ = s.masterConfig.backlog.since(0)
+	})
+	if kept {
+		t.Fatal("the promoted replica kept the expired key")
+	}
+	if want := SerializeCommand("DEL", "key"); string(stream) != want {
+		t.Fatalf("got %q, want %q in the backlog", stream, want)
+	}
+}
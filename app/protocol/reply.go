@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// replies larger than this do not keep their buffer around
+const maxRetainedReplyBuffer = 64 * 1024
+
+// builds the reply of the current command straight into a buffer owned
+// by the connection, which is reused from one command to the next
+//
+// the reply is sent once the command returns, so that pushes queued by
+// other goroutines never end up in the middle of it
+type ReplyWriter struct {
+	c   *Connection
+	buf []byte
+}
+
+func (w *ReplyWriter) appendLength(prefix byte, n int) {
+	w.buf = append(w.buf, prefix)
+	w.buf = strconv.AppendInt(w.buf, int64(n), 10)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *ReplyWriter) WriteSimpleString(s string) {
+	w.buf = append(w.buf, '+')
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// simple errors cannot span multiple lines, line breaks are replaced
+// with spaces
+func (w *ReplyWriter) WriteError(s string) {
+	w.buf = append(w.buf, '-')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' {
+			w.buf = append(w.buf, ' ')
+		} else {
+			w.buf = append(w.buf, s[i])
+		}
+	}
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *ReplyWriter) WriteInt(i int) {
+	w.appendLength(':', i)
+}
+
+func (w *ReplyWriter) WriteBulk(b []byte) {
+	w.appendLength('$', len(b))
+	w.buf = append(w.buf, b...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *ReplyWriter) WriteBulkString(s string) {
+	w.appendLength('$', len(s))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *ReplyWriter) WriteNull() {
+	w.buf = append(w.buf, "$-1\r\n"...)
+}
+
+func (w *ReplyWriter) WriteArrayHeader(n int) {
+	w.appendLength('*', n)
+}
+
+// writes an array of bulk strings
+func (w *ReplyWriter) WriteBulkStrings(elements []string) {
+	w.WriteArrayHeader(len(elements))
+	for _, el := range elements {
+		w.WriteBulkString(el)
+	}
+}
+
+// header of a map of n pairs, a flat array of keys and values
+// for RESP2 connections
+func (w *ReplyWriter) WriteMapHeader(n int) {
+	if w.c.protocol >= 3 {
+		w.appendLength('%', n)
+		return
+	}
+	w.appendLength('*', 2*n)
+}
+
+// header of an out of band push of n elements, an array for RESP2
+// connections
+func (w *ReplyWriter) WritePushHeader(n int) {
+	if w.c.protocol >= 3 {
+		w.appendLength('>', n)
+		return
+	}
+	w.appendLength('*', n)
+}
+
+// writes already serialized RESP
+func (w *ReplyWriter) WriteRaw(p []byte) {
+	w.buf = append(w.buf, p...)
+}
+
+// writes an rdb file sent to a replica, a bulk string without the
+// trailing CRLF
+func (w *ReplyWriter) WriteRDB(rdb []byte) {
+	w.appendLength('$', len(rdb))
+	w.buf = append(w.buf, rdb...)
+}
+
+// writes the header of an rdb file streamed to a replica, which ends
+// with the given mark instead of being preceded by its length
+func (w *ReplyWriter) WriteRDBMarkHeader(mark string) {
+	w.buf = append(w.buf, "$EOF:"...)
+	w.buf = append(w.buf, mark...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// returns the reply writer of the current command
+func (c *Connection) Reply() *ReplyWriter {
+	return &c.reply
+}
+
+// returns a writer for a push to c, built apart from the reply of the
+// command c may be running, its bytes are then handed to c.Push
+func (c *Connection) pushWriter() *ReplyWriter {
+	return &ReplyWriter{c: c}
+}
+
+// sends the reply built so far, honouring CLIENT REPLY and the push queue
+func (c *Connection) flushReply() error {
+	w := &c.reply
+	if len(w.buf) == 0 {
+		return nil
+	}
+	defer func() {
+		if cap(w.buf) > maxRetainedReplyBuffer {
+			w.buf = nil
+		} else {
+			w.buf = w.buf[:0]
+		}
+	}()
+
+	if c.discardsReplies() {
+		return nil
+	}
+	if c.pushing.Load() {
+		c.Push(bytes.Clone(w.buf))
+		return nil
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.rw.Write(w.buf)
+	if err != nil || c.batching {
+		return err
+	}
+	return c.rw.Flush()
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestReplyWriter(t *testing.T) {
+	for _, proto := range []int{2, 3} {
+		c, buf := newRecorderConn()
+		c.protocol = proto
+		w := c.Reply()
+		w.WriteSimpleString("OK")
+		w.WriteError("ERR two\r\nlines")
+		w.WriteInt(-3)
+		w.WriteBulkString("a\r\nb")
+		w.WriteNull()
+		w.WriteMapHeader(1)
+		w.WriteBulkStrings([]string{"k", "v"})
+		if err := c.flushReply(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := "+OK\r\n-ERR two  lines\r\n:-3\r\n$4\r\na\r\nb\r\n$-1\r\n"
+		if proto == 3 {
+			want += "%1\r\n"
+		} else {
+			want += "*2\r\n"
+		}
+		want += "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"
+		if got := buf.String(); got != want {
+			t.Errorf("RESP%d: got %q, want %q", proto, got, want)
+		}
+		if len(w.buf) != 0 {
+			t.Errorf("RESP%d: the reply buffer should be emptied once flushed", proto)
+		}
+	}
+}
+
+func TestPushWriter(t *testing.T) {
+	for proto, want := range map[int]string{
+		2: "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+		3: ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+	} {
+		c, _ := newRecorderConn()
+		c.protocol = proto
+		// a push is built apart from the reply being written
+		c.Reply().WriteSimpleString("OK")
+		if got := string(messagePush(c, "message", "ch", "hi")); got != want {
+			t.Errorf("RESP%d: got %q, want %q", proto, got, want)
+		}
+		if got := string(c.Reply().buf); got != "+OK\r\n" {
+			t.Errorf("RESP%d: got reply %q, the push leaked into it", proto, got)
+		}
+	}
+}
+
+func TestReplyWriterRDB(t *testing.T) {
+	var w ReplyWriter
+	w.WriteSimpleString("FULLRESYNC id 0")
+	w.WriteRDB([]byte("REDIS0011"))
+	w.WriteRDBMarkHeader("mark")
+	// the rdb file isn't followed by a CRLF
+	if got, want := string(w.buf), "+FULLRESYNC id 0\r\n$9\r\nREDIS0011$EOF:mark\r\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP type markers
+const (
+	SimpleStringType = '+'
+	ErrorType        = '-'
+	IntegerType      = ':'
+	BulkStringType   = '$'
+	ArrayType        = '*'
+	MapType          = '%'
+	PushType         = '>'
+	SetType          = '~'
+	NullType         = '_'
+	BooleanType      = '#'
+	DoubleType       = ','
+)
+
+// a RESP2 or RESP3 value read from the network
+type Value struct {
+	Type byte
+	// contents of simple strings, errors, bulk strings and doubles
+	Str string
+	// integers, booleans are 0 or 1
+	Int int64
+	// null bulk strings, null arrays and RESP3 nulls
+	Null bool
+	// elements of arrays, sets and pushes, maps hold their keys and
+	// values one after another
+	Elems []Value
+}
+
+func (v Value) IsError() bool {
+	return v.Type == ErrorType
+}
+
+// reads a single value, nested values included
+func ReadValue(r *bufio.Reader) (Value, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Value{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return Value{}, errors.New("empty RESP value")
+	}
+
+	v := Value{Type: line[0]}
+	body := line[1:]
+	switch v.Type {
+	case SimpleStringType, ErrorType, DoubleType:
+		v.Str = body
+	case NullType:
+		v.Null = true
+	case BooleanType:
+		if body == "t" {
+			v.Int = 1
+		}
+	case IntegerType:
+		v.Int, err = strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid integer %s", body)
+		}
+	case BulkStringType:
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return v, fmt.Errorf("invalid bulk string length %s", body)
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return v, err
+		}
+		v.Str = string(buf[:n])
+	case ArrayType, MapType, PushType, SetType:
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return v, fmt.Errorf("invalid aggregate length %s", body)
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		if v.Type == MapType {
+			n *= 2
+		}
+		v.Elems = make([]Value, n)
+		for i := range v.Elems {
+			if v.Elems[i], err = ReadValue(r); err != nil {
+				return v, err
+			}
+		}
+	default:
+		return v, fmt.Errorf("unsupported RESP type %c", v.Type)
+	}
+	return v, nil
+}
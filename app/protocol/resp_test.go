@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Value
+	}{
+		{"+OK\r\n", Value{Type: SimpleStringType, Str: "OK"}},
+		{"-ERR boom\r\n", Value{Type: ErrorType, Str: "ERR boom"}},
+		{":-42\r\n", Value{Type: IntegerType, Int: -42}},
+		{"$5\r\na\r\nbc\r\n", Value{Type: BulkStringType, Str: "a\r\nbc"}},
+		{"$0\r\n\r\n", Value{Type: BulkStringType}},
+		{"$-1\r\n", Value{Type: BulkStringType, Null: true}},
+		{"*-1\r\n", Value{Type: ArrayType, Null: true}},
+		{"_\r\n", Value{Type: NullType, Null: true}},
+		{"#t\r\n", Value{Type: BooleanType, Int: 1}},
+		{"#f\r\n", Value{Type: BooleanType}},
+		{",1.5\r\n", Value{Type: DoubleType, Str: "1.5"}},
+		{"*2\r\n$3\r\nfoo\r\n*1\r\n:1\r\n", Value{Type: ArrayType, Elems: []Value{
+			{Type: BulkStringType, Str: "foo"},
+			{Type: ArrayType, Elems: []Value{{Type: IntegerType, Int: 1}}},
+		}}},
+		{"%1\r\n+key\r\n:2\r\n", Value{Type: MapType, Elems: []Value{
+			{Type: SimpleStringType, Str: "key"},
+			{Type: IntegerType, Int: 2},
+		}}},
+		{">2\r\n+message\r\n+hi\r\n", Value{Type: PushType, Elems: []Value{
+			{Type: SimpleStringType, Str: "message"},
+			{Type: SimpleStringType, Str: "hi"},
+		}}},
+	}
+	for _, tt := range tests {
+		got, err := ReadValue(bufio.NewReader(strings.NewReader(tt.input)))
+		if err != nil {
+			t.Errorf("%q: %s", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestReadValueErrors(t *testing.T) {
+	for _, input := range []string{"", "\r\n", "?x\r\n", ":abc\r\n", "$abc\r\n", "$5\r\nab\r\n", "*2\r\n:1\r\n"} {
+		if _, err := ReadValue(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("%q should fail", input)
+		}
+	}
+}
+
+func TestReadValueRoundTrip(t *testing.T) {
+	cmd := SerializeCommand("SET", "key", "multi\r\nline")
+	got, err := ReadValue(bufio.NewReader(strings.NewReader(cmd)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Elems) != 3 || got.Elems[2].Str != "multi\r\nline" {
+		t.Fatalf("got %+v", got)
+	}
+}
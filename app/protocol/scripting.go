@@ -0,0 +1,618 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultBusyScriptTimeout = 5 * time.Second
+
+// commands which cannot be run through redis.call from a script
+var scriptForbiddenCommands = map[string]unit{
+	"eval":         {},
+	"evalsha":      {},
+	"script":       {},
+	"psync":        {},
+	"replconf":     {},
+	"wait":         {},
+	"multi":        {},
+	"exec":         {},
+	"discard":      {},
+	"shutdown":     {},
+	"replicaof":    {},
+	"slaveof":      {},
+	"function":     {},
+	"fcall":        {},
+	"fcall_ro":     {},
+	"hello":        {},
+	"subscribe":    {},
+	"psubscribe":   {},
+	"unsubscribe":  {},
+	"punsubscribe": {},
+	"ssubscribe":   {},
+	"sunsubscribe": {},
+	"client":       {},
+	"auth":         {},
+	"acl":          {},
+}
+
+type scriptingEngine struct {
+	lock        sync.Mutex
+	scripts     map[string]string
+	busyTimeout time.Duration
+
+	running *runningScript
+}
+
+type runningScript struct {
+	name      string
+	command   []string
+	startedAt time.Time
+	cancel    context.CancelFunc
+	readOnly  bool
+	wrote     bool
+	killed    bool
+}
+
+func newScriptingEngine() *scriptingEngine {
+	return &scriptingEngine{
+		lock:        sync.Mutex{},
+		scripts:     make(map[string]string),
+		busyTimeout: defaultBusyScriptTimeout,
+		running:     nil,
+	}
+}
+
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// caches the script body and returns its sha1 digest
+func (se *scriptingEngine) load(body string) string {
+	sha := scriptSHA(body)
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.scripts[sha] = body
+	return sha
+}
+
+func (se *scriptingEngine) get(sha string) (string, bool) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	body, ok := se.scripts[strings.ToLower(sha)]
+	return body, ok
+}
+
+func (se *scriptingEngine) exists(sha string) bool {
+	_, ok := se.get(sha)
+	return ok
+}
+
+func (se *scriptingEngine) flush() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.scripts = make(map[string]string)
+}
+
+// a script is busy when it has been running longer than the busy timeout
+func (se *scriptingEngine) isBusy() bool {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	return se.running != nil &&
+		time.Since(se.running.startedAt) > se.busyTimeout
+}
+
+// runs fn if a script is busy, the executor can't move on to the next
+// command until fn returns even if the script finishes meanwhile
+//
+// returns false without running fn if no script is busy
+func (se *scriptingEngine) whileBusy(fn func()) bool {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.running == nil || time.Since(se.running.startedAt) <= se.busyTimeout {
+		return false
+	}
+	fn()
+	return true
+}
+
+func (se *scriptingEngine) start(rs *runningScript) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	rs.startedAt = time.Now()
+	se.running = rs
+}
+
+// returns a copy of the running script, nil if there is none
+func (se *scriptingEngine) current() *runningScript {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.running == nil {
+		return nil
+	}
+	rs := *se.running
+	return &rs
+}
+
+func (se *scriptingEngine) finish() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.running = nil
+}
+
+func (se *scriptingEngine) wasKilled(rs *runningScript) bool {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	return rs.killed
+}
+
+// returns false if the running script is not allowed to write
+func (se *scriptingEngine) markWrite() bool {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.running == nil {
+		return true
+	}
+	if se.running.readOnly {
+		return false
+	}
+	se.running.wrote = true
+	return true
+}
+
+// returns the error reply SCRIPT KILL should answer with, empty if the
+// running script got killed
+func (se *scriptingEngine) kill() string {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.running == nil {
+		return "NOTBUSY No scripts in execution right now."
+	}
+	if se.running.wrote {
+		return "UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."
+	}
+	se.running.killed = true
+	se.running.cancel()
+	return ""
+}
+
+// stops the running script even if it already wrote, used when the
+// server shuts down
+func (se *scriptingEngine) abort() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.running != nil {
+		se.running.killed = true
+		se.running.cancel()
+	}
+}
+
+// served outside of the executor while a script is busy, the client is
+// authorized as usual while the script holds the executor
+//
+// returns false if no script is busy anymore, the command is then left
+// for the executor
+func (s *Server) processBusyRequest(c *Connection, msg Message) (bool, error) {
+	var reply string
+	var denial *aclDenial
+	if !s.scripting.whileBusy(func() { reply, denial = s.permissionError(c, msg) }) {
+		return false, nil
+	}
+	if reply != "" {
+		if denial != nil {
+			// the script may log denials of its own, the ACL log is only
+			// written from the executor once the script returns
+			go s.exec.do(func() {
+				s.logDenial(c, denial, "toplevel")
+			})
+		}
+		c.Reply().WriteError(reply)
+		return true, nil
+	}
+	cmd := strings.ToLower(msg.data[0])
+	if (cmd == "script" || cmd == "function") && len(msg.data) == 2 {
+		switch strings.ToLower(msg.data[1]) {
+		case "kill":
+			return true, s.processScriptKill(c)
+		case "stats":
+			if cmd == "function" {
+				return true, s.processFunctionStats(c)
+			}
+		}
+	}
+	// only users allowed to run SHUTDOWN get here, logging in is not enough
+	if cmd == "shutdown" && len(msg.data) == 2 && strings.ToLower(msg.data[1]) == "nosave" {
+		s.scripting.abort()
+		s.shutdownInBackground()
+		return true, nil
+	}
+	c.Reply().WriteError(
+		"BUSY Redis is busy running a script. You can only call SCRIPT KILL, FUNCTION KILL or SHUTDOWN NOSAVE.")
+	return true, nil
+}
+
+func (s *Server) processEvalRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 3 {
+		return errors.New("incorrect number of arguments for the eval command")
+	}
+	return s.evalScript(c, msg, msg.data[1], msg.data[2:])
+}
+
+func (s *Server) processEvalShaRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 3 {
+		return errors.New("incorrect number of arguments for the evalsha command")
+	}
+	body, ok := s.scripting.get(msg.data[1])
+	if !ok {
+		c.Reply().WriteError("NOSCRIPT No matching script. Please use EVAL.")
+		return nil
+	}
+	return s.evalScript(c, msg, body, msg.data[2:])
+}
+
+func (s *Server) processScriptRequest(c *Connection, msg Message) error {
+	if len(msg.data) < 2 {
+		return errors.New("incorrect number of arguments for the script command")
+	}
+
+	switch strings.ToLower(msg.data[1]) {
+	case "load":
+		if len(msg.data) != 3 {
+			return errors.New("incorrect number of arguments for the script load command")
+		}
+		if err := compileScript(msg.data[2]); err != nil {
+			c.Reply().WriteError(fmt.Sprintf("ERR Error compiling script: %s", err))
+			return nil
+		}
+		sha := s.scripting.load(msg.data[2])
+		c.Reply().WriteBulkString(sha)
+		return nil
+	case "exists":
+		if len(msg.data) < 3 {
+			return errors.New("incorrect number of arguments for the script exists command")
+		}
+		w := c.Reply()
+		w.WriteArrayHeader(len(msg.data) - 2)
+		for _, sha := range msg.data[2:] {
+			if s.scripting.exists(sha) {
+				w.WriteInt(1)
+			} else {
+				w.WriteInt(0)
+			}
+		}
+		return nil
+	case "flush":
+		s.scripting.flush()
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	case "kill":
+		return s.processScriptKill(c)
+	default:
+		return fmt.Errorf("unknown script subcommand %s", msg.data[1])
+	}
+}
+
+func (s *Server) processScriptKill(c *Connection) error {
+	if reply := s.scripting.kill(); reply != "" {
+		c.Reply().WriteError(reply)
+		return nil
+	}
+	c.Reply().WriteSimpleString("OK")
+	return nil
+}
+
+// args are numkeys followed by the keys and the arguments of the script
+func (s *Server) evalScript(c *Connection, msg Message, body string, args []string) error {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		c.Reply().WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	if numKeys < 0 {
+		c.Reply().WriteError("ERR Number of keys can't be negative")
+		return nil
+	}
+	if numKeys > len(args)-1 {
+		c.Reply().WriteError("ERR Number of keys can't be greater than number of args")
+		return nil
+	}
+	keys, argv := args[1:1+numKeys], args[1+numKeys:]
+
+	if err := s.runScript(c.Reply(), body, keys, argv, msg.data); err != nil {
+		c.Reply().WriteError(err.Error())
+	}
+	return nil
+}
+
+func compileScript(body string) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	_, err := L.LoadString(body)
+	return err
+}
+
+// should be called from the executor
+//
+// runs the script to completion and writes its reply to w, the body is
+// cached for EVALSHA once it compiled
+func (s *Server) runScript(w *ReplyWriter, body string, keys, argv, command []string) error {
+	L := newScriptState()
+	defer L.Close()
+
+	L.SetGlobal("KEYS", stringsToLuaTable(L, keys))
+	L.SetGlobal("ARGV", stringsToLuaTable(L, argv))
+	s.registerRedisModule(L)
+
+	fn, err := L.LoadString(body)
+	if err != nil {
+		return fmt.Errorf("ERR Error compiling script: %s", err)
+	}
+	s.scripting.load(body)
+
+	return s.callScriptFunction(w, L, fn, &runningScript{command: command})
+}
+
+// should be called from the executor
+//
+// calls fn with the given arguments, enforcing the busy timeout
+// and SCRIPT KILL semantics, the value it returns is written to w
+func (s *Server) callScriptFunction(w *ReplyWriter, L *lua.LState, fn *lua.LFunction, running *runningScript, args ...lua.LValue) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	running.cancel = cancel
+	s.scripting.start(running)
+	defer s.scripting.finish()
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		if s.scripting.wasKilled(running) {
+			return errors.New("ERR Script killed by user with SCRIPT KILL...")
+		}
+		return luaError(err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	writeLuaReply(w, ret)
+	return nil
+}
+
+// errors raised through redis.call are passed to the client as is,
+// everything else is reported as a script runtime error
+func luaError(err error) error {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if tb, ok := apiErr.Object.(*lua.LTable); ok {
+			if e, ok := tb.RawGetString("err").(lua.LString); ok {
+				return errors.New(string(e))
+			}
+		}
+		return fmt.Errorf("ERR Error running script: %s", apiErr.Object.String())
+	}
+	return fmt.Errorf("ERR Error running script: %s", err)
+}
+
+// returns a lua state with only the sandbox safe libraries loaded
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, unsafe := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+	return L
+}
+
+func (s *Server) registerRedisModule(L *lua.LState) *lua.LTable {
+	mod := L.NewTable()
+	L.SetFuncs(mod, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return s.luaRedisCall(L, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return s.luaRedisCall(L, false)
+		},
+		"error_reply": func(L *lua.LState) int {
+			tb := L.NewTable()
+			tb.RawSetString("err", lua.LString(L.CheckString(1)))
+			L.Push(tb)
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			tb := L.NewTable()
+			tb.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(tb)
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(scriptSHA(L.CheckString(1))))
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			fmt.Printf("script log [%d]: %s\n", L.CheckInt(1), L.CheckString(2))
+			return 0
+		},
+	})
+	mod.RawSetString("LOG_DEBUG", lua.LNumber(0))
+	mod.RawSetString("LOG_VERBOSE", lua.LNumber(1))
+	mod.RawSetString("LOG_NOTICE", lua.LNumber(2))
+	mod.RawSetString("LOG_WARNING", lua.LNumber(3))
+	L.SetGlobal("redis", mod)
+	return mod
+}
+
+// implements redis.call and redis.pcall
+//
+// redis.call raises errors, redis.pcall returns them as error tables
+func (s *Server) luaRedisCall(L *lua.LState, raise bool) int {
+	fail := func(reason string) int {
+		if raise {
+			tb := L.NewTable()
+			tb.RawSetString("err", lua.LString(reason))
+			L.Error(tb, 1)
+			return 0
+		}
+		tb := L.NewTable()
+		tb.RawSetString("err", lua.LString(reason))
+		L.Push(tb)
+		return 1
+	}
+
+	top := L.GetTop()
+	if top == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	args := make([]string, top)
+	for i := 1; i <= top; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(v)
+		case lua.LNumber:
+			args[i-1] = v.String()
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	cmd := strings.ToLower(args[0])
+	if _, ok := scriptForbiddenCommands[cmd]; ok {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	// scripts run with the permissions of the calling client
+	if caller := s.currentClient.Load(); caller != nil && !caller.slaveToMaster {
+		if denial := s.checkACL(caller, args, "lua"); denial != nil {
+			return fail(fmt.Sprintf("%s script", noPermError(caller.user, denial)))
+		}
+	}
+	if isWriteCommand(cmd, args) && !s.scripting.markWrite() {
+		return fail("ERR Write commands are not allowed from read-only scripts.")
+	}
+
+	rc, buf := newRecorderConn()
+	if err := s.call(rc, Message{data: args}); err != nil {
+		return fail(fmt.Sprintf("ERR %s", err))
+	}
+	if err := rc.flushReply(); err != nil {
+		return fail(fmt.Sprintf("ERR %s", err))
+	}
+	if buf.Len() == 0 {
+		return fail(fmt.Sprintf("ERR Unknown Redis command called from script: %s", args[0]))
+	}
+
+	ret, err := respToLua(L, bufio.NewReader(buf))
+	if err != nil {
+		return fail(fmt.Sprintf("ERR couldn't parse reply: %s", err))
+	}
+	if tb, ok := ret.(*lua.LTable); ok && raise {
+		if e, ok := tb.RawGetString("err").(lua.LString); ok {
+			return fail(string(e))
+		}
+	}
+	L.Push(ret)
+	return 1
+}
+
+func stringsToLuaTable(L *lua.LState, strs []string) *lua.LTable {
+	tb := L.CreateTable(len(strs), 0)
+	for _, str := range strs {
+		tb.Append(lua.LString(str))
+	}
+	return tb
+}
+
+// converts a single RESP reply into its lua representation
+func respToLua(L *lua.LState, r *bufio.Reader) (lua.LValue, error) {
+	v, err := ReadValue(r)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return valueToLua(L, v), nil
+}
+
+func valueToLua(L *lua.LState, v Value) lua.LValue {
+	switch v.Type {
+	case SimpleStringType:
+		tb := L.NewTable()
+		tb.RawSetString("ok", lua.LString(v.Str))
+		return tb
+	case ErrorType:
+		tb := L.NewTable()
+		tb.RawSetString("err", lua.LString(v.Str))
+		return tb
+	case IntegerType:
+		return lua.LNumber(v.Int)
+	default:
+		if v.Null {
+			return lua.LFalse
+		}
+		if v.Type == BulkStringType {
+			return lua.LString(v.Str)
+		}
+		tb := L.CreateTable(len(v.Elems), 0)
+		for _, el := range v.Elems {
+			tb.Append(valueToLua(L, el))
+		}
+		return tb
+	}
+}
+
+// converts a lua value returned from a script into a RESP reply
+func writeLuaReply(w *ReplyWriter, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		w.WriteBulkString(string(v))
+	case lua.LNumber:
+		w.WriteInt(int(v))
+	case lua.LBool:
+		if v {
+			w.WriteInt(1)
+		} else {
+			w.WriteNull()
+		}
+	case *lua.LTable:
+		if e, ok := v.RawGetString("err").(lua.LString); ok {
+			w.WriteError(string(e))
+			return
+		}
+		if s, ok := v.RawGetString("ok").(lua.LString); ok {
+			w.WriteSimpleString(string(s))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		w.WriteArrayHeader(n)
+		for i := 1; i <= n; i++ {
+			writeLuaReply(w, v.RawGetInt(i))
+		}
+	default:
+		w.WriteNull()
+	}
+}
@@ -2,12 +2,18 @@ package protocol
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/common"
 )
@@ -15,37 +21,157 @@ import (
 type Role string
 
 type Server struct {
-	store *Store
+	store     *Store
+	scripting *scriptingEngine
+	functions *functionRegistry
+	pubsub    *pubSub
+	clients   *clientRegistry
+	tracking  *trackingTable
+	pause     *clientPause
+	acl       *aclRegistry
+
+	// replicas attached to this server, replicas of a replica receive
+	// the stream of the master it follows
+	replicas []*SlaveConnection
+	// replicas waiting for a diskless transfer, nil if none
+	diskless *disklessTransfer
+
+	// client whose command is being executed, nil for writes
+	// done by the server itself such as expirations
+	currentClient atomic.Pointer[Connection]
+	// commands propagated for the command being executed, nil
+	// outside of commands
+	propagation *propagation
+
+	// classes of keyspace events published to subscribers
+	keyspaceEvents int
 
 	addr string
+	// port 0 binds any free port, which is then given by Addr
 	port int
+	// no tcp listener is bound, clients connect through tls or the unix
+	// socket
+	tcpDisabled bool
+	// path of the unix socket listener, empty if disabled
+	unixSocket     string
+	unixSocketPerm os.FileMode
+
+	// tls listener and certificates, nil if tls is disabled
+	tls *tlsContext
+	// replicas connect to their master over tls
+	tlsReplication bool
+
+	// rdb file written by SHUTDOWN and loaded on start, empty if disabled
+	snapshotFile string
 
-	lock         sync.Mutex
+	replBacklogSize int
+	// 0 keeps the backlog forever
+	replBacklogTTL time.Duration
+	// a link with no traffic for this long is considered dead
+	replTimeout time.Duration
+	// how often masters ping their replicas, which keeps links with
+	// no writes from timing out
+	replPingPeriod time.Duration
+	// replicas falling further behind are dropped
+	replicaOutputLimit outputBufferLimit
+	// writes are refused when fewer replicas acknowledged their offset
+	// within minReplicasMaxLag, 0 never refuses writes
+	minReplicasToWrite int
+	minReplicasMaxLag  time.Duration
+	// replicas refuse writes from clients, only applying those of
+	// their master
+	replicaReadOnly bool
+	// full resyncs stream the snapshot straight to the replicas, which
+	// asked for it within disklessSyncDelay of each other
+	disklessSync      bool
+	disklessSyncDelay time.Duration
+	// how the snapshot received from the master is loaded
+	disklessLoad string
+
+	listeners   []net.Listener
+	tcpListener net.Listener
+	tlsListener net.Listener
+	// goroutines serving clients, drained on shutdown
+	handlers sync.WaitGroup
+	// guards closing stopping against registering new handlers
+	stopLock sync.Mutex
+	// closed once the shutdown starts
+	stopping chan unit
+	// closed once the server is shut down
+	done chan struct{}
+	// cancels the SHUTDOWN waiting for replicas, nil if there is none
+	abortShutdown context.CancelFunc
+
+	// credentials used to authenticate with the master
+	masterUser     string
+	masterPassword string
+
+	exec         *executor
 	masterConfig *masterConfig
 	slaveConfig  *slaveConfig
 }
 
 type slaveConfig struct {
-	addr   string
+	addr string
+
 	conn   *Connection
 	offset int
+	// replication id of the master, empty until the first full resync,
+	// together with offset it allows resuming with a partial resync
+	replID string
+	// previous replication id of the master, sub-replicas which followed
+	// it continue with a partial resync up to secondOffset
+	replID2      string
+	secondOffset int
+	// stream received from the master, kept for partial resyncs
+	// once this replica gets promoted
+	backlog *replBacklog
+
+	state replState
+	// when the link with the master went down
+	downSince time.Time
+	// stops the replication loop and closes the link
+	cancel context.CancelFunc
 }
 
 type masterConfig struct {
 	id string
+	// replication id of the master this server replicated before being
+	// promoted, replicas of that master continue with a partial resync
+	// up to secondOffset
+	replID2      string
+	secondOffset int
 
 	offset int
-	slaves []*SlaveConnection
+
+	// nil until the first replica attaches
+	backlog *replBacklog
+	// when the last replica went away, the backlog is freed
+	// after repl-backlog-ttl
+	noReplicasSince time.Time
 }
 
 type ServerOptFunc func(*Server)
 
+// time given to replicas to catch up and to clients to finish their
+// commands when shutting down
+const shutdownTimeout = 10 * time.Second
+
 func WithAddressAndPort(address string, port int) ServerOptFunc {
 	return func(rs *Server) {
 		rs.addr = address
 		rs.port = port
 	}
 }
+
+// disables the tcp listener, WithTLS or WithUnixSocket should give
+// another one
+func WithoutTCP() ServerOptFunc {
+	return func(rs *Server) {
+		rs.tcpDisabled = true
+	}
+}
+
 func WithMasterAs(address string, port int) ServerOptFunc {
 	return func(rs *Server) {
 		rs.masterConfig = nil
@@ -57,60 +183,379 @@ func WithMasterAs(address string, port int) ServerOptFunc {
 	}
 }
 
+// authenticates with the master as the user, the default user if empty
+func WithMasterAuth(user, password string) ServerOptFunc {
+	return func(rs *Server) {
+		rs.masterUser = user
+		rs.masterPassword = password
+	}
+}
+
+// loads the users from the acl file, ACL SAVE writes them back to it
+func WithACLFile(path string) ServerOptFunc {
+	return func(rs *Server) {
+		rs.acl.file = path
+	}
+}
+
+// serves clients on a unix socket created with the given permissions
+func WithUnixSocket(path string, perm os.FileMode) ServerOptFunc {
+	return func(rs *Server) {
+		rs.unixSocket = path
+		rs.unixSocketPerm = perm
+	}
+}
+
+// serves tls clients on the port, port 0 only loads the certificates
+// for replication links
+func WithTLS(port int, certFile, keyFile, caCertFile string, clientAuth tls.ClientAuthType) ServerOptFunc {
+	return func(rs *Server) {
+		rs.tls = newTLSContext(port, certFile, keyFile, caCertFile, clientAuth)
+	}
+}
+
+func WithTLSReplication(enabled bool) ServerOptFunc {
+	return func(rs *Server) {
+		rs.tlsReplication = enabled
+	}
+}
+
+// sets the size of the replication backlog and for how long it is kept
+// once no replica is connected
+func WithReplBacklog(size int, ttl time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.replBacklogSize = size
+		rs.replBacklogTTL = ttl
+	}
+}
+
+// sets after how long without traffic the link with the master is
+// considered dead, and how often masters ping their replicas
+func WithReplTimeout(timeout, pingPeriod time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.replTimeout = timeout
+		rs.replPingPeriod = pingPeriod
+	}
+}
+
+// sets client-output-buffer-limit for replicas, in bytes, 0 disables
+// a limit
+func WithReplicaOutputBufferLimit(hard, soft int, softFor time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.replicaOutputLimit = outputBufferLimit{hard: hard, soft: soft, softFor: softFor}
+	}
+}
+
+// refuses writes unless at least count replicas acknowledged their
+// offset within maxLag, a count of 0 never refuses writes
+func WithMinReplicas(count int, maxLag time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.minReplicasToWrite = count
+		rs.minReplicasMaxLag = maxLag
+	}
+}
+
+// sets whether replicas refuse writes from clients other than their
+// master
+func WithReplicaReadOnly(readOnly bool) ServerOptFunc {
+	return func(rs *Server) {
+		rs.replicaReadOnly = readOnly
+	}
+}
+
+// streams the snapshot to replicas on full resync instead of sending it
+// as one bulk string, waiting delay for more replicas to share the transfer
+func WithDisklessSync(enabled bool, delay time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.disklessSync = enabled
+		rs.disklessSyncDelay = delay
+	}
+}
+
+// sets how replicas load the snapshot received on full resync, either
+// disabled or swapdb
+func WithDisklessLoad(mode string) ServerOptFunc {
+	return func(rs *Server) {
+		rs.disklessLoad = mode
+	}
+}
+
+// the snapshot, keys and function libraries, is loaded on start and
+// saved by SHUTDOWN
+func WithSnapshotFile(path string) ServerOptFunc {
+	return func(rs *Server) {
+		rs.snapshotFile = path
+	}
+}
+
+func WithBusyScriptTimeout(timeout time.Duration) ServerOptFunc {
+	return func(rs *Server) {
+		rs.scripting.busyTimeout = timeout
+	}
+}
+
+func WithKeyspaceEvents(classes int) ServerOptFunc {
+	return func(rs *Server) {
+		rs.keyspaceEvents = classes
+	}
+}
+
 func NewServer(opts []ServerOptFunc) (*Server, error) {
 	repliID := common.RandomString(40)
 	repliOffset := 0
 	server := &Server{
-		store: NewStore(),
-		lock:  sync.Mutex{},
+		store:              NewStore(),
+		scripting:          newScriptingEngine(),
+		functions:          newFunctionRegistry(),
+		pubsub:             newPubSub(),
+		clients:            newClientRegistry(),
+		pause:              newClientPause(),
+		acl:                newACLRegistry(),
+		stopping:           make(chan unit),
+		replBacklogSize:    defaultReplBacklogSize,
+		replBacklogTTL:     defaultReplBacklogTTL,
+		replTimeout:        defaultReplTimeout,
+		replPingPeriod:     defaultReplPingPeriod,
+		replicaOutputLimit: defaultReplicaOutputLimit,
+		minReplicasMaxLag:  defaultMinReplicasMaxLag,
+		replicaReadOnly:    true,
+		disklessSyncDelay:  defaultDisklessSyncDelay,
+		disklessLoad:       disklessLoadDisabled,
+		done:               make(chan struct{}),
 		masterConfig: &masterConfig{
 			id:     repliID,
 			offset: repliOffset,
-			slaves: []*SlaveConnection{},
 		},
 		slaveConfig: nil,
 	}
 	for _, optFunc := range opts {
 		optFunc(server)
 	}
+	if server.replBacklogSize <= 0 {
+		return nil, errors.New("repl-backlog-size should be positive")
+	}
+	if l := server.replicaOutputLimit; l.hard < 0 || l.soft < 0 || l.softFor < 0 {
+		return nil, errors.New("client-output-buffer-limit should not be negative")
+	}
+	if server.minReplicasToWrite < 0 || server.minReplicasMaxLag < 0 {
+		return nil, errors.New("min-replicas-to-write and min-replicas-max-lag should not be negative")
+	}
+	if server.disklessSyncDelay < 0 {
+		return nil, errors.New("repl-diskless-sync-delay should not be negative")
+	}
+	if server.disklessLoad != disklessLoadDisabled && server.disklessLoad != disklessLoadSwapDB {
+		return nil, fmt.Errorf("unsupported repl-diskless-load %s", server.disklessLoad)
+	}
+	if server.replTimeout <= 0 || server.replPingPeriod <= 0 {
+		return nil, errors.New("repl-timeout and repl-ping-replica-period should be positive")
+	}
+	server.tracking = newTrackingTable(server.clients, server.pubsub)
+	if server.tls != nil {
+		if err := server.tls.reload(); err != nil {
+			return nil, fmt.Errorf("couldn't configure tls: %w", err)
+		}
+		if server.tls.port != 0 && server.tls.cert == nil {
+			return nil, errors.New("tls-port requires tls-cert-file and tls-key-file")
+		}
+	} else if server.tlsReplication {
+		return nil, errors.New("tls-replication requires tls to be configured")
+	}
+	if server.acl.file != "" {
+		if err := server.acl.load(); err != nil {
+			return nil, err
+		}
+	}
+	server.store.notify = server.onKeyspaceEvent
+	server.store.schedule = server.runExpiration
+	server.store.keepExpired = server.slaveConfig != nil
+	server.exec = newExecutor()
+
+	return server, nil
+}
+
+// binds the listeners, loads the snapshot and connects to the master,
+// clients are then served in the background
+//
+// the server shuts down once ctx is cancelled or Shutdown is called
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.listen(); err != nil {
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		s.exec.stop()
+		return err
+	}
+	if s.snapshotFile != "" {
+		if err := s.loadSnapshotFile(); err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			s.exec.stop()
+			return err
+		}
+	}
 
 	// slave server specific processes
-	if server.slaveConfig != nil {
-		err := server.handshakeMaster()
+	if s.slaveConfig != nil {
+		s.startReplication()
+	}
+	go s.pingReplicas()
+
+	for _, l := range s.listeners {
+		go s.serve(l)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("shutdown didn't complete gracefully: %s\n", err)
+			}
+		case <-s.stopping:
+		}
+	}()
+	return nil
+}
+
+// starts the server and blocks until it is shut down
+func (s *Server) Listen() error {
+	if err := s.Start(context.Background()); err != nil {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// closed once the server is shut down
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// address of the tcp listener, nil before Start or if tcp is disabled
+func (s *Server) Addr() net.Addr {
+	if s.tcpListener == nil {
+		return nil
+	}
+	return s.tcpListener.Addr()
+}
+
+// address of the tls listener, nil before Start or if tls is disabled
+func (s *Server) TLSAddr() net.Addr {
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+func (s *Server) listen() error {
+	if !s.tcpDisabled {
+		l, err := net.Listen("tcp", listenAddr(s.addr, s.port))
 		if err != nil {
-			fmt.Printf("handshake with master failed, %s", err)
+			return err
 		}
+		s.listeners = append(s.listeners, l)
+		s.tcpListener = l
+		// the port announced to the master is the one actually bound
+		s.port = l.Addr().(*net.TCPAddr).Port
 	}
+	if s.unixSocket != "" {
+		l, err := s.listenUnix()
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	if s.tls != nil && s.tls.port != 0 {
+		l, err := tls.Listen("tcp", listenAddr(s.addr, s.tls.port), s.tls.serverConfig())
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+		s.tlsListener = l
+		s.tls.port = l.Addr().(*net.TCPAddr).Port
+	}
+	if len(s.listeners) == 0 {
+		return errors.New("no listeners configured, set a port, tls-port or unixsocket")
+	}
+	return nil
+}
 
-	return server, nil
+func listenAddr(addr string, port int) string {
+	return net.JoinHostPort(addr, strconv.Itoa(port))
 }
 
-func (s *Server) Listen() error {
-	if s.slaveConfig != nil {
-		go s.handleClient(s.slaveConfig.conn)
+// a socket file left behind by a previous run is replaced, the socket
+// is removed again when the listener is closed
+func (s *Server) listenUnix() (net.Listener, error) {
+	if err := os.Remove(s.unixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
 	}
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.addr, s.port))
+	l, err := net.Listen("unix", s.unixSocket)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer l.Close()
+	if s.unixSocketPerm != 0 {
+		if err := os.Chmod(s.unixSocket, s.unixSocketPerm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// accepts clients until the listener is closed
+func (s *Server) serve(l net.Listener) {
 	for {
 		c, err := l.Accept()
-		conn := NewConn(c, false)
-
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("error accepting connection: ", err)
+			continue
 		}
-		go s.handleClient(conn)
+		if !s.trackHandler() {
+			c.Close()
+			return
+		}
+		go func() {
+			defer s.handlers.Done()
+			if err := handshakeTLS(c); err != nil {
+				fmt.Println("tls handshake failed: ", err)
+				c.Close()
+				return
+			}
+			s.handleClient(NewConn(c, false))
+		}()
 	}
 }
 
 func (s *Server) handleClient(conn *Connection) {
+	s.exec.do(func() {
+		conn.authenticated = s.acl.defaultUserNeedsNoAuth()
+	})
+	s.clients.add(conn)
 	for {
 		err := s.handleRequest(conn)
+		if errors.Is(err, errProtocol) {
+			// the stream can't be parsed past the malformed request
+			conn.Reply().WriteError(fmt.Sprintf("ERR %s", err))
+			if conn.flushReply() == nil {
+				conn.flush()
+			}
+		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			// the link with the master times out after repl-timeout,
+			// clients waiting for their next command are woken up
+			// with a read deadline on shutdown
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) ||
+				errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, errProtocol) || s.isStopping() {
 				conn.conn.Close()
+				s.clients.remove(conn)
+				s.pubsub.removeConnection(conn)
+				s.tracking.removeConnection(conn)
+				conn.closePushes()
 				fmt.Println("closing connection with client")
 				break
 			} else if errors.Is(err, ConnNotClientError) {
@@ -131,10 +576,94 @@ func (s *Server) handleRequest(c *Connection) error {
 		return err
 	}
 	fmt.Println("handling command: ", msg.data)
+	// a script running past its busy timeout still holds the executor,
+	// only a few commands are served until it finishes or gets killed,
+	// the replication stream waits for it so that no write is lost
+	if !c.slaveToMaster && s.scripting.isBusy() {
+		if busy, err := s.processBusyRequest(c, msg); busy {
+			if flushErr := c.flushReply(); flushErr != nil {
+				return flushErr
+			}
+			return err
+		}
+	}
+	// the replication stream is never paused
+	if !c.slaveToMaster {
+		s.pause.wait(isMayWriteCommand(strings.ToLower(msg.data[0]), msg.data))
+	}
 	// command handling
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	switch strings.ToLower(msg.data[0]) {
+	var blockedOn func() error
+	s.exec.do(func() {
+		// commands still arriving from a master replaced by REPLICAOF
+		// are dropped
+		if c.slaveToMaster && (s.slaveConfig == nil || s.slaveConfig.conn != c) {
+			return
+		}
+		s.beforeCommand(c, msg)
+		if s.authorize(c, msg) {
+			s.currentClient.Store(c)
+			err = s.call(c, msg)
+			s.currentClient.Store(nil)
+		} else if c.inMulti() {
+			// a denied command fails the whole transaction
+			c.multi.aborted = true
+		}
+		blockedOn, c.blockedOn = c.blockedOn, nil
+		if blockedOn == nil {
+			if flushErr := c.flushReply(); flushErr != nil && err == nil {
+				err = flushErr
+			}
+			s.afterCommand(c)
+		}
+		// replicas should update their offset for all propogations from the master
+		if c.slaveToMaster {
+			s.advanceReplicaOffset(msg)
+		}
+	})
+	if blockedOn != nil {
+		err = blockedOn()
+		if flushErr := c.flushReply(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+		s.exec.do(func() {
+			s.afterCommand(c)
+		})
+	}
+	fmt.Println("handled command: ", msg.data)
+	return err
+}
+
+// should be called from the executor
+//
+// runs the given command against the server, writing the reply to c
+func (s *Server) execute(c *Connection, msg Message) error {
+	var err error
+	cmd := strings.ToLower(msg.data[0])
+	if _, ok := subscriberModeCommands[cmd]; !ok && c.inSubscriberMode() {
+		c.Reply().WriteError(fmt.Sprintf(
+			"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context", cmd))
+		return nil
+	}
+	// replicas only apply the writes of their master, a refused write
+	// fails the transaction it is queued in
+	if s.replicaReadOnly && s.slaveConfig != nil && !c.slaveToMaster && isWriteCommand(cmd, msg.data) {
+		if c.inMulti() {
+			c.multi.aborted = true
+		}
+		c.Reply().WriteError("READONLY You can't write against a read only replica.")
+		return nil
+	}
+	if c.inMulti() && cmd != "exec" && cmd != "discard" {
+		s.queueCommand(c, msg)
+		return nil
+	}
+	// writes are refused unless enough replicas would receive them
+	if s.minReplicasToWrite > 0 && s.masterConfig != nil && isWriteCommand(cmd, msg.data) &&
+		s.goodReplicas() < s.minReplicasToWrite {
+		c.Reply().WriteError("NOREPLICAS Not enough good replicas to write.")
+		return nil
+	}
+	switch cmd {
 	case "ping":
 		err = s.processPingRequest(c, msg)
 	case "echo":
@@ -143,29 +672,124 @@ func (s *Server) handleRequest(c *Connection) error {
 		err = s.processGetRequest(c, msg)
 	case "set":
 		err = s.processSetRequest(c, msg)
+	case "pexpireat":
+		err = s.processPexpireatRequest(c, msg)
+	case "del":
+		err = s.processDelRequest(c, msg)
 	case "info":
 		err = s.processInfoRequest(c, msg)
 	case "replconf":
 		err = s.processReplConfRequest(c, msg)
 	case "psync":
-		err := s.processPsyncRequest(c, msg)
+		err = s.processPsyncRequest(c, msg)
 		fmt.Println("post psync req ", err)
-		if err == nil {
+		if err == nil && c.replica {
 			return ConnNotClientError
 		}
 	case "wait":
 		err = s.processWaitRequest(c, msg)
+	case "eval":
+		err = s.processEvalRequest(c, msg)
+	case "evalsha":
+		err = s.processEvalShaRequest(c, msg)
+	case "script":
+		err = s.processScriptRequest(c, msg)
+	case "function":
+		err = s.processFunctionRequest(c, msg)
+	case "fcall":
+		err = s.processFcallRequest(c, msg, false)
+	case "fcall_ro":
+		err = s.processFcallRequest(c, msg, true)
+	case "hello":
+		err = s.processHelloRequest(c, msg)
+	case "subscribe":
+		err = s.processSubscribeRequest(c, msg, channelSubscription)
+	case "psubscribe":
+		err = s.processSubscribeRequest(c, msg, patternSubscription)
+	case "ssubscribe":
+		err = s.processSubscribeRequest(c, msg, shardChannelSubscription)
+	case "unsubscribe":
+		err = s.processUnsubscribeRequest(c, msg, channelSubscription)
+	case "punsubscribe":
+		err = s.processUnsubscribeRequest(c, msg, patternSubscription)
+	case "sunsubscribe":
+		err = s.processUnsubscribeRequest(c, msg, shardChannelSubscription)
+	case "publish":
+		err = s.processPublishRequest(c, msg)
+	case "spublish":
+		err = s.processSpublishRequest(c, msg)
+	case "pubsub":
+		err = s.processPubSubRequest(c, msg)
+	case "client":
+		err = s.processClientRequest(c, msg)
+	case "auth":
+		err = s.processAuthRequest(c, msg)
+	case "acl":
+		err = s.processACLRequest(c, msg)
+	case "multi":
+		err = s.processMultiRequest(c, msg)
+	case "exec":
+		err = s.processExecRequest(c, msg)
+	case "discard":
+		err = s.processDiscardRequest(c, msg)
+	case "shutdown":
+		err = s.processShutdownRequest(c, msg)
+	case "replicaof", "slaveof":
+		err = s.processReplicaOfRequest(c, msg)
+	default:
+		c.Reply().WriteError(fmt.Sprintf("ERR unknown command '%s'", msg.data[0]))
 	}
-	// replicas should update their offset for all propogations from the master
-	if c.slaveToMaster {
-		s.incrementOffset(msg.readBytes)
-	}
-	fmt.Println("handled command: ", msg.data)
 	return err
 }
 
-func (s *Server) incrementOffset(i int) {
-	s.slaveConfig.offset += i
+// should be called from the executor
+func (s *Server) beforeCommand(c *Connection, msg Message) {
+	c.lastInteraction = time.Now()
+	c.lastCommand = strings.ToLower(msg.data[0])
+	if len(msg.data) > 1 && strings.ToLower(msg.data[0]) == "client" {
+		c.lastCommand += "|" + strings.ToLower(msg.data[1])
+	}
+	c.queryBuffer = c.rw.Reader.Buffered()
+	// the command after CLIENT REPLY SKIP is not replied to
+	if c.replyMode == replySkip {
+		c.replyMode = replyOn
+		c.skipping = true
+	}
+}
+
+// should be called from the executor
+func (s *Server) afterCommand(c *Connection) {
+	c.skipping = false
+	s.tracking.commandDone(c)
+	if c.closeAfterReply {
+		_ = c.flush()
+		c.Close()
+	}
+}
+
+// should be called from the executor
+//
+// moves the replica past a command of the replication stream, which is
+// kept in the backlog as well
+func (s *Server) advanceReplicaOffset(msg Message) {
+	sc := s.slaveConfig
+	sc.offset += msg.readBytes
+	if sc.backlog == nil {
+		return
+	}
+	raw := SerializeCommand(msg.data...)
+	if len(raw) != msg.readBytes {
+		// the command can't be replayed byte for byte, the history
+		// before it is lost
+		sc.backlog = newReplBacklog(s.replBacklogSize, sc.offset)
+		s.dropReplicas()
+		return
+	}
+	sc.backlog.write(raw)
+	// sub-replicas receive the stream exactly as it came from the master
+	if len(s.replicas) > 0 {
+		s.sendToReplicas(raw, fmt.Sprintf("%q", strings.Join(msg.data, " ")))
+	}
 }
 
 // handshake goes as:
@@ -175,27 +799,63 @@ func (s *Server) incrementOffset(i int) {
 // - slave sends REPLCONF twice to the master
 //
 // - slave sends PSYNC to the master
-func (s *Server) handshakeMaster() error {
-	c, err := net.Dial("tcp", fmt.Sprintf("%s", s.slaveConfig.addr))
-	conn := NewConn(c, true)
-	s.slaveConfig.conn = conn
+//
+// returns the link with the master once it is in sync, the link is
+// closed on failure
+func (s *Server) handshakeMaster(ctx context.Context, sc *slaveConfig) (*Connection, error) {
+	s.setReplState(sc, replStateConnect)
+	var c net.Conn
+	var err error
+	if s.tlsReplication {
+		d := tls.Dialer{Config: s.tls.clientConfig()}
+		c, err = d.DialContext(ctx, "tcp", sc.addr)
+	} else {
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", sc.addr)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	conn := NewConn(c, true)
+	// a master which stops answering fails the handshake instead of
+	// hanging it, cancelling ctx interrupts it right away
+	conn.readTimeout = s.replTimeout
+	c.SetWriteDeadline(time.Now().Add(s.replTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+	if err := s.syncWithMaster(sc, conn); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
 
-	err = s.pingMaster(conn)
+func (s *Server) syncWithMaster(sc *slaveConfig, conn *Connection) error {
+	s.setReplState(sc, replStateHandshake)
+	err := s.pingMaster(conn)
 	if err != nil {
 		return fmt.Errorf("error while pinging master: %w", err)
 	}
 
+	if s.masterPassword != "" {
+		err = s.authWithMaster(conn)
+		if err != nil {
+			return fmt.Errorf("error while authenticating with master: %w", err)
+		}
+	}
+
 	err = s.configureReplicationWithMaster(conn)
 	if err != nil {
 		return fmt.Errorf("error while configuring replication with master: %w", err)
 	}
 
-	err = s.psyncWithMaster(conn)
+	s.setReplState(sc, replStateSync)
+	err = s.psyncWithMaster(sc, conn)
 	if err != nil {
-		return fmt.Errorf("error while configuring replication with master: %w", err)
+		return fmt.Errorf("error while syncing with master: %w", err)
 	}
 
 	return nil
@@ -216,6 +876,11 @@ func (s *Server) pingMaster(c *Connection) error {
 	if err != nil {
 		return fmt.Errorf("master didn't response to ping: %w", err)
 	}
+	// a master requiring authentication refuses the ping,
+	// which still proves the link works
+	if strings.HasPrefix(resp, "-NOAUTH") {
+		return nil
+	}
 	pong, err := DeserializeSimpleString(resp)
 	if err != nil || strings.ToLower(pong) != "pong" {
 		return fmt.Errorf("expected master to reply pong got %s", pong)
@@ -223,6 +888,31 @@ func (s *Server) pingMaster(c *Connection) error {
 	return nil
 }
 
+func (s *Server) authWithMaster(c *Connection) error {
+	args := []string{SerializeBulkString("AUTH")}
+	if s.masterUser != "" {
+		args = append(args, SerializeBulkString(s.masterUser))
+	}
+	args = append(args, SerializeBulkString(s.masterPassword))
+	_, err := c.rw.WriteString(SerializeArray(args...))
+	if err != nil {
+		return err
+	}
+	err = c.rw.Flush()
+	if err != nil {
+		return err
+	}
+	resp, _, err := c.nextString()
+	if err != nil {
+		return fmt.Errorf("master didn't respond to AUTH: %w", err)
+	}
+	ok, err := DeserializeSimpleString(resp)
+	if err != nil || strings.ToLower(ok) != "ok" {
+		return fmt.Errorf("expected master to reply ok got %s", resp)
+	}
+	return nil
+}
+
 func (s *Server) configureReplicationWithMaster(c *Connection) error {
 	_, err := c.rw.WriteString(SerializeArray(
 		SerializeBulkString("REPLCONF"),
@@ -269,12 +959,17 @@ func (s *Server) configureReplicationWithMaster(c *Connection) error {
 	return nil
 }
 
-func (s *Server) psyncWithMaster(c *Connection) error {
-	_, err := c.rw.WriteString(SerializeArray(
-		SerializeBulkString("PSYNC"),
-		SerializeBulkString(fmt.Sprintf("?")),
-		SerializeBulkString(fmt.Sprintf("-1")),
-	))
+// asks to continue from the last known offset of the master's
+// replication stream, falling back to a full resync if the master
+// no longer holds it
+func (s *Server) psyncWithMaster(sc *slaveConfig, c *Connection) error {
+	replID, offset := "?", "-1"
+	s.exec.do(func() {
+		if sc.replID != "" {
+			replID, offset = sc.replID, strconv.Itoa(sc.offset)
+		}
+	})
+	_, err := c.rw.WriteString(SerializeCommand("PSYNC", replID, offset))
 	if err != nil {
 		return err
 	}
@@ -284,76 +979,212 @@ func (s *Server) psyncWithMaster(c *Connection) error {
 	}
 	resp, _, err := c.nextString()
 	if err != nil {
-		return fmt.Errorf("master didn't respond to REPLCONF: %w", err)
+		return fmt.Errorf("master didn't respond to PSYNC: %w", err)
 	}
-	_, err = DeserializeSimpleString(resp)
-
-	_, err = c.parseRDBFile()
-	if err != nil {
-		return fmt.Errorf("expected rdbfile but %w", err)
+	status, err := DeserializeSimpleString(resp)
+	fields := strings.Fields(status)
+	if err != nil || len(fields) == 0 {
+		return fmt.Errorf("expected master to reply FULLRESYNC or CONTINUE got %s", resp)
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "CONTINUE":
+		// the master sends the missed part of the stream right away
+		fmt.Printf("continuing replication from offset %s\n", offset)
+		s.exec.do(func() {
+			if s.slaveConfig != sc {
+				err = errReplicationStopped
+				return
+			}
+			if len(fields) > 1 && fields[1] != sc.replID {
+				// sub-replicas learn the new id when they reconnect and
+				// continue from the previous one
+				sc.replID2, sc.secondOffset = sc.replID, sc.offset
+				sc.replID = fields[1]
+				s.dropReplicas()
+			}
+			if sc.backlog == nil || sc.backlog.end != sc.offset {
+				sc.backlog = newReplBacklog(s.replBacklogSize, sc.offset)
+				s.dropReplicas()
+			}
+		})
+		return err
+	case "FULLRESYNC":
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed FULLRESYNC reply %s", status)
+		}
+		masterOffset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("malformed FULLRESYNC offset %s", fields[2])
+		}
+		payload, err := c.rdbPayload()
+		if err != nil {
+			return fmt.Errorf("expected rdbfile but %w", err)
+		}
+		load := s.loadSnapshot
+		var snapshot rdbSnapshot
+		if s.disklessLoad == disklessLoadSwapDB {
+			// the dataset is served until the new one is complete
+			fresh := NewStore()
+			fresh.keepExpired = true
+			snapshot, err = readRDB(payload, fresh.load)
+			load = func(snapshot rdbSnapshot) error {
+				if err := s.restoreFunctions(snapshot.functions, "flush"); err != nil {
+					return fmt.Errorf("couldn't load function libraries: %w", err)
+				}
+				fresh.notify = s.store.notify
+				fresh.schedule = s.store.schedule
+				s.store = fresh
+				return nil
+			}
+		} else {
+			var rdb []byte
+			if rdb, err = io.ReadAll(payload); err == nil {
+				snapshot, err = decodeRDB(rdb)
+			}
+		}
+		if err == nil {
+			// the checksum is left unread by the parser
+			_, err = io.Copy(io.Discard, payload)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't parse rdbfile: %w", err)
+		}
+		s.exec.do(func() {
+			// REPLICAOF may have moved on while the snapshot was transferred
+			if s.slaveConfig != sc {
+				err = errReplicationStopped
+				return
+			}
+			if s.disklessLoad != disklessLoadSwapDB {
+				s.store.clear()
+			}
+			if err = load(snapshot); err == nil {
+				sc.replID, sc.offset = fields[1], masterOffset
+				sc.replID2, sc.secondOffset = "", 0
+				sc.backlog = newReplBacklog(s.replBacklogSize, masterOffset)
+				// the history of the sub-replicas no longer matches
+				s.dropReplicas()
+			}
+		})
+		return err
+	default:
+		return fmt.Errorf("expected master to reply FULLRESYNC or CONTINUE got %s", status)
 	}
+}
 
+// replaces the dataset and the function libraries with the snapshot
+func (s *Server) loadSnapshot(snapshot rdbSnapshot) error {
+	if err := s.restoreFunctions(snapshot.functions, "flush"); err != nil {
+		return fmt.Errorf("couldn't load function libraries: %w", err)
+	}
+	for _, e := range snapshot.entries {
+		s.store.load(e)
+	}
 	return nil
 }
 
-// Sets given key to val
+// returns the rdb file which is sent to replicas on full resync
+// and saved on shutdown
+func (s *Server) snapshot() []byte {
+	return encodeRDB(s.snapshotState())
+}
+
+// should be called from the executor
 //
-// # If the server is master, also propagates the command to replicas
+// returns the dataset, the function libraries and the replication
+// offset they correspond to
+func (s *Server) snapshotState() rdbSnapshot {
+	snapshot := rdbSnapshot{
+		functions: s.functions.codes(),
+		entries:   s.store.entries(),
+	}
+	if s.masterConfig != nil {
+		snapshot.replID, snapshot.replOffset = s.masterConfig.id, s.masterConfig.offset
+	} else {
+		snapshot.replID, snapshot.replOffset = s.slaveConfig.replID, s.slaveConfig.offset
+	}
+	return snapshot
+}
+
+// should be called from the executor
 //
-// Setting operation itself cannot fail, not-nil error means
-// at least one replica failed during propagation
-func (s *Server) Set(key, val string) error {
-	s.store.Set(key, val)
+// # If the server is master, queues the command on the output buffer of
+// every replica
+//
+// not-nil error means at least one replica was dropped, either because
+// its link broke or because it fell too far behind
+func (s *Server) propagateCommand(args ...string) error {
 	if s.masterConfig == nil {
 		return nil
 	}
 
-	wg := sync.WaitGroup{}
-	propagationCmd := SerializeArray(
-		SerializeBulkString("SET"),
-		SerializeBulkString(key),
-		SerializeBulkString(val),
-	)
-	s.masterConfig.offset += len(propagationCmd)
-	for _, c := range s.masterConfig.slaves {
-		wg.Add(1)
-		go func(sc *SlaveConnection) {
-			defer wg.Done()
-			sc.lock.Lock()
-			defer sc.lock.Unlock()
-
-			command := fmt.Sprintf("\"%s %s %s\"", "SET", key, val)
-			addr := sc.conn.RemoteAddr().String()
-			fmt.Printf("syncing with slave %s, command: %s\n", addr, command)
-
-			_, err := sc.WriteString(propagationCmd)
-			if err != nil {
-				fmt.Printf(
-					"failure while propagating %s command to replica %s, error: %s",
-					command, addr, err)
-				return
-			}
+	propagationCmd := SerializeCommand(args...)
+	command := fmt.Sprintf("%q", strings.Join(args, " "))
+	s.feedReplicationStream(propagationCmd)
+	err := s.sendToReplicas(propagationCmd, command)
+	fmt.Printf("propagated command %s\n", command)
+	return err
+}
 
-			fmt.Printf("synced with slave %s, command %s\n", addr, command)
-		}(c)
+// should be called from the executor
+//
+// queues a part of the replication stream on the output buffer of every
+// replica, replicas dropped here resync when they reconnect
+func (s *Server) sendToReplicas(p string, command string) error {
+	var err error
+	for _, sc := range slices.Clone(s.replicas) {
+		if sendErr := sc.send(p); sendErr != nil {
+			fmt.Printf(
+				"failure while propagating %s command to replica %s, error: %s\n",
+				command, sc.conn.RemoteAddr(), sendErr)
+			s.removeReplica(sc)
+			err = errors.New("couldn't propagate the command to every replica")
+		}
 	}
-	wg.Wait()
-	fmt.Println("SET FINISHED")
-	return nil
+	return err
 }
 
-// `s *Server` should be locked when this function is called
+// should be called from the executor
+func (s *Server) removeReplica(sc *SlaveConnection) {
+	s.replicas = slices.DeleteFunc(s.replicas, func(other *SlaveConnection) bool {
+		return other == sc
+	})
+	sc.stopOutput()
+	sc.Close()
+	s.clients.remove(sc.Connection)
+	if len(s.replicas) == 0 && s.masterConfig != nil {
+		s.masterConfig.noReplicasSince = time.Now()
+	}
+}
+
+// should be called from the executor
+//
+// disconnects every replica, they resync when they reconnect
+func (s *Server) dropReplicas() {
+	for _, sc := range slices.Clone(s.replicas) {
+		s.removeReplica(sc)
+	}
+}
+
+// should be called from the executor
 //
-// channel sends when a slave's offset is equal to master's
-func (s *Server) SyncSlaves(ctx context.Context) <-chan int {
+// queues REPLCONF GETACK for every replica and sends, on the returned
+// channel, the number of replicas which acknowledged the target offset
+// so far, the channel is closed once ctx is done
+func (s *Server) SyncSlaves(ctx context.Context, target int) <-chan int {
+	replicas := slices.Clone(s.replicas)
 	var (
-		fanInChan = make(chan int, len(s.masterConfig.slaves))
-		ch        = make(chan int, len(s.masterConfig.slaves))
+		fanInChan = make(chan unit, len(replicas))
+		ch        = make(chan int, len(replicas))
 	)
-	s.masterConfig.offset += len(CommandReplConfGetAck)
-	for _, sc := range s.masterConfig.slaves {
-		sc := sc
-		go sc.Sync(ctx, fanInChan)
+	s.feedReplicationStream(CommandReplConfGetAck)
+	for _, sc := range replicas {
+		if err := sc.send(CommandReplConfGetAck); err != nil {
+			fmt.Printf("couldn't ask replica %s for its offset: %s\n", sc.conn.RemoteAddr(), err)
+			s.removeReplica(sc)
+			continue
+		}
+		go sc.waitOffset(ctx, target, fanInChan)
 	}
 
 	go func() {
@@ -363,12 +1194,9 @@ func (s *Server) SyncSlaves(ctx context.Context) <-chan int {
 			case <-ctx.Done():
 				close(ch)
 				return
-			case offset := <-fanInChan:
-				fmt.Printf("got offset %d, master is %d\n", offset, s.masterConfig.offset)
-				if offset == s.masterConfig.offset {
-					inSyncCount++
-					ch <- inSyncCount
-				}
+			case <-fanInChan:
+				inSyncCount++
+				ch <- inSyncCount
 			}
 		}
 	}()
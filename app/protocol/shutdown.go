@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// registers a goroutine serving a client, false once the server
+// is shutting down
+func (s *Server) trackHandler() bool {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if s.isStopping() {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stops accepting clients, lets the commands being executed finish and
+// closes every connection, the links with the master and the replicas
+// included
+//
+// connections still open once ctx expires are closed forcibly and the
+// running script, if any, is aborted
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopLock.Lock()
+	first := !s.isStopping()
+	if first {
+		close(s.stopping)
+	}
+	s.stopLock.Unlock()
+	if !first {
+		select {
+		case <-s.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	fmt.Println("shutting down")
+	defer s.exec.stop()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	// a busy script holds the executor until it returns
+	err := s.exec.doContext(ctx, func() {
+		if s.slaveConfig != nil && s.slaveConfig.cancel != nil {
+			s.slaveConfig.cancel()
+		}
+	})
+	// clients waiting for their next command are woken up right away,
+	// the others once their command is replied to
+	for _, c := range s.clients.list() {
+		if c.conn != nil {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+
+	drained := make(chan unit)
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.scripting.abort()
+		for _, c := range s.clients.list() {
+			if c.conn != nil {
+				c.Close()
+			}
+		}
+	}
+
+	// replicas get what is left in their output buffers before their
+	// links are closed
+	var replicas []*SlaveConnection
+	// the task may still run after ctx expired, it doesn't share
+	// variables with this goroutine
+	collected := make(chan []*SlaveConnection, 1)
+	if doErr := s.exec.doContext(ctx, func() {
+		var replicas []*SlaveConnection
+		if s.masterConfig != nil {
+			replicas = slices.Clone(s.replicas)
+		}
+		collected <- replicas
+	}); doErr == nil {
+		replicas = <-collected
+	} else if err == nil {
+		err = doErr
+	}
+	for _, sc := range replicas {
+		sc.stopOutput()
+		select {
+		case <-sc.stopped:
+		case <-ctx.Done():
+		}
+	}
+	for _, c := range s.clients.list() {
+		if c.replica {
+			c.Close()
+		}
+	}
+	close(s.done)
+	return err
+}
+
+// shuts the server down without blocking the caller, which is
+// one of the clients being drained
+func (s *Server) shutdownInBackground() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			fmt.Printf("shutdown didn't complete gracefully: %s\n", err)
+		}
+	}()
+}
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+//
+// waits for the replicas to catch up unless NOW is given, then saves the
+// snapshot if a snapshot file is configured or SAVE is given, the client
+// is not replied to when the server shuts down
+func (s *Server) processShutdownRequest(c *Connection, msg Message) error {
+	var save, noSave, now, force, abort bool
+	for _, arg := range msg.data[1:] {
+		switch strings.ToLower(arg) {
+		case "save":
+			save = true
+		case "nosave":
+			noSave = true
+		case "now":
+			now = true
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		default:
+			c.Reply().WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	if (save && noSave) || (abort && len(msg.data) > 2) {
+		c.Reply().WriteError("ERR syntax error")
+		return nil
+	}
+
+	if abort {
+		if s.abortShutdown == nil {
+			c.Reply().WriteError("ERR No shutdown in progress.")
+			return nil
+		}
+		s.abortShutdown()
+		s.abortShutdown = nil
+		c.Reply().WriteSimpleString("OK")
+		return nil
+	}
+	if s.abortShutdown != nil {
+		c.Reply().WriteError("ERR A shutdown is already in progress.")
+		return nil
+	}
+	if save && s.snapshotFile == "" {
+		c.Reply().WriteError("ERR no snapshot file configured, set dir and dbfilename")
+		return nil
+	}
+	save = !noSave && s.snapshotFile != ""
+
+	total := 0
+	if s.masterConfig != nil {
+		total = len(s.replicas)
+	}
+	if now || total == 0 {
+		s.finishShutdown(c, save, force)
+		return nil
+	}
+
+	// replicas are given a chance to receive the last writes, waiting
+	// can be cancelled with SHUTDOWN ABORT
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	s.abortShutdown = cancel
+	ch := s.SyncSlaves(ctx, s.masterConfig.offset)
+	s.blockClient(c, func() error {
+		defer cancel()
+		for inSyncCount := range ch {
+			if inSyncCount == total {
+				break
+			}
+		}
+		aborted := errors.Is(ctx.Err(), context.Canceled)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			fmt.Println("replicas didn't catch up before shutdown")
+		}
+		s.exec.do(func() {
+			if aborted {
+				c.Reply().WriteError("ERR Errors trying to SHUTDOWN. Check logs.")
+				return
+			}
+			s.abortShutdown = nil
+			s.finishShutdown(c, save, force)
+		})
+		return nil
+	})
+	return nil
+}
+
+// should be called from the executor
+func (s *Server) finishShutdown(c *Connection, save, force bool) {
+	if save {
+		if err := s.saveSnapshotFile(); err != nil {
+			fmt.Printf("couldn't save snapshot before shutdown: %s\n", err)
+			if !force {
+				c.Reply().WriteError("ERR Errors trying to SHUTDOWN. Check logs.")
+				return
+			}
+		}
+	}
+	s.shutdownInBackground()
+}
+
+// should be called from the executor
+//
+// writes the snapshot to a temporary file first, so that a failed
+// save never leaves a truncated snapshot behind
+func (s *Server) saveSnapshotFile() error {
+	f, err := os.CreateTemp(filepath.Dir(s.snapshotFile), filepath.Base(s.snapshotFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(s.snapshot()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.snapshotFile)
+}
+
+// a missing snapshot file starts the server empty
+func (s *Server) loadSnapshotFile() error {
+	data, err := os.ReadFile(s.snapshotFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot, err := decodeRDB(data)
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s: %w", s.snapshotFile, err)
+	}
+	if err := s.loadSnapshot(snapshot); err != nil {
+		return err
+	}
+	// the dataset continues the replication stream it was saved at, so
+	// that replicas and masters can resume with a partial resync
+	if snapshot.replID != "" {
+		if s.masterConfig != nil {
+			s.masterConfig.id, s.masterConfig.offset = snapshot.replID, snapshot.replOffset
+		} else {
+			s.slaveConfig.replID, s.slaveConfig.offset = snapshot.replID, snapshot.replOffset
+		}
+	}
+	return nil
+}
@@ -2,40 +2,232 @@ package protocol
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Store struct {
-	m    map[string]string
-	lock sync.RWMutex
+	m       map[string]string
+	expires map[string]time.Time
+	lock    sync.RWMutex
+	// counts the changes made to the dataset, expirations aside
+	dirty atomic.Int64
+
+	// called for every keyspace event, outside of the store lock
+	notify func(class int, event, key string)
+	// runs the work of the expiration timers, the server hands it to
+	// its executor so that expirations are serialized with commands
+	schedule func(fn func())
+	// set on replicas, which keep expired keys until their master
+	// deletes them, reads miss the keys in the meantime
+	keepExpired bool
 }
 
 func NewStore() *Store {
 	return &Store{
-		m:    make(map[string]string),
-		lock: sync.RWMutex{},
+		m:       make(map[string]string),
+		expires: make(map[string]time.Time),
+		lock:    sync.RWMutex{},
+	}
+}
+
+func (store *Store) emit(class int, event, key string) {
+	if store.notify != nil {
+		store.notify(class, event, key)
 	}
 }
 
+// deletes the key when expireAt is reached, unless its expiration
+// time changed in the meantime
+func (store *Store) expireLater(key string, expireAt time.Time) {
+	time.AfterFunc(time.Until(expireAt), func() {
+		if store.schedule == nil {
+			store.expire(key, expireAt)
+			return
+		}
+		store.schedule(func() {
+			store.expire(key, expireAt)
+		})
+	})
+}
+
 func (store *Store) Set(key, val string) {
 	store.lock.Lock()
-	defer store.lock.Unlock()
+	_, existed := store.m[key]
 	store.m[key] = val
+	delete(store.expires, key)
+	store.lock.Unlock()
+	store.dirty.Add(1)
+
+	if !existed {
+		store.emit(notifyNew, "new", key)
+	}
+	store.emit(notifyString, "set", key)
 }
 
 func (store *Store) Get(key string) (string, bool) {
 	store.lock.RLock()
-	defer store.lock.RUnlock()
 	val, ok := store.m[key]
-	return val, ok
+	expireAt, hasTTL := store.expires[key]
+	store.lock.RUnlock()
+
+	// the expiration timer might not have fired yet
+	if ok && hasTTL && !time.Now().Before(expireAt) {
+		store.expire(key, expireAt)
+		ok = false
+	}
+	if !ok {
+		store.emit(notifyKeyMiss, "keymiss", key)
+		return "", false
+	}
+	return val, true
 }
 
-func (store *Store) SetWithTTL(key string, val string, ttl time.Duration) {
-	store.Set(key, val)
-	go func() {
-		time.Sleep(ttl)
-		store.lock.Lock()
-		defer store.lock.Unlock()
+// returns false if the key does not exist
+func (store *Store) Delete(key string) bool {
+	store.lock.Lock()
+	_, ok := store.m[key]
+	expireAt, hasTTL := store.expires[key]
+	expired := ok && hasTTL && !time.Now().Before(expireAt)
+	if expired && !store.keepExpired {
+		store.lock.Unlock()
+		store.expire(key, expireAt)
+		return false
+	}
+	delete(store.m, key)
+	delete(store.expires, key)
+	store.lock.Unlock()
+	if !ok {
+		return false
+	}
+	store.dirty.Add(1)
+	store.emit(notifyGeneric, "del", key)
+	return !expired
+}
+
+// returns the time at which the key expires
+func (store *Store) SetWithTTL(key string, val string, ttl time.Duration) time.Time {
+	expireAt := time.Now().Add(ttl)
+	store.lock.Lock()
+	_, existed := store.m[key]
+	store.m[key] = val
+	store.expires[key] = expireAt
+	store.lock.Unlock()
+	store.dirty.Add(1)
+
+	if !existed {
+		store.emit(notifyNew, "new", key)
+	}
+	store.emit(notifyString, "set", key)
+	store.emit(notifyGeneric, "expire", key)
+
+	store.expireLater(key, expireAt)
+	return expireAt
+}
+
+// sets the expiration time of an existing key, the key is deleted
+// right away if the time already passed
+//
+// returns false if the key does not exist
+func (store *Store) ExpireAt(key string, expireAt time.Time) bool {
+	now := time.Now()
+	store.lock.Lock()
+	_, ok := store.m[key]
+	if current, hasTTL := store.expires[key]; ok && hasTTL && !now.Before(current) {
+		ok = false
+	}
+	if !ok {
+		store.lock.Unlock()
+		return false
+	}
+	if !now.Before(expireAt) {
 		delete(store.m, key)
-	}()
+		delete(store.expires, key)
+		store.lock.Unlock()
+		store.dirty.Add(1)
+		store.emit(notifyGeneric, "del", key)
+		return true
+	}
+	store.expires[key] = expireAt
+	store.lock.Unlock()
+	store.dirty.Add(1)
+	store.emit(notifyGeneric, "expire", key)
+
+	store.expireLater(key, expireAt)
+	return true
+}
+
+// deletes the key if its expiration time is still expireAt,
+// the key might have been overwritten since the timer was set
+func (store *Store) expire(key string, expireAt time.Time) {
+	// replicas wait for the DEL of their master
+	if store.keepExpired {
+		return
+	}
+	store.lock.Lock()
+	current, ok := store.expires[key]
+	if !ok || !current.Equal(expireAt) {
+		store.lock.Unlock()
+		return
+	}
+	delete(store.m, key)
+	delete(store.expires, key)
+	store.lock.Unlock()
+
+	store.emit(notifyExpired, "expired", key)
+}
+
+// deletes the keys whose expiration time passed, a replica promoted to
+// master expires the keys it kept for its master
+func (store *Store) expireDue() {
+	now := time.Now()
+	store.lock.RLock()
+	due := make(map[string]time.Time)
+	for key, expireAt := range store.expires {
+		if !now.Before(expireAt) {
+			due[key] = expireAt
+		}
+	}
+	store.lock.RUnlock()
+	for key, expireAt := range due {
+		store.expire(key, expireAt)
+	}
+}
+
+// returns the keys which have not expired yet along with their values
+// and expiration times
+func (store *Store) entries() []rdbEntry {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	now := time.Now()
+	entries := make([]rdbEntry, 0, len(store.m))
+	for key, val := range store.m {
+		expireAt, hasTTL := store.expires[key]
+		if hasTTL && !now.Before(expireAt) {
+			continue
+		}
+		entries = append(entries, rdbEntry{key: key, val: val, expireAt: expireAt})
+	}
+	return entries
+}
+
+// adds a key read from an rdb file, keys which expired since are skipped
+func (store *Store) load(e rdbEntry) {
+	if e.expireAt.IsZero() {
+		store.Set(e.key, e.val)
+		return
+	}
+	ttl := time.Until(e.expireAt)
+	if ttl <= 0 {
+		return
+	}
+	store.SetWithTTL(e.key, e.val, ttl)
+}
+
+// removes every key, without keyspace events
+func (store *Store) clear() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.m = make(map[string]string)
+	store.expires = make(map[string]time.Time)
 }
@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// parses the tls-auth-clients setting, `yes` requires clients to present
+// a certificate signed by the CA while `optional` only verifies it if given
+func ParseTLSAuthClients(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "yes":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "no":
+		return tls.NoClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("tls-auth-clients should be yes, no or optional, got %s", mode)
+	}
+}
+
+// certificates used by the tls listener and by replication links
+//
+// the files are checked for modifications on every handshake so that
+// rotated certificates are picked up without a restart
+type tlsContext struct {
+	port       int
+	certFile   string
+	keyFile    string
+	caCertFile string
+	clientAuth tls.ClientAuthType
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes [3]time.Time
+}
+
+func newTLSContext(port int, certFile, keyFile, caCertFile string, clientAuth tls.ClientAuthType) *tlsContext {
+	return &tlsContext{
+		port:       port,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caCertFile: caCertFile,
+		clientAuth: clientAuth,
+		lock:       sync.Mutex{},
+	}
+}
+
+func fileModTime(path string) (time.Time, error) {
+	if path == "" {
+		return time.Time{}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// loads the certificate and the CA bundle again if any of the files changed
+func (t *tlsContext) reload() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var modTimes [3]time.Time
+	for i, path := range []string{t.certFile, t.keyFile, t.caCertFile} {
+		modTime, err := fileModTime(path)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = modTime
+	}
+	if modTimes == t.modTimes && (t.cert != nil || t.certFile == "") {
+		return nil
+	}
+
+	var cert *tls.Certificate
+	if t.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return fmt.Errorf("couldn't load certificate: %w", err)
+		}
+		cert = &loaded
+	}
+	var caPool *x509.CertPool
+	if t.caCertFile != "" {
+		pem, err := os.ReadFile(t.caCertFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read CA certificate: %w", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", t.caCertFile)
+		}
+	}
+	t.cert, t.caPool, t.modTimes = cert, caPool, modTimes
+	return nil
+}
+
+// returns the loaded certificates, a failing reload keeps the previous ones
+func (t *tlsContext) current() (*tls.Certificate, *x509.CertPool) {
+	if err := t.reload(); err != nil {
+		fmt.Printf("error reloading tls certificates, keeping the loaded ones: %s\n", err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.cert, t.caPool
+}
+
+func (t *tlsContext) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, caPool := t.current()
+			if cert == nil {
+				return nil, errors.New("no certificate configured")
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    caPool,
+				ClientAuth:   t.clientAuth,
+			}, nil
+		},
+	}
+}
+
+// config used to dial the master, the certificate chain of the master is
+// verified against the CA but, as replicas are configured by address,
+// its host name is not
+func (t *tlsContext) clientConfig() *tls.Config {
+	cert, caPool := t.current()
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				parsed, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs[i] = parsed
+			}
+			if len(certs) == 0 {
+				return errors.New("master presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         caPool,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// completes the tls handshake before the connection is served so that
+// clients failing it are dropped right away
+func handshakeTLS(c net.Conn) error {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	_ = tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
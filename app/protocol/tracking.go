@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const invalidationChannel = "__redis__:invalidate"
+
+type trackingCaching int
+
+const (
+	cachingUnset trackingCaching = iota
+	cachingYes
+	cachingNo
+)
+
+type trackingOptions struct {
+	redirect int64
+	prefixes []string
+	bcast    bool
+	optIn    bool
+	optOut   bool
+	noLoop   bool
+}
+
+// per connection client side caching state, guarded by the tracking table lock
+type trackingState struct {
+	trackingOptions
+
+	// set by CLIENT CACHING, applies only to the next command
+	caching     trackingCaching
+	keepCaching bool
+}
+
+// remembers which clients may have cached which keys, so that
+// they can be sent invalidation messages when the keys change
+type trackingTable struct {
+	lock     sync.Mutex
+	keys     map[string]map[*Connection]unit
+	prefixes map[string]map[*Connection]unit
+
+	// used to look up redirection targets
+	clients *clientRegistry
+	pubsub  *pubSub
+}
+
+func newTrackingTable(clients *clientRegistry, pubsub *pubSub) *trackingTable {
+	return &trackingTable{
+		lock:     sync.Mutex{},
+		keys:     make(map[string]map[*Connection]unit),
+		prefixes: make(map[string]map[*Connection]unit),
+		clients:  clients,
+		pubsub:   pubsub,
+	}
+}
+
+func (tt *trackingTable) enable(c *Connection, opts trackingOptions) error {
+	if opts.optIn && opts.optOut {
+		return errors.New("ERR You can't use both OPTIN and OPTOUT")
+	}
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		return errors.New("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if opts.bcast && (opts.optIn || opts.optOut) {
+		return errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if opts.bcast && len(opts.prefixes) == 0 {
+		// without prefixes every key is broadcast
+		opts.prefixes = []string{""}
+	}
+
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.removePrefixes(c)
+	c.tracking = &trackingState{trackingOptions: opts}
+	for _, prefix := range opts.prefixes {
+		if tt.prefixes[prefix] == nil {
+			tt.prefixes[prefix] = make(map[*Connection]unit)
+		}
+		tt.prefixes[prefix][c] = unit{}
+	}
+	return nil
+}
+
+func (tt *trackingTable) disable(c *Connection) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.removePrefixes(c)
+	// remembered keys are dropped lazily on the next invalidation
+	c.tracking = nil
+}
+
+// the table should be locked
+func (tt *trackingTable) removePrefixes(c *Connection) {
+	if c.tracking == nil {
+		return
+	}
+	for _, prefix := range c.tracking.prefixes {
+		delete(tt.prefixes[prefix], c)
+		if len(tt.prefixes[prefix]) == 0 {
+			delete(tt.prefixes, prefix)
+		}
+	}
+}
+
+func (tt *trackingTable) setCaching(c *Connection, caching trackingCaching) error {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if c.tracking == nil {
+		return errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	if caching == cachingYes && !c.tracking.optIn {
+		return errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	if caching == cachingNo && !c.tracking.optOut {
+		return errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	c.tracking.caching = caching
+	c.tracking.keepCaching = true
+	return nil
+}
+
+// called after every command, CLIENT CACHING only affects the command after it
+func (tt *trackingTable) commandDone(c *Connection) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if c.tracking == nil {
+		return
+	}
+	if c.tracking.keepCaching {
+		c.tracking.keepCaching = false
+		return
+	}
+	c.tracking.caching = cachingUnset
+}
+
+// remembers that the client read the key, in default tracking mode
+func (tt *trackingTable) remember(c *Connection, key string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	t := c.tracking
+	if t == nil || t.bcast {
+		return
+	}
+	if t.optIn && t.caching != cachingYes {
+		return
+	}
+	if t.optOut && t.caching == cachingNo {
+		return
+	}
+	if tt.keys[key] == nil {
+		tt.keys[key] = make(map[*Connection]unit)
+	}
+	tt.keys[key][c] = unit{}
+}
+
+// sends invalidation messages for the key to every client which might
+// have cached it, writer is the client which modified the key, nil if
+// the key got modified by the server itself
+func (tt *trackingTable) invalidate(key string, writer *Connection) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	for c := range tt.keys[key] {
+		tt.sendInvalidation(c, key, writer)
+	}
+	delete(tt.keys, key)
+	for prefix, clients := range tt.prefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for c := range clients {
+			tt.sendInvalidation(c, key, writer)
+		}
+	}
+}
+
+// the table should be locked
+func (tt *trackingTable) sendInvalidation(c *Connection, key string, writer *Connection) {
+	t := c.tracking
+	// tracking might have been turned off since the key was read
+	if t == nil {
+		return
+	}
+	if t.noLoop && c == writer {
+		return
+	}
+
+	target := c
+	if t.redirect != 0 {
+		redirected, ok := tt.clients.get(t.redirect)
+		if !ok {
+			return
+		}
+		target = redirected
+	}
+
+	w := target.pushWriter()
+	if target.protocol >= 3 {
+		w.WritePushHeader(2)
+		w.WriteBulkString("invalidate")
+		w.WriteBulkStrings([]string{key})
+		target.Push(w.buf)
+		return
+	}
+	// RESP2 clients receive invalidations through the pub/sub channel
+	if tt.pubsub.isSubscribed(target, invalidationChannel) {
+		w.WriteArrayHeader(3)
+		w.WriteBulkString("message")
+		w.WriteBulkString(invalidationChannel)
+		w.WriteBulkStrings([]string{key})
+		target.Push(w.buf)
+	}
+}
+
+func (tt *trackingTable) redirection(c *Connection) int64 {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if c.tracking == nil {
+		return -1
+	}
+	return c.tracking.redirect
+}
+
+// writes the CLIENT TRACKINGINFO reply of the client
+func (tt *trackingTable) info(c *Connection, w *ReplyWriter) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	t := c.tracking
+	flags := []string{"off"}
+	redirect := int64(-1)
+	prefixes := []string{}
+	if t != nil {
+		flags[0] = "on"
+		for _, flag := range []struct {
+			name string
+			set  bool
+		}{
+			{"bcast", t.bcast},
+			{"optin", t.optIn},
+			{"optout", t.optOut},
+			{"caching-yes", t.caching == cachingYes},
+			{"caching-no", t.caching == cachingNo},
+			{"noloop", t.noLoop},
+		} {
+			if flag.set {
+				flags = append(flags, flag.name)
+			}
+		}
+		redirect = t.redirect
+		prefixes = t.prefixes
+	}
+
+	w.WriteMapHeader(3)
+	w.WriteBulkString("flags")
+	w.WriteBulkStrings(flags)
+	w.WriteBulkString("redirect")
+	w.WriteInt(int(redirect))
+	w.WriteBulkString("prefixes")
+	w.WriteBulkStrings(prefixes)
+}
+
+// removes a disconnecting client from the table
+func (tt *trackingTable) removeConnection(c *Connection) {
+	tt.disable(c)
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	for key, clients := range tt.keys {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(tt.keys, key)
+		}
+	}
+}
@@ -14,23 +14,10 @@ func DeserializeSimpleString(s string) (string, error) {
 	ret := s[1:]
 	return ret, nil
 }
-func SerializeSimpleString(s string) string {
-	v := fmt.Sprintf("+%s\r\n", s)
-	return v
-}
 func DeserializeSimpleError(s string) (string, error) {
 	ret := s[1:]
 	return ret, nil
 }
-func SerializeSimpleError(s string) string {
-	v := fmt.Sprintf("-%s\r\n", s)
-	return v
-}
-
-func SerializeInteger(i int) string {
-	return fmt.Sprintf(":%d\r\n", i)
-}
-
 func DeserializeBulkString(data string) string {
 	return data
 }
@@ -38,9 +25,6 @@ func SerializeBulkString(s string) string {
 	v := fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
 	return v
 }
-func SerializeNullBulkString() string {
-	return "$-1\r\n"
-}
 func SerializeArray(elements ...string) string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("*%d\r\n", len(elements)))
@@ -49,3 +33,12 @@ func SerializeArray(elements ...string) string {
 	}
 	return sb.String()
 }
+
+// serializes a command as sent by clients, an array of bulk strings
+func SerializeCommand(args ...string) string {
+	elements := make([]string, len(args))
+	for i, arg := range args {
+		elements[i] = SerializeBulkString(arg)
+	}
+	return SerializeArray(elements...)
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/protocol"
 )
@@ -21,29 +27,159 @@ func main() {
 	// You can use print statements as follows for debugging, they'll be visible when running tests.
 	fmt.Println("logs from your program will appear here!")
 
-	port := flag.Int("port", 6379, "port of the instance")
-	masterAddr := flag.String("replicaof", "-1", "address of the master")
+	cfg := config{addr: "0.0.0.0"}
+	flag.IntVar(&cfg.port, "port", 6379, "port of the instance, 0 disables the tcp listener")
+	flag.StringVar(&cfg.masterAddr, "replicaof", "-1", "address of the master")
+	flag.StringVar(&cfg.masterUser, "masteruser", "", "user to authenticate with the master as")
+	flag.StringVar(&cfg.masterAuth, "masterauth", "", "password to authenticate with the master")
+	flag.StringVar(&cfg.aclFile, "aclfile", "", "path of the file users are loaded from and saved to")
+	flag.StringVar(&cfg.unixSocket, "unixsocket", "", "path of the unix socket to listen on")
+	flag.StringVar(&cfg.unixSocketPerm, "unixsocketperm", "0", "octal permissions of the unix socket, 0 keeps the default")
+	flag.IntVar(&cfg.tlsPort, "tls-port", 0, "port of the tls listener, 0 disables it")
+	flag.StringVar(&cfg.tlsCertFile, "tls-cert-file", "", "certificate presented to clients and masters")
+	flag.StringVar(&cfg.tlsKeyFile, "tls-key-file", "", "private key of the certificate")
+	flag.StringVar(&cfg.tlsCACertFile, "tls-ca-cert-file", "", "CA bundle used to verify clients and masters")
+	flag.StringVar(&cfg.tlsAuthClients, "tls-auth-clients", "yes", "whether tls clients must present a certificate: yes, no or optional")
+	flag.StringVar(&cfg.tlsReplication, "tls-replication", "no", "whether replicas connect to their master over tls: yes or no")
+	flag.IntVar(&cfg.busyTimeout, "busy-reply-threshold", 5000, "milliseconds a script can run before other clients are replied with BUSY")
+	flag.StringVar(&cfg.keyspaceEvents, "notify-keyspace-events", "", "classes of keyspace events published to subscribers")
+	flag.IntVar(&cfg.replBacklogSize, "repl-backlog-size", 1024*1024, "bytes of the replication stream kept for replicas to resume from")
+	flag.IntVar(&cfg.replBacklogTTL, "repl-backlog-ttl", 3600, "seconds the backlog is kept without replicas, 0 keeps it forever")
+	flag.IntVar(&cfg.replTimeout, "repl-timeout", 60, "seconds without traffic after which a replication link is considered dead")
+	flag.IntVar(&cfg.replPingPeriod, "repl-ping-replica-period", 10, "seconds between the pings masters send to their replicas")
+	flag.StringVar(&cfg.dir, "dir", "", "directory of the snapshot file")
+	flag.StringVar(&cfg.dbFilename, "dbfilename", "", "name of the snapshot file loaded on start and saved by SHUTDOWN")
+	flag.StringVar(&cfg.replicaOutputLimit, "client-output-buffer-limit-replica", "256mb 64mb 60", "hard limit, soft limit and soft seconds of the output buffers of replicas")
+	flag.IntVar(&cfg.minReplicasToWrite, "min-replicas-to-write", 0, "writes are refused with fewer replicas acknowledging their offset, 0 disables the check")
+	flag.IntVar(&cfg.minReplicasMaxLag, "min-replicas-max-lag", 10, "seconds since its last acknowledgement for a replica to count toward min-replicas-to-write")
+	flag.StringVar(&cfg.replicaReadOnly, "replica-read-only", "yes", "whether replicas refuse writes from clients: yes or no")
+	flag.StringVar(&cfg.disklessSync, "repl-diskless-sync", "no", "whether full resyncs stream the snapshot straight to replicas: yes or no")
+	flag.IntVar(&cfg.disklessSyncDelay, "repl-diskless-sync-delay", 5, "seconds to wait for more replicas before starting a diskless transfer")
+	flag.StringVar(&cfg.disklessLoad, "repl-diskless-load", "disabled", "how replicas load the snapshot of a full resync: disabled or swapdb")
 	flag.Parse()
-	server, err := initServer("0.0.0.0", *port, masterAddr)
+	server, err := initServer(cfg)
 	if err != nil {
 		log.Fatalf("couldn't initialize server: %s", err)
 	}
 
-	if err = server.Listen(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = server.Start(ctx); err != nil {
 		log.Fatal(fmt.Errorf("error while listening %s", err))
 	}
+	<-server.Done()
 }
 
-func initServer(addr string, port int, masterAddr *string) (*protocol.Server, error) {
+// settings given through the command line
+type config struct {
+	addr            string
+	port            int
+	masterAddr      string
+	masterUser      string
+	masterAuth      string
+	aclFile         string
+	unixSocket      string
+	unixSocketPerm  string
+	tlsPort         int
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsCACertFile   string
+	tlsAuthClients  string
+	tlsReplication  string
+	busyTimeout     int
+	keyspaceEvents  string
+	dir             string
+	dbFilename      string
+	replBacklogSize int
+	replBacklogTTL  int
+	replTimeout     int
+	replPingPeriod  int
+	// hard limit, soft limit and soft seconds, such as "256mb 64mb 60"
+	replicaOutputLimit string
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+	replicaReadOnly    string
+	disklessSync       string
+	disklessSyncDelay  int
+	disklessLoad       string
+}
+
+func initServer(cfg config) (*protocol.Server, error) {
+	eventClasses, err := protocol.ParseKeyspaceEventFlags(cfg.keyspaceEvents)
+	if err != nil {
+		return nil, err
+	}
+	hard, soft, softFor, err := parseOutputBufferLimit(cfg.replicaOutputLimit)
+	if err != nil {
+		return nil, fmt.Errorf("given client-output-buffer-limit is invalid: %s", err)
+	}
 	rsOpts := []protocol.ServerOptFunc{
-		protocol.WithAddressAndPort(addr, port),
+		protocol.WithAddressAndPort(cfg.addr, cfg.port),
+		protocol.WithBusyScriptTimeout(time.Duration(cfg.busyTimeout) * time.Millisecond),
+		protocol.WithKeyspaceEvents(eventClasses),
+		protocol.WithReplBacklog(cfg.replBacklogSize, time.Duration(cfg.replBacklogTTL)*time.Second),
+		protocol.WithReplTimeout(time.Duration(cfg.replTimeout)*time.Second, time.Duration(cfg.replPingPeriod)*time.Second),
+		protocol.WithReplicaOutputBufferLimit(hard, soft, softFor),
+		protocol.WithMinReplicas(cfg.minReplicasToWrite, time.Duration(cfg.minReplicasMaxLag)*time.Second),
+	}
+	if cfg.port == 0 {
+		rsOpts = append(rsOpts, protocol.WithoutTCP())
+	}
+	if cfg.unixSocket != "" {
+		perm, err := strconv.ParseUint(cfg.unixSocketPerm, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("given unixsocketperm is invalid: %s", err)
+		}
+		rsOpts = append(rsOpts, protocol.WithUnixSocket(cfg.unixSocket, os.FileMode(perm)))
+	}
+	if cfg.tlsPort != 0 || cfg.tlsCertFile != "" {
+		clientAuth, err := protocol.ParseTLSAuthClients(cfg.tlsAuthClients)
+		if err != nil {
+			return nil, err
+		}
+		rsOpts = append(rsOpts, protocol.WithTLS(cfg.tlsPort, cfg.tlsCertFile, cfg.tlsKeyFile, cfg.tlsCACertFile, clientAuth))
+	}
+	switch cfg.tlsReplication {
+	case "yes":
+		rsOpts = append(rsOpts, protocol.WithTLSReplication(true))
+	case "no":
+	default:
+		return nil, fmt.Errorf("tls-replication should be yes or no, got %s", cfg.tlsReplication)
+	}
+	switch cfg.replicaReadOnly {
+	case "yes":
+	case "no":
+		rsOpts = append(rsOpts, protocol.WithReplicaReadOnly(false))
+	default:
+		return nil, fmt.Errorf("replica-read-only should be yes or no, got %s", cfg.replicaReadOnly)
+	}
+	switch cfg.disklessSync {
+	case "yes":
+		rsOpts = append(rsOpts, protocol.WithDisklessSync(true, time.Duration(cfg.disklessSyncDelay)*time.Second))
+	case "no":
+	default:
+		return nil, fmt.Errorf("repl-diskless-sync should be yes or no, got %s", cfg.disklessSync)
+	}
+	rsOpts = append(rsOpts, protocol.WithDisklessLoad(cfg.disklessLoad))
+	if cfg.dir != "" || cfg.dbFilename != "" {
+		dir, name := cfg.dir, cfg.dbFilename
+		if dir == "" {
+			dir = "."
+		}
+		if name == "" {
+			name = "dump.rdb"
+		}
+		rsOpts = append(rsOpts, protocol.WithSnapshotFile(filepath.Join(dir, name)))
+	}
+	if cfg.aclFile != "" {
+		rsOpts = append(rsOpts, protocol.WithACLFile(cfg.aclFile))
 	}
 
 	// is this instance a replica
-	if *masterAddr != "-1" {
+	if cfg.masterAddr != "-1" {
 		args := os.Args
 		replicaOfIdx := slices.IndexFunc(args, func(arg string) bool {
-			return arg == *masterAddr
+			return arg == cfg.masterAddr
 		})
 		// replicaOfIdx cannot be -1 as masterAddr is not -1
 		// no need to check
@@ -56,8 +192,57 @@ func initServer(addr string, port int, masterAddr *string) (*protocol.Server, er
 		if err != nil {
 			return nil, fmt.Errorf("given master port is invalid: %s", err)
 		}
-		rsOpts = append(rsOpts, protocol.WithMasterAs(*masterAddr, masterPort))
+		rsOpts = append(rsOpts,
+			protocol.WithMasterAs(cfg.masterAddr, masterPort),
+		)
 	}
+	// kept for masters as well, which can become replicas through REPLICAOF
+	rsOpts = append(rsOpts, protocol.WithMasterAuth(cfg.masterUser, cfg.masterAuth))
 
 	return protocol.NewServer(rsOpts)
 }
+
+func parseOutputBufferLimit(limit string) (int, int, time.Duration, error) {
+	fields := strings.Fields(limit)
+	if len(fields) != 3 {
+		return 0, 0, 0, errors.New("expected a hard limit, a soft limit and soft seconds")
+	}
+	hard, err := parseMemory(fields[0])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	soft, err := parseMemory(fields[1])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	seconds, err := strconv.Atoi(fields[2])
+	if err != nil || seconds < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid soft seconds %s", fields[2])
+	}
+	return hard, soft, time.Duration(seconds) * time.Second, nil
+}
+
+// parses sizes such as 64mb or 1gb, plain numbers are bytes
+func parseMemory(size string) (int, error) {
+	units := []struct {
+		suffix string
+		bytes  int
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	lower := strings.ToLower(size)
+	mul := 1
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the settings of the command line flags left to their defaults
+func testConfig() config {
+	return config{
+		addr:               "127.0.0.1",
+		masterAddr:         "-1",
+		unixSocketPerm:     "0",
+		tlsAuthClients:     "yes",
+		tlsReplication:     "no",
+		busyTimeout:        5000,
+		replBacklogSize:    1024 * 1024,
+		replBacklogTTL:     3600,
+		replTimeout:        60,
+		replPingPeriod:     10,
+		replicaOutputLimit: "256mb 64mb 60",
+		minReplicasMaxLag:  10,
+		replicaReadOnly:    "yes",
+		disklessSync:       "no",
+		disklessSyncDelay:  5,
+		disklessLoad:       "disabled",
+	}
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	// a socket left behind by a previous run is replaced
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.port = 0
+	cfg.unixSocket = path
+	cfg.unixSocketPerm = "700"
+	s, err := initServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	if s.Addr() != nil {
+		t.Fatal("port 0 should disable the tcp listener")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o700 {
+		t.Fatalf("got mode %s, want a socket with 0700 permissions", info.Mode())
+	}
+	nc, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := nc.Write([]byte("*2\r\n$6\r\nCLIENT\r\n$4\r\nINFO\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(nc)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(line, " flags=U ") {
+		t.Fatalf("got %q %v, want the client flagged as a unix socket client", line, err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for name, edit := range map[string]func(*config){
+		"unixsocketperm":                     func(cfg *config) { cfg.unixSocket, cfg.unixSocketPerm = "redis.sock", "9" },
+		"notify-keyspace-events":             func(cfg *config) { cfg.keyspaceEvents = "Kq" },
+		"client-output-buffer-limit-replica": func(cfg *config) { cfg.replicaOutputLimit = "1mb 2mb" },
+		"replica-read-only":                  func(cfg *config) { cfg.replicaReadOnly = "maybe" },
+		"repl-diskless-sync":                 func(cfg *config) { cfg.disklessSync = "1" },
+		"repl-diskless-load":                 func(cfg *config) { cfg.disklessLoad = "on-empty-db" },
+		"tls-replication":                    func(cfg *config) { cfg.tlsReplication = "always" },
+		"repl-backlog-size":                  func(cfg *config) { cfg.replBacklogSize = 0 },
+	} {
+		cfg := testConfig()
+		edit(&cfg)
+		if _, err := initServer(cfg); err == nil {
+			t.Errorf("%s: the invalid setting was accepted", name)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	for size, want := range map[string]int{"10": 10, "1k": 1000, "1kb": 1024, "64mb": 64 << 20, "2G": 2e9, "0b": 0} {
+		if got, err := parseMemory(size); err != nil || got != want {
+			t.Errorf("%s: got %d %v, want %d", size, got, err, want)
+		}
+	}
+	for _, size := range []string{"", "-1", "mb", "1tb"} {
+		if _, err := parseMemory(size); err == nil {
+			t.Errorf("%s: the invalid size was accepted", size)
+		}
+	}
+}
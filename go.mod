@@ -9,3 +9,5 @@
 module github.com/codecrafters-io/redis-starter-go
 
 go 1.19
+
+require github.com/yuin/gopher-lua v1.1.1